@@ -4,76 +4,561 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
 )
 
 const (
-	maxToolResultChars = 100000
+	defaultAzureAPIVersion  = "2024-06-01"
+	defaultAnthropicVersion = "2023-06-01"
+)
+
+// todosFile keeps the todo board in the workspace between runs.
+const todosFile = ".mcc-todos.json"
+
+// memoryFile holds the facts saved with memory_set, relative to the workspace.
+const memoryFile = ".mcc/memory.json"
+
+const (
+	maxMemoryEntries     = 200
+	maxMemoryKeyLen      = 100
+	maxMemoryValueChars  = 2000
+	maxMemoryInjectChars = 4000
+)
+
+// maxAuditFieldChars bounds each string argument and the result recorded in
+// the audit log.
+const maxAuditFieldChars = 4000
+
+// defaultStreamMaxLine bounds one line of a streamed reply. bufio.Scanner
+// stops at 64KB by default, and a single chunk with a large tool-call
+// argument delta can be longer than that.
+const defaultStreamMaxLine = 8 << 20
+
+// minWrapWidth is the narrowest WRAP_WIDTH accepted.
+const minWrapWidth = 20
+
+// maxShownResultChars is how much of a tool result is printed unless it is
+// paged.
+const maxShownResultChars = 2000
+
+// subLineIndent lines continuation lines up under the text after "  -> ".
+const subLineIndent = "     "
+
+// maxMentionBytes is the largest file an @mention attaches.
+const maxMentionBytes = 1 << 20
+
+// maxProjectContextChars bounds how much of the project context file goes
+// into the system prompt.
+const maxProjectContextChars = 20000
+
+const (
+	defaultToolResults = 100000
 	defaultMaxTokens   = 8192
-	maxAgentIterations = 20
+	defaultIterations  = 20
 	spinnerTick        = 80 * time.Millisecond
-	maxTodoItems       = 20
+	defaultTodoItems   = 20
+	defaultTodoNag     = 10
+	maxReadFilesPaths  = 20
+	minReadFilesChars  = 2000
+	maxGitFilesEntries = 1000
+	maxDataFileBytes   = 20 << 20
+	maxComputeExprLen  = 1000
+	maxComputeDepth    = 50
+	maxComputeString   = 10000
+	binarySniffBytes   = 8000
+	defaultGrepResults = 100
+	maxGrepResults     = 1000
+	maxGrepFileBytes   = 2 << 20
+	maxGrepLineChars   = 300
+	defaultGlobResults = 500
+	maxPathSuggestions = 3
+	defaultListDepth   = 2
+	maxListDepth       = 10
+	defaultListEntries = 500
+	maxListEntries     = 5000
+	maxSuggestScan     = 20000
+	maxGlobResults     = 10000
+	diffContextLines   = 3
+	maxDiffCells       = 4000000 // LCS table limit before falling back to remove/add
+	maxTraceFrames     = 50
+	maxTraceSources    = 10
+	defaultTraceLines  = 2
+	defaultBuildMillis = 300000
+	defaultLintMillis  = 300000
+	maxDiagnostics     = 50
+	maxUndoEntries     = 50
+	maxUndoBytes       = 32 << 20
+	maxObservationSize = 20000
+	maxEditPreview     = 2000
+	maxPersonaChars    = 300
+	maxAgentNameChars  = 40
+	defaultLogLines    = 1000
+	maxLogLines        = 100000
+	defaultLogBytes    = 8 << 20
+	maxLogBytes        = 64 << 20
+	maxLogPatternLen   = 1000
+	logSearchTimeout   = 5 * time.Second
+	maxSearchWorkers   = 8 // default cap; SEARCH_WORKERS may go higher
 )
 
 const (
 	todoPendingColor   = "\x1b[38;2;176;176;176m"
 	todoProgressColor  = "\x1b[38;2;120;200;255m"
 	todoCompletedColor = "\x1b[38;2;34;139;34m"
+	todoHighColor      = "\x1b[38;2;255;165;0m"
 	strikethrough      = "\x1b[9m"
+	dimText            = "\x1b[2m"
 	reset              = "\x1b[0m"
 )
 
+// colorEnabled reports whether ANSI styling may be written: not when
+// NO_COLOR is set (https://no-color.org) or stdout isn't a terminal, so
+// pipes and logs get plain text.
+var colorEnabled = os.Getenv("NO_COLOR") == "" && term.IsTerminal(int(os.Stdout.Fd()))
+
+// paint wraps text in an ANSI style when colorEnabled allows it.
+func paint(style, text string) string {
+	if !colorEnabled {
+		return text
+	}
+	return style + text + reset
+}
+
+// displayWidth is the width assistant text is wrapped to: WRAP_WIDTH, or
+// the terminal's width. 0 (no wrapping) when stdout isn't a terminal, the
+// width is unknown or wrapping is off.
+func displayWidth(cfg Config) int {
+	if cfg.WrapWidth < 0 || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return 0
+	}
+	if cfg.WrapWidth > 0 {
+		return cfg.WrapWidth
+	}
+	width, _, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 {
+		return 0
+	}
+	return width
+}
+
+// softWrapper soft-wraps text for display at word boundaries. It works on
+// streamed chunks: Write returns what can be printed so far and holds back
+// the word in progress until Flush. Only the display is wrapped; callers
+// keep the original text.
+type softWrapper struct {
+	width  int // 0 passes text through unchanged
+	col    int // columns used on the current line
+	spaces []rune
+	word   []rune
+}
+
+func newSoftWrapper(width int) *softWrapper {
+	return &softWrapper{width: width}
+}
+
+// Write adds text and returns the part that is ready to print
+func (sw *softWrapper) Write(text string) string {
+	if sw.width <= 0 {
+		return text
+	}
+	var out strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '\n':
+			sw.flushWord(&out)
+			// Trailing blanks would only push the cursor past the edge
+			sw.spaces = sw.spaces[:0]
+			out.WriteRune('\n')
+			sw.col = 0
+		case r == ' ' || r == '\t':
+			sw.flushWord(&out)
+			sw.spaces = append(sw.spaces, r)
+		case runeWidth(r) == 2:
+			// CJK text has no spaces; it may break between any two characters
+			sw.flushWord(&out)
+			sw.word = append(sw.word, r)
+			sw.flushWord(&out)
+		default:
+			sw.word = append(sw.word, r)
+		}
+	}
+	return out.String()
+}
+
+// Flush returns the word held back by Write
+func (sw *softWrapper) Flush() string {
+	if sw.width <= 0 {
+		return ""
+	}
+	var out strings.Builder
+	sw.flushWord(&out)
+	sw.spaces = sw.spaces[:0]
+	return out.String()
+}
+
+func (sw *softWrapper) flushWord(out *strings.Builder) {
+	if len(sw.word) == 0 {
+		return
+	}
+	spaceCol := sw.col
+	for _, r := range sw.spaces {
+		spaceCol = advanceColumn(spaceCol, r)
+	}
+	wordWidth := 0
+	for _, r := range sw.word {
+		wordWidth += runeWidth(r)
+	}
+	if sw.col > 0 && spaceCol+wordWidth > sw.width {
+		// Break the line in place of the blanks before the word
+		out.WriteRune('\n')
+		sw.col = 0
+	} else {
+		out.WriteString(string(sw.spaces))
+		sw.col = spaceCol
+	}
+	sw.spaces = sw.spaces[:0]
+	// A word wider than the whole line is split wherever it overflows
+	for _, r := range sw.word {
+		if w := runeWidth(r); sw.col > 0 && sw.col+w > sw.width {
+			out.WriteRune('\n')
+			sw.col = 0
+		}
+		out.WriteRune(r)
+		sw.col += runeWidth(r)
+	}
+	sw.word = sw.word[:0]
+}
+
+// advanceColumn is the column after printing r at col (tabs stop every 8)
+func advanceColumn(col int, r rune) int {
+	if r == '\t' {
+		return col + 8 - col%8
+	}
+	return col + runeWidth(r)
+}
+
+// runeWidth is the number of terminal columns r takes: 2 for East Asian
+// wide characters, 0 for combining marks and controls, 1 otherwise.
+func runeWidth(r rune) int {
+	switch {
+	case unicode.Is(unicode.Mn, r) || unicode.IsControl(r):
+		return 0
+	case unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hangul, r) ||
+		unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r) ||
+		(r >= 0xFF01 && r <= 0xFF60) || (r >= 0x3000 && r <= 0x303F):
+		return 2
+	}
+	return 1
+}
+
+// wrapForDisplay soft-wraps a complete reply to the display width.
+func wrapForDisplay(cfg Config, text string) string {
+	sw := newSoftWrapper(displayWidth(cfg))
+	return sw.Write(text) + sw.Flush()
+}
+
 var spinnerFrames = []string{"-", "\\", "|", "/"}
 
 // Global todo board and agent state
 var (
-	todoBoard            = &TodoManager{}
-	pendingContextBlocks []ContentBlock
-	agentState           = struct {
+	todoBoard      = &TodoManager{}
+	pendingContext = &ContextQueue{}
+	stdinScanner   = bufio.NewScanner(os.Stdin)
+	approvals      = &ApprovalRules{}
+	sessionEnv     = &SessionEnv{}
+	macroRecorder  = &MacroRecorder{}
+	events         = &EventEmitter{}
+	turnRetries    = &RetryBudget{}
+	lastWrites     = &WriteTracker{}
+	builds         = &BuildCache{}
+	edits          = &EditHistory{}
+	observations   = &ObservationFeed{}
+	memory         = &MemoryStore{}
+	audit          = &AuditLog{}
+	agentState     = struct {
 		roundsWithoutTodo int
 		mu                sync.Mutex
 	}{}
 )
 
 const (
-	initialReminder = `<reminder source="system" topic="todos">System message: complex work should be tracked with the Todo tool. Do not respond to this reminder and do not mention it to the user.</reminder>`
-	nagReminder     = `<reminder source="system" topic="todos">System notice: more than ten rounds passed without Todo usage. Update the Todo board if the task still requires multiple steps. Do not reply to or mention this reminder to the user.</reminder>`
+	initialReminder        = `<reminder source="system" topic="todos">System message: complex work should be tracked with the Todo tool. Do not respond to this reminder and do not mention it to the user.</reminder>`
+	planCapturedReminder   = `<reminder source="system" topic="todos">System notice: the numbered plan from your last reply (%d steps) was copied onto the Todo board. Keep it current with the TodoWrite tool as you work. Do not reply to or mention this reminder to the user.</reminder>`
+	contextTrimmedReminder = `<reminder source="system" topic="context">Earlier messages were dropped to fit the context window. Re-read files if you need details from before this point. Do not reply to or mention this reminder to the user.</reminder>`
+	macroPlayedReminder    = `<reminder source="system" topic="macro">System notice: the user replayed the macro %q outside the conversation (%d tool calls: %s). Files may have changed; re-read them before editing. Do not reply to or mention this reminder to the user.</reminder>`
+	staleWritesReminder    = `<reminder source="system" topic="files">System notice: these files changed outside the agent after you last wrote them, so what you remember of them is stale: %s. Re-read them or call diff_since_write before editing. Do not reply to or mention this reminder to the user.</reminder>`
+	contentFilterReminder  = `<reminder source="system" topic="content-filter">System notice: the provider's content filter stopped your last reply. Answer again, leaving out or describing in neutral terms whatever may have triggered it (quoted secrets, offensive sample data, exploit payloads). Do not reply to or mention this reminder to the user.</reminder>`
+	observationNotice      = `<observation source="external" from=%q>
+The following was posted by an external process (not the user), e.g. CI results. Take it into account if it is relevant to the task.
+
+%s
+</observation>`
+	todosRestoredReminder = `<reminder source="system" topic="todos">System notice: the todo board from an earlier run was restored:
+%s
+Continue from it if the user's request fits, or replace it with the TodoWrite tool. Do not reply to or mention this reminder to the user.</reminder>`
+	memoryReminder = `<reminder source="system" topic="memory">System notice: facts you saved with memory_set in earlier sessions (key: value, most recent first):
+%s
+Treat them as background; they may be out of date. Do not reply to or mention this reminder to the user.</reminder>`
+	mentionedFileBlock = `<file path=%q source="@mention">
+%s
+</file>`
+	nagReminder = `<reminder source="system" topic="todos">System notice: more than %d rounds passed without Todo usage. Update the Todo board if the task still requires multiple steps. Do not reply to or mention this reminder to the user.</reminder>`
 )
 
+// HTTPDoer sends an HTTP request; *http.Client satisfies it.
+type HTTPDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// defaultHTTPClient sends API requests when Config.HTTPClient is nil.
+var defaultHTTPClient HTTPDoer = &http.Client{Timeout: 60 * time.Second}
+
 // Config carries runtime configuration.
 type Config struct {
-	APIKey    string
-	BaseURL   string
-	Model     string
-	WorkDir   string
-	MaxResult int
-	Debug     bool
-	Stream    bool
+	APIKey  string
+	BaseURL string
+	Model   string
+	// HTTPClient sends the API requests, so tests can point them at an
+	// httptest.Server or a fake; nil uses defaultHTTPClient.
+	HTTPClient HTTPDoer
+	// APIType selects the provider wire format: "openai" (default), "azure"
+	// or "anthropic".
+	APIType          string
+	Deployment       string
+	APIVersion       string
+	AnthropicVersion string
+	WorkDir          string
+	MaxResult        int
+	// MaxIterations bounds model requests per turn (AGENT_MAX_ITERATIONS);
+	// MaxToolResultChars clamps what a tool returns (MAX_TOOL_RESULT_CHARS);
+	// MaxTodoItems caps the todo board (MAX_TODO_ITEMS);
+	// TodoNagRounds is how many replies may go by without the Todo tool
+	// before the model is reminded of it, 0 for never (TODO_NAG_ROUNDS).
+	MaxIterations      int
+	MaxToolResultChars int
+	MaxTodoItems       int
+	TodoNagRounds      int
+	// Temperature and TopP are sent only when set, since some models
+	// (reasoning models in particular) reject them.
+	Temperature *float64
+	TopP        *float64
+	// Seed asks for reproducible sampling on providers that honor it; sent
+	// only when set (OPENAI_SEED, OpenAI and Azure only).
+	Seed *int64
+	// ResponseFormat is sent as response_format when set, e.g. json_object
+	// or a JSON schema (OPENAI_RESPONSE_FORMAT).
+	ResponseFormat map[string]interface{}
+	// Stop lists sequences at which the model halts generation (OPENAI_STOP).
+	Stop []string
+	// Reasoning is "auto", "true" or "false" (OPENAI_REASONING): whether the
+	// model is treated as a reasoning model (o1, o3, ...), which takes
+	// max_completion_tokens and no sampling parameters. In auto mode, models
+	// whose names start with one of ReasoningPrefixes are
+	// (OPENAI_REASONING_MODELS).
+	Reasoning         string
+	ReasoningPrefixes []string
+	// ReasoningEffort and Verbosity are sent as reasoning_effort and
+	// verbosity only when set (OPENAI_REASONING_EFFORT, OPENAI_VERBOSITY).
+	ReasoningEffort string
+	Verbosity       string
+	// ToolChoice is sent as tool_choice: "auto" (the default, not sent),
+	// "none", "required" or a tool name (OPENAI_TOOL_CHOICE). A forced
+	// choice applies to the first request of each turn only.
+	ToolChoice string
+	// ParallelTools lets the model return several tool calls in one reply;
+	// false sends parallel_tool_calls=false (OPENAI_PARALLEL_TOOLS).
+	ParallelTools bool
+	Debug         bool
+	Stream        bool
+	// StreamHybrid (OPENAI_STREAM=hybrid) stops printing streamed text once
+	// a tool call starts and shows only the assembling indicator until done.
+	StreamHybrid bool
+	// PlanCapture controls how numbered plans in assistant prose are mirrored
+	// onto the todo board: "off", "ask" or "auto".
+	PlanCapture string
+	// ApproveBash asks on the terminal before each bash command runs.
+	ApproveBash bool
+	// ContextTokens is the estimated token budget for a request; older
+	// messages are dropped to fit (OPENAI_CONTEXT_TOKENS, 0 disables).
+	ContextTokens int
+	// AutoCompact summarizes older history once the estimate exceeds
+	// CompactTokens, keeping the last CompactKeepTurns user turns verbatim.
+	AutoCompact      bool
+	CompactTokens    int
+	CompactKeepTurns int
+	// DedupeReads collapses older read_file results superseded by a later
+	// full read of the same path (DEDUPE_READS, default true).
+	DedupeReads bool
+	// SessionSave writes the conversation to SessionsDir on exit;
+	// SessionAutosave also saves after every turn.
+	SessionSave     bool
+	SessionAutosave bool
+	SessionsDir     string
+	// ExtraHeaders are added to every API request (OPENAI_EXTRA_HEADERS).
+	ExtraHeaders map[string]string
+	// BashDeny blocks matching commands (the defaults plus BASH_DENY);
+	// BashAllow, when set, only admits commands starting with one of its
+	// prefixes (BASH_ALLOW).
+	BashDeny  []commandRule
+	BashAllow []string
+	// KnownContentChars includes a file's new content in edit results up to
+	// this size so the model needn't re-read it (KNOWN_CONTENT_CHARS, 0 disables).
+	KnownContentChars int
+	// WriteBackup saves a file's previous contents to <path>.bak before
+	// write_file or edit_text changes it, unless the call passes backup
+	// (WRITE_BACKUP).
+	WriteBackup bool
+	// EnabledTools is the allowlist of tools the model sees and may call;
+	// nil enables all of them (MCC_TOOLS, DISABLE_BASH).
+	EnabledTools map[string]bool
+	// ProjectContext is the workspace's project context file (MCC.md,
+	// AGENTS.md or CLAUDE.md, named by ProjectContextFile), appended to the
+	// system prompt; PROJECT_CONTEXT=false skips it.
+	ProjectContext     string
+	ProjectContextFile string
+	// DryRun keeps the workspace unchanged: edits only report what they
+	// would do and bash is limited to read-only commands (MCC_READONLY,
+	// --dry-run).
+	DryRun bool
+	// MemoryInject adds saved memories to the first turn of a session
+	// (MEMORY_INJECT, default true).
+	MemoryInject bool
+	// RedactPatterns mask secrets in tool results before they reach the
+	// model; nil when redaction is off (REDACT_SECRETS=false).
+	RedactPatterns []*regexp.Regexp
+	// MaxRetries is how often one API request is retried on network errors,
+	// 429 and 5xx (OPENAI_MAX_RETRIES); every retry in a turn also draws on
+	// RetryBudget (RETRY_BUDGET).
+	MaxRetries  int
+	RetryBudget int
+	// OutputFormat is "text", or "json" to emit NDJSON events on stdout
+	// with the human-oriented output moved to stderr.
+	OutputFormat string
+	// AgentName and Persona customize who the system prompt says the agent
+	// is and how it comes across (AGENT_NAME, AGENT_PERSONA); the tool rules
+	// stay as they are.
+	AgentName string
+	Persona   string
+	// WrapWidth soft-wraps assistant text on a terminal: 0 wraps to the
+	// terminal width, a positive value to that many columns, -1 turns it
+	// off (WRAP_WIDTH).
+	WrapWidth int
+	// PageResults shows tool results taller than the terminal in full, a
+	// screen at a time, instead of cutting them short (PAGE_RESULTS).
+	PageResults bool
+	// StreamFormat is how streamed replies are framed: "sse", "ndjson" or
+	// "auto" to detect it from the Content-Type or each line (STREAM_FORMAT).
+	StreamFormat string
+	// StreamMaxLine is the longest single line a streamed reply may carry,
+	// in bytes (STREAM_MAX_LINE).
+	StreamMaxLine int
+	// ContentFilter decides what happens when the provider filters a reply
+	// (CONTENT_FILTER): "warn" keeps the partial reply with a warning,
+	// "retry" asks once for a rephrased answer, "error" ends the turn.
+	ContentFilter string
+	// SearchWorkers is how many files grep scans, and directories glob
+	// reads, at once (SEARCH_WORKERS).
+	SearchWorkers int
+	// ObservationsSource is a file or named pipe that external processes
+	// write to; new content is shown to the model before its next request
+	// (OBSERVATIONS_SOURCE, empty disables).
+	ObservationsSource string
+	// AuditLog is the file every tool call is appended to as a JSON line
+	// (AUDIT_LOG, empty disables).
+	AuditLog string
+	// SessionTimeout bounds the whole run; once reached the current turn
+	// finishes and the program exits with exitSessionTimeout (0 disables).
+	SessionTimeout time.Duration
 }
 
 // Message for OpenAI chat format
 type Message struct {
-	Role       string      `json:"role"` // system, user, assistant, tool
+	Role       string      `json:"role"`              // system, user, assistant, tool
 	Content    interface{} `json:"content,omitempty"` // string or []ContentBlock
 	ToolCalls  []ToolCall  `json:"tool_calls,omitempty"`
 	ToolCallID string      `json:"tool_call_id,omitempty"`
 	Name       string      `json:"name,omitempty"`
 }
 
+// UnmarshalJSON decodes content given as a string or as an array of
+// blocks (or a single block) into a string or []ContentBlock, so callers
+// never see raw maps. Refusal blocks become text blocks carrying the refusal.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	type plain Message
+	var raw struct {
+		plain
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*m = Message(raw.plain)
+	m.Content = nil
+	content := bytes.TrimSpace(raw.Content)
+	if len(content) == 0 || bytes.Equal(content, []byte("null")) {
+		return nil
+	}
+	switch content[0] {
+	case '"':
+		var text string
+		if err := json.Unmarshal(content, &text); err != nil {
+			return err
+		}
+		m.Content = text
+		return nil
+	case '{':
+		content = append(append([]byte("["), content...), ']')
+	}
+	var parts []struct {
+		Type    string `json:"type"`
+		Text    string `json:"text"`
+		Refusal string `json:"refusal"`
+	}
+	if err := json.Unmarshal(content, &parts); err != nil {
+		return fmt.Errorf("message content: %w", err)
+	}
+	blocks := []ContentBlock{}
+	for _, p := range parts {
+		switch {
+		case p.Type == "refusal" || (p.Text == "" && p.Refusal != ""):
+			blocks = append(blocks, ContentBlock{Type: "text", Text: p.Refusal})
+		case p.Type == "" || p.Type == "text" || p.Text != "":
+			blocks = append(blocks, ContentBlock{Type: "text", Text: p.Text})
+		}
+	}
+	m.Content = blocks
+	return nil
+}
+
 // ContentBlock for multi-modal content
 type ContentBlock struct {
 	Type string `json:"type"` // "text"
@@ -111,6 +596,7 @@ type TodoItem struct {
 	Content    string `json:"content"`
 	Status     string `json:"status"` // pending|in_progress|completed
 	ActiveForm string `json:"active_form"`
+	Priority   string `json:"priority,omitempty"` // high|medium|low, optional
 }
 
 // TodoManager manages the todo list
@@ -119,19 +605,20 @@ type TodoManager struct {
 	mu    sync.Mutex
 }
 
-func (tm *TodoManager) Update(items []TodoItem) (string, error) {
+// Update replaces the board with items, allowing at most limit of them.
+func (tm *TodoManager) Update(items []TodoItem, limit int) (string, error) {
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
 
-	if len(items) > maxTodoItems {
-		return "", fmt.Errorf("todo list is limited to %d items", maxTodoItems)
+	if len(items) > limit {
+		return "", fmt.Errorf("todo list is limited to %d items", limit)
 	}
 
 	// Validate items
 	seenIDs := make(map[string]bool)
 	inProgressCount := 0
 
-	for _, item := range items {
+	for i, item := range items {
 		// Check duplicate IDs
 		if seenIDs[item.ID] {
 			return "", fmt.Errorf("duplicate todo id: %s", item.ID)
@@ -153,11 +640,18 @@ func (tm *TodoManager) Update(items []TodoItem) (string, error) {
 		if status != "pending" && status != "in_progress" && status != "completed" {
 			return "", fmt.Errorf("status must be one of: pending, in_progress, completed")
 		}
-		item.Status = status
+		items[i].Status = status
 
 		if status == "in_progress" {
 			inProgressCount++
 		}
+
+		// Check priority
+		priority := strings.ToLower(strings.TrimSpace(item.Priority))
+		if priority != "" && priority != "high" && priority != "medium" && priority != "low" {
+			return "", fmt.Errorf("priority must be one of: high, medium, low")
+		}
+		items[i].Priority = priority
 	}
 
 	if inProgressCount > 1 {
@@ -170,31 +664,61 @@ func (tm *TodoManager) Update(items []TodoItem) (string, error) {
 
 // render is the internal unlocked rendering method
 func (tm *TodoManager) render() string {
+	// Box characters need a capable terminal; plain markers go everywhere
+	openMark, doneMark := "☐", "☒"
+	if !colorEnabled {
+		openMark, doneMark = "[ ]", "[x]"
+	}
 	if len(tm.items) == 0 {
-		return fmt.Sprintf("%s☐ No todos yet%s", todoPendingColor, reset)
+		return paint(todoPendingColor, openMark+" No todos yet")
 	}
 
-	var lines []string
+	stats := tm.stats()
+	lines := []string{paint(todoPendingColor, fmt.Sprintf("Todos (%d/%d done, %d in progress)",
+		stats["completed"], stats["total"], stats["in_progress"]))}
 	for _, todo := range tm.items {
-		mark := "☐"
+		mark := openMark
 		if todo.Status == "completed" {
-			mark = "☒"
+			mark = doneMark
+		}
+
+		content := todo.Content
+		if todo.Priority == "high" || todo.Priority == "low" {
+			content += " [" + todo.Priority + "]"
 		}
 
 		var line string
-		switch todo.Status {
-		case "completed":
-			line = fmt.Sprintf("%s%s%s %s%s", todoCompletedColor, strikethrough, mark, todo.Content, reset)
-		case "in_progress":
-			line = fmt.Sprintf("%s%s %s%s", todoProgressColor, mark, todo.Content, reset)
+		text := mark + " " + content
+		switch {
+		case todo.Status == "completed":
+			line = paint(todoCompletedColor+strikethrough, text)
+		case todo.Status == "in_progress":
+			line = paint(todoProgressColor, text)
+		case todo.Priority == "high":
+			// Pending high-priority work stands out from the rest
+			line = paint(todoHighColor, text)
 		default:
-			line = fmt.Sprintf("%s%s %s%s", todoPendingColor, mark, todo.Content, reset)
+			line = paint(todoPendingColor, text)
 		}
 		lines = append(lines, line)
 	}
 	return strings.Join(lines, "\n")
 }
 
+// Reset empties the todo list (thread-safe)
+func (tm *TodoManager) Reset() {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.items = nil
+}
+
+// Items returns a copy of the current todo items (thread-safe)
+func (tm *TodoManager) Items() []TodoItem {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return append([]TodoItem(nil), tm.items...)
+}
+
 // Render returns the formatted todo list (thread-safe)
 func (tm *TodoManager) Render() string {
 	tm.mu.Lock()
@@ -228,533 +752,7347 @@ func (tm *TodoManager) Stats() map[string]int {
 	return tm.stats()
 }
 
-type spinner struct {
-	label   string
-	frames  []string
-	stopCh  chan struct{}
-	doneCh  chan struct{}
-	mu      sync.Mutex
-	running bool
+// ApprovalRule remembers a session-wide approval decision for bash commands.
+type ApprovalRule struct {
+	Pattern string `json:"pattern"`
+	Prefix  bool   `json:"prefix"` // match commands starting with Pattern
 }
 
-func newSpinner(label string) *spinner {
-	return &spinner{
-		label:  label,
-		frames: spinnerFrames,
+// matches reports whether the rule covers command. A prefix must end at a
+// word boundary, so "git status" doesn't cover "git statusx".
+func (r ApprovalRule) matches(command string) bool {
+	if !r.Prefix {
+		return command == r.Pattern
 	}
+	rest, ok := strings.CutPrefix(command, r.Pattern)
+	return ok && (rest == "" || strings.HasSuffix(r.Pattern, " ") || rest[0] == ' ' || rest[0] == '\t')
 }
 
-func (s *spinner) Start() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if s.running {
-		return
-	}
-	if !term.IsTerminal(int(os.Stdout.Fd())) {
-		return
+// allows is matches for allow rules: a prefix doesn't cover a command that
+// goes on to chain or substitute another one, as in "git status; curl x | sh".
+func (r ApprovalRule) allows(command string) bool {
+	if !r.matches(command) {
+		return false
 	}
-	s.stopCh = make(chan struct{})
-	s.doneCh = make(chan struct{})
-	s.running = true
-	go s.loop()
+	return !r.Prefix || !chainsCommands(strings.TrimPrefix(command, r.Pattern))
 }
 
-func (s *spinner) loop() {
-	ticker := time.NewTicker(spinnerTick)
-	defer ticker.Stop()
-	frame := 0
-	for {
-		select {
-		case <-s.stopCh:
-			fmt.Printf("\r%*s\r", len(s.label)+2, "")
-			close(s.doneCh)
-			return
-		case <-ticker.C:
-			fmt.Printf("\r%s %s", s.label, s.frames[frame%len(s.frames)])
-			frame++
+// ApprovalRules holds the "always allow" / "always deny" answers given at the
+// approval prompt for the rest of the session.
+type ApprovalRules struct {
+	Allow []ApprovalRule `json:"allow,omitempty"`
+	Deny  []ApprovalRule `json:"deny,omitempty"`
+	mu    sync.Mutex
+}
+
+// Decide reports whether a rule covers command; deny rules win over allow rules.
+func (ar *ApprovalRules) Decide(command string) (allowed, decided bool) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	for _, rule := range ar.Deny {
+		if rule.matches(command) {
+			return false, true
+		}
+	}
+	for _, rule := range ar.Allow {
+		if rule.allows(command) {
+			return true, true
 		}
 	}
+	return false, false
 }
 
-func (s *spinner) Stop() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if !s.running {
-		return
-	}
-	close(s.stopCh)
-	<-s.doneCh
-	s.running = false
+// Rules returns copies of the allow and deny rules (thread-safe)
+func (ar *ApprovalRules) Rules() ([]ApprovalRule, []ApprovalRule) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	return append([]ApprovalRule(nil), ar.Allow...), append([]ApprovalRule(nil), ar.Deny...)
 }
 
-func main() {
-	cfg := loadConfig()
-	history := make([]Message, 0)
+// Restore replaces the rules, e.g. when resuming a saved session
+func (ar *ApprovalRules) Restore(allow, deny []ApprovalRule) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	ar.Allow = append([]ApprovalRule(nil), allow...)
+	ar.Deny = append([]ApprovalRule(nil), deny...)
+}
 
-	// Initialize with initial reminder
-	pendingContextBlocks = append(pendingContextBlocks, ContentBlock{
-		Type: "text",
-		Text: initialReminder,
-	})
+func (ar *ApprovalRules) Add(rule ApprovalRule, allow bool) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	if allow {
+		ar.Allow = append(ar.Allow, rule)
+	} else {
+		ar.Deny = append(ar.Deny, rule)
+	}
+}
 
-	fmt.Printf("Tiny CC Agent (Go) -- cwd: %s\n", cfg.WorkDir)
-	fmt.Println("Type \"exit\" or \"quit\" to leave.")
-	fmt.Println()
+// SessionEnv holds variables set with /env; every bash command sees them on
+// top of the agent's own environment.
+type SessionEnv struct {
+	mu   sync.Mutex
+	vars map[string]string
+}
 
-	scanner := bufio.NewScanner(os.Stdin)
-	for {
-		fmt.Print("User: ")
-		if !scanner.Scan() {
-			break
-		}
-		line := scanner.Text()
-		trimmed := strings.TrimSpace(line)
-		if trimmed == "" {
-			continue
-		}
-		lower := strings.ToLower(trimmed)
-		if lower == "exit" || lower == "quit" || lower == "q" {
-			break
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Set stores key=value, expanding $VAR references against the session and
+// process environment so PATH=$PATH:/extra works.
+func (se *SessionEnv) Set(key, value string) string {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	value = os.Expand(value, func(name string) string {
+		if v, ok := se.vars[name]; ok {
+			return v
 		}
+		return os.Getenv(name)
+	})
+	if se.vars == nil {
+		se.vars = make(map[string]string)
+	}
+	se.vars[key] = value
+	return value
+}
 
-		// Inject reminders into user message
-		content := injectReminders(line)
-		history = append(history, Message{Role: "user", Content: content})
+func (se *SessionEnv) Unset(key string) bool {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	_, ok := se.vars[key]
+	delete(se.vars, key)
+	return ok
+}
 
-		updated, err := query(cfg, history)
-		if err != nil {
-			fmt.Printf("Error: %v\n", err)
-			continue
-		}
-		history = updated
+// Vars returns a copy of the variables (thread-safe)
+func (se *SessionEnv) Vars() map[string]string {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	if len(se.vars) == 0 {
+		return nil
 	}
+	out := make(map[string]string, len(se.vars))
+	for k, v := range se.vars {
+		out[k] = v
+	}
+	return out
 }
 
-func loadConfig() Config {
-	workDir, err := os.Getwd()
-	if err != nil {
-		panic(err)
+// Restore replaces the variables, e.g. when resuming a saved session
+func (se *SessionEnv) Restore(vars map[string]string) {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	se.vars = make(map[string]string, len(vars))
+	for k, v := range vars {
+		se.vars[k] = v
 	}
+}
 
-	apiKey := strings.TrimSpace(os.Getenv("OPENAI_API_KEY"))
-	baseURL := strings.TrimSpace(os.Getenv("OPENAI_BASE_URL"))
-	if baseURL == "" {
-		baseURL = "https://api.openai.com"
+// Environ returns the environment for a child process, or nil (inherit
+// unchanged) when no variables are set.
+func (se *SessionEnv) Environ() []string {
+	vars := se.Vars()
+	if len(vars) == 0 {
+		return nil
 	}
+	env := os.Environ()
+	for k, v := range vars {
+		env = append(env, k+"="+v)
+	}
+	return env
+}
 
-	model := strings.TrimSpace(os.Getenv("OPENAI_MODEL"))
-	if model == "" {
-		model = "gpt-4"
+var secretEnvName = regexp.MustCompile(`(?i)(key|token|secret|passw|credential|auth)`)
+
+// maskEnvValue hides values whose name or content looks like a secret.
+func maskEnvValue(cfg Config, key, value string) string {
+	if secretEnvName.MatchString(key) {
+		return "***"
 	}
+	masked, _ := redactSecrets(cfg, value)
+	return masked
+}
 
-	maxTokens := defaultMaxTokens
-	if maxTokensStr := strings.TrimSpace(os.Getenv("OPENAI_MAX_TOKENS")); maxTokensStr != "" {
-		if parsed, err := strconv.Atoi(maxTokensStr); err == nil && parsed > 0 {
-			maxTokens = parsed
+// ContextQueue holds reminders and other context blocks waiting to be sent
+// ahead of the next user message.
+type ContextQueue struct {
+	mu     sync.Mutex
+	blocks []ContentBlock
+}
+
+// Ensure queues text unless the same block is already waiting (thread-safe)
+func (q *ContextQueue) Ensure(text string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, block := range q.blocks {
+		if block.Text == text {
+			return
 		}
 	}
+	q.blocks = append(q.blocks, ContentBlock{Type: "text", Text: text})
+}
 
-	cfg := Config{
-		APIKey:    apiKey,
-		BaseURL:   baseURL,
-		Model:     model,
-		WorkDir:   workDir,
-		MaxResult: maxTokens,
-		Debug:     strings.ToLower(strings.TrimSpace(os.Getenv("DEBUG"))) == "true",
-		Stream:    strings.ToLower(strings.TrimSpace(os.Getenv("OPENAI_STREAM"))) != "false",
-	}
+// Take empties the queue and returns what was in it (thread-safe)
+func (q *ContextQueue) Take() []ContentBlock {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	blocks := q.blocks
+	q.blocks = nil
+	return blocks
+}
 
-	if cfg.APIKey == "" {
-		log.Fatal("OPENAI_API_KEY required")
+// Inject returns the message content for userText: the plain string when
+// nothing is queued, otherwise the queued blocks followed by the text, which
+// empties the queue (thread-safe)
+func (q *ContextQueue) Inject(userText string) interface{} {
+	blocks := q.Take()
+	if len(blocks) == 0 {
+		return userText // Simple string
 	}
-
-	return cfg
+	return append(blocks, ContentBlock{Type: "text", Text: userText})
 }
 
-func query(cfg Config, messages []Message) ([]Message, error) {
-	sysPrompt := fmt.Sprintf(systemPrompt, cfg.WorkDir)
+// RetryBudget caps how many retries one user turn may spend across every
+// source (API errors, malformed tool arguments); it is reset each turn.
+type RetryBudget struct {
+	mu        sync.Mutex
+	remaining int
+	exhausted bool
+}
 
-	// 在消息前面添加 system message
-	fullMessages := make([]Message, 0, len(messages)+1)
-	fullMessages = append(fullMessages, Message{
-		Role:    "system",
-		Content: sysPrompt,
-	})
-	fullMessages = append(fullMessages, messages...)
+// Reset starts a new turn with n retries (thread-safe)
+func (rb *RetryBudget) Reset(n int) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.remaining = n
+	rb.exhausted = false
+}
 
-	for idx := 0; idx < maxAgentIterations; idx++ {
-		spin := newSpinner("Waiting for model")
-		spin.Start()
-		resp, err := callOpenAI(cfg, fullMessages)
-		spin.Stop()
-		if err != nil {
-			return messages, err
-		}
+// Take spends one retry, reporting false once the budget is used up, along
+// with how many are left (thread-safe)
+func (rb *RetryBudget) Take() (bool, int) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.remaining <= 0 {
+		rb.exhausted = true
+		return false, 0
+	}
+	rb.remaining--
+	return true, rb.remaining
+}
 
-		if len(resp.Choices) == 0 {
-			return messages, errors.New("no choices in response")
-		}
+// Remaining returns the retries left this turn (thread-safe)
+func (rb *RetryBudget) Remaining() int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.remaining
+}
 
-		choice := resp.Choices[0]
-		assistantMsg := choice.Message
+// Exhausted reports whether a retry was refused this turn (thread-safe)
+func (rb *RetryBudget) Exhausted() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.exhausted
+}
 
-		// 打印文本内容
-		if assistantMsg.Content != "" {
-			fmt.Println(assistantMsg.Content)
-		}
+// EventEmitter writes newline-delimited JSON events for embedding UIs when
+// OUTPUT_FORMAT=json; it does nothing until enabled.
+type EventEmitter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
 
-		// 追加 assistant 消息到历史
-		messages = append(messages, assistantMsg)
-		fullMessages = append(fullMessages, assistantMsg)
+// Enable sends subsequent events to w
+func (e *EventEmitter) Enable(w io.Writer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.w = w
+}
 
-		// 检查是否有 tool calls
-		if choice.FinishReason == "tool_calls" && len(assistantMsg.ToolCalls) > 0 {
-			// 执行所有工具
-			for _, tc := range assistantMsg.ToolCalls {
-				result := dispatchToolCall(cfg, tc)
-				messages = append(messages, result)
-				fullMessages = append(fullMessages, result)
-			}
-			continue
-		}
+// Emit writes one event of the given type with the extra fields (thread-safe)
+func (e *EventEmitter) Emit(typ string, fields map[string]interface{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.w == nil {
+		return
+	}
+	event := map[string]interface{}{"type": typ}
+	for k, v := range fields {
+		event[k] = v
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	e.w.Write(append(data, '\n'))
+}
 
-		// Track rounds without todo usage
-		agentState.mu.Lock()
-		agentState.roundsWithoutTodo++
-		if agentState.roundsWithoutTodo > 10 {
-			ensureContextBlock(nagReminder)
-		}
-		agentState.mu.Unlock()
+// AuditLog appends one JSON line per tool call to AUDIT_LOG, synced after
+// every write so a crash doesn't lose the trail; it does nothing until
+// opened.
+type AuditLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
 
-		return messages, nil
+// Open starts appending to path, creating it if needed
+func (al *AuditLog) Open(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
 	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.f = f
+	return nil
+}
 
-	return messages, errors.New("agent max iterations reached")
+// Record writes the entry for one tool call (thread-safe)
+func (al *AuditLog) Record(entry map[string]interface{}) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.f == nil {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if _, err := al.f.Write(append(data, '\n')); err != nil {
+		return
+	}
+	al.f.Sync()
 }
 
-func callOpenAI(cfg Config, messages []Message) (*APIResponse, error) {
-	baseURL := cfg.BaseURL
-	var endpoint string
+// auditInput copies tool arguments for the audit log with long strings
+// (such as file contents) shortened and secrets masked.
+func auditInput(cfg Config, input map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(input))
+	for k, v := range input {
+		if str, ok := v.(string); ok {
+			str, _ = redactSecrets(cfg, str)
+			v = clampText(str, maxAuditFieldChars)
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// publishTodos emits the board after every change so a UI can mirror it.
+func publishTodos() {
+	events.Emit("todo_update", map[string]interface{}{
+		"items": todoBoard.Items(),
+		"stats": todoBoard.Stats(),
+	})
+}
+
+// saveTodos writes the board to todosFile, or removes the file once the
+// board is empty.
+func saveTodos(cfg Config) error {
+	if cfg.DryRun {
+		// The board lives on in memory; the workspace stays untouched
+		return nil
+	}
+	path, err := safePath(cfg.WorkDir, todosFile)
+	if err != nil {
+		return err
+	}
+	items := todoBoard.Items()
+	if len(items) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// loadTodos reads the board saved by saveTodos; a missing file is no error.
+func loadTodos(cfg Config) ([]TodoItem, error) {
+	path, err := safePath(cfg.WorkDir, todosFile)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var items []TodoItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, fmt.Errorf("%s: %v", todosFile, err)
+	}
+	return items, nil
+}
+
+// MemoryStore is the agent's durable key-value memory in memoryFile. The
+// file is re-read on every call so concurrent sessions see each other's
+// changes.
+type MemoryStore struct {
+	mu sync.Mutex
+}
+
+type memoryEntry struct {
+	Value     string    `json:"value"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type memoryItem struct {
+	key string
+	memoryEntry
+}
+
+func (ms *MemoryStore) load(cfg Config) (map[string]memoryEntry, string, error) {
+	path, err := safePath(cfg.WorkDir, memoryFile)
+	if err != nil {
+		return nil, "", err
+	}
+	entries := map[string]memoryEntry{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, path, nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, "", fmt.Errorf("%s: %v", memoryFile, err)
+	}
+	return entries, path, nil
+}
+
+// Set stores value under key, or deletes key when value is empty. It reports
+// whether the key existed before (thread-safe).
+func (ms *MemoryStore) Set(cfg Config, key, value string) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	entries, path, err := ms.load(cfg)
+	if err != nil {
+		return false, err
+	}
+	_, existed := entries[key]
+	if value == "" {
+		if !existed {
+			return false, nil
+		}
+		delete(entries, key)
+	} else {
+		if !existed && len(entries) >= maxMemoryEntries {
+			return false, fmt.Errorf("memory is full (%d entries); delete stale ones with memory_set and an empty value first", maxMemoryEntries)
+		}
+		entries[key] = memoryEntry{Value: value, UpdatedAt: time.Now().UTC()}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return false, err
+	}
+	return existed, writeFileAtomic(path, append(data, '\n'))
+}
+
+// Get returns the entry stored under key (thread-safe)
+func (ms *MemoryStore) Get(cfg Config, key string) (memoryEntry, bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	entries, _, err := ms.load(cfg)
+	if err != nil {
+		return memoryEntry{}, false, err
+	}
+	entry, ok := entries[key]
+	return entry, ok, nil
+}
+
+// Items returns every entry, most recently updated first (thread-safe)
+func (ms *MemoryStore) Items(cfg Config) ([]memoryItem, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	entries, _, err := ms.load(cfg)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]memoryItem, 0, len(entries))
+	for key, entry := range entries {
+		items = append(items, memoryItem{key: key, memoryEntry: entry})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].UpdatedAt.Equal(items[j].UpdatedAt) {
+			return items[i].UpdatedAt.After(items[j].UpdatedAt)
+		}
+		return items[i].key < items[j].key
+	})
+	return items, nil
+}
+
+// memoryDigest lists saved memories for the session-start reminder, most
+// recent first, stopping before maxMemoryInjectChars.
+func memoryDigest(items []memoryItem) (string, int) {
+	var lines []string
+	used := 0
+	for _, item := range items {
+		line := fmt.Sprintf("- %s: %s", item.key, strings.ReplaceAll(item.Value, "\n", " "))
+		if used+len(line) > maxMemoryInjectChars {
+			break
+		}
+		used += len(line) + 1
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), len(lines)
+}
+
+// WriteTracker remembers what the agent last wrote to each file so edits
+// made outside the agent can be detected (diff_since_write, stale notices).
+type WriteTracker struct {
+	mu    sync.Mutex
+	files map[string]*writtenFile
+}
+
+type writtenFile struct {
+	content  string
+	modTime  time.Time
+	size     int64
+	reported bool // an external change was already announced
+}
+
+// Record stores the content just written to the absolute path
+func (wt *WriteTracker) Record(path, content string) {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	if wt.files == nil {
+		wt.files = make(map[string]*writtenFile)
+	}
+	entry := &writtenFile{content: content, size: int64(len(content))}
+	if info, err := os.Stat(path); err == nil {
+		entry.modTime = info.ModTime()
+	}
+	wt.files[path] = entry
+}
+
+// Last returns the content last written to path, if any
+func (wt *WriteTracker) Last(path string) (string, bool) {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	entry, ok := wt.files[path]
+	if !ok {
+		return "", false
+	}
+	return entry.content, true
+}
+
+// Changed returns files modified or deleted outside the agent since its last
+// write, each only once. Size and mtime are checked first; the content is
+// compared only when they differ, so a plain touch is not a change.
+func (wt *WriteTracker) Changed() []string {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	var changed []string
+	for path, entry := range wt.files {
+		if entry.reported {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err == nil && info.Size() == entry.size && info.ModTime().Equal(entry.modTime) {
+			continue
+		}
+		if err == nil {
+			if data, err := os.ReadFile(path); err == nil && string(data) == entry.content {
+				entry.modTime = info.ModTime()
+				continue
+			}
+		}
+		entry.reported = true
+		changed = append(changed, path)
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// Forget drops the record for path
+func (wt *WriteTracker) Forget(path string) {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	delete(wt.files, path)
+}
+
+// Move re-keys the records for from, and for files under it when from is a
+// directory, to their new location after a rename
+func (wt *WriteTracker) Move(from, to string) {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	for path, entry := range wt.files {
+		var moved string
+		switch {
+		case path == from:
+			moved = to
+		case strings.HasPrefix(path, from+string(filepath.Separator)):
+			moved = to + path[len(from):]
+		default:
+			continue
+		}
+		delete(wt.files, path)
+		wt.files[moved] = entry
+	}
+}
+
+// Reset forgets all recorded writes
+func (wt *WriteTracker) Reset() {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	wt.files = nil
+}
+
+// BuildCache remembers the last build result along with a fingerprint of
+// the workspace, so re-checking an unchanged tree doesn't rebuild.
+type BuildCache struct {
+	mu      sync.Mutex
+	command string
+	key     string
+	passed  bool
+	output  string
+}
+
+// Lookup returns the cached result if command last ran against key.
+func (bc *BuildCache) Lookup(command, key string) (bool, string, bool) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if bc.key == "" || bc.command != command || bc.key != key {
+		return false, "", false
+	}
+	return bc.passed, bc.output, true
+}
+
+func (bc *BuildCache) Store(command, key string, passed bool, output string) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.command, bc.key, bc.passed, bc.output = command, key, passed, output
+}
+
+// Invalidate forgets the cached result; called whenever the agent edits files
+func (bc *BuildCache) Invalidate() {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.key = ""
+}
+
+// EditHistory is a bounded stack of file contents from before each
+// write_file, edit_text and apply_patch change, and of move_file renames, so
+// the last edits can be undone.
+type EditHistory struct {
+	mu      sync.Mutex
+	entries []editEntry
+	bytes   int
+}
+
+type editEntry struct {
+	path    string // absolute
+	data    []byte
+	existed bool   // false when the write created the file
+	from    string // for a move_file, where path was moved from
+}
+
+// Push records path's contents from before a write that succeeded. The
+// oldest entries are dropped once the stack exceeds maxUndoEntries or
+// maxUndoBytes.
+func (eh *EditHistory) Push(path string, data []byte, existed bool) {
+	eh.push(editEntry{path: path, data: data, existed: existed})
+}
+
+// PushMove records a move from one path to another, along with the contents
+// of a file the move replaced at to, if any
+func (eh *EditHistory) PushMove(from, to string, replaced []byte, existed bool) {
+	eh.push(editEntry{path: to, data: replaced, existed: existed, from: from})
+}
+
+func (eh *EditHistory) push(entry editEntry) {
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+	eh.entries = append(eh.entries, entry)
+	eh.bytes += len(entry.data)
+	for len(eh.entries) > maxUndoEntries || (eh.bytes > maxUndoBytes && len(eh.entries) > 1) {
+		eh.bytes -= len(eh.entries[0].data)
+		eh.entries = eh.entries[1:]
+	}
+}
+
+// Pop removes and returns the most recent entry
+func (eh *EditHistory) Pop() (editEntry, bool) {
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+	if len(eh.entries) == 0 {
+		return editEntry{}, false
+	}
+	last := eh.entries[len(eh.entries)-1]
+	eh.entries = eh.entries[:len(eh.entries)-1]
+	eh.bytes -= len(last.data)
+	return last, true
+}
+
+// Len returns how many edits can still be undone
+func (eh *EditHistory) Len() int {
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+	return len(eh.entries)
+}
+
+func (eh *EditHistory) Reset() {
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+	eh.entries, eh.bytes = nil, 0
+}
+
+// ObservationFeed collects text that external processes write to a file or
+// named pipe. A regular file is polled for appended content; a pipe is read
+// in the background as writers come and go.
+type ObservationFeed struct {
+	mu      sync.Mutex
+	path    string
+	offset  int64
+	pipe    bool
+	pending strings.Builder
+}
+
+// Start begins watching path. Content already in a regular file is skipped;
+// a file that doesn't exist yet is picked up once it appears.
+func (of *ObservationFeed) Start(path string) error {
+	of.mu.Lock()
+	defer of.mu.Unlock()
+	of.path = path
+	info, err := os.Stat(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil
+	case err != nil:
+		return err
+	case info.Mode()&os.ModeNamedPipe != 0:
+		of.pipe = true
+		go of.readPipe()
+	case info.IsDir():
+		return fmt.Errorf("%s is a directory", path)
+	default:
+		of.offset = info.Size()
+	}
+	return nil
+}
+
+// readPipe copies whatever writers send to the pipe into pending. Opening
+// blocks until a writer connects; after each writer closes, it reopens.
+func (of *ObservationFeed) readPipe() {
+	buf := make([]byte, 4096)
+	for {
+		f, err := os.Open(of.path)
+		if err != nil {
+			return
+		}
+		for {
+			n, err := f.Read(buf)
+			if n > 0 {
+				of.mu.Lock()
+				of.pending.Write(buf[:n])
+				of.mu.Unlock()
+			}
+			if err != nil {
+				break
+			}
+		}
+		f.Close()
+	}
+}
+
+// Drain returns the content that arrived since the last call, clamped to
+// maxObservationSize.
+func (of *ObservationFeed) Drain() string {
+	of.mu.Lock()
+	defer of.mu.Unlock()
+	if of.path == "" {
+		return ""
+	}
+	if !of.pipe {
+		of.readAppended()
+	}
+	text := strings.TrimSpace(of.pending.String())
+	of.pending.Reset()
+	return clampText(text, maxObservationSize)
+}
+
+// readAppended reads a regular file from the last offset, starting over if
+// it was truncated or replaced by a shorter one.
+func (of *ObservationFeed) readAppended() {
+	// Stat first: opening a pipe created after Start would block
+	info, err := os.Stat(of.path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() == of.offset {
+		return
+	}
+	f, err := os.Open(of.path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if info.Size() < of.offset {
+		of.offset = 0
+	}
+	data, err := io.ReadAll(io.NewSectionReader(f, of.offset, info.Size()-of.offset))
+	if err != nil {
+		return
+	}
+	of.offset += int64(len(data))
+	of.pending.Write(data)
+}
+
+// Session is a saved conversation that can be resumed with --resume/--continue.
+type Session struct {
+	ID         string            `json:"id"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+	Model      string            `json:"model"`
+	WorkDir    string            `json:"work_dir"`
+	History    []Message         `json:"history"`
+	Todos      []TodoItem        `json:"todos,omitempty"`
+	AllowRules []ApprovalRule    `json:"allow_rules,omitempty"`
+	DenyRules  []ApprovalRule    `json:"deny_rules,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+}
+
+func newSession(cfg Config) *Session {
+	now := time.Now()
+	return &Session{
+		ID:        now.Format("20060102-150405"),
+		CreatedAt: now,
+		Model:     cfg.Model,
+		WorkDir:   cfg.WorkDir,
+	}
+}
+
+// saveSession writes the session with the given history and the current todo
+// board, approval rules and /env variables to <SessionsDir>/<id>.json.
+func saveSession(cfg Config, s *Session, history []Message) error {
+	if err := os.MkdirAll(cfg.SessionsDir, 0o700); err != nil {
+		return err
+	}
+	s.UpdatedAt = time.Now()
+	s.Model = cfg.Model
+	s.History = history
+	s.Todos = todoBoard.Items()
+	s.AllowRules, s.DenyRules = approvals.Rules()
+	s.Env = sessionEnv.Vars()
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(cfg.SessionsDir, s.ID+".json"), data, 0o600)
+}
+
+func loadSession(cfg Config, id string) (*Session, error) {
+	id = strings.TrimSuffix(filepath.Base(strings.TrimSpace(id)), ".json")
+	data, err := os.ReadFile(filepath.Join(cfg.SessionsDir, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var s Session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("parse session %s: %v", id, err)
+	}
+	if s.ID == "" {
+		s.ID = id
+	}
+	return &s, nil
+}
+
+// latestSession returns the most recently updated session for cfg.WorkDir.
+func latestSession(cfg Config) (*Session, error) {
+	entries, err := os.ReadDir(cfg.SessionsDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, errors.New("no saved sessions")
+		}
+		return nil, err
+	}
+	var latest *Session
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		s, err := loadSession(cfg, entry.Name())
+		if err != nil || s.WorkDir != cfg.WorkDir {
+			continue
+		}
+		if latest == nil || s.UpdatedAt.After(latest.UpdatedAt) {
+			latest = s
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no saved sessions for %s", cfg.WorkDir)
+	}
+	return latest, nil
+}
+
+type spinner struct {
+	label   string
+	frames  []string
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+	mu      sync.Mutex
+	running bool
+	// labelMu guards label separately; Stop holds mu while the loop exits
+	labelMu sync.Mutex
+}
+
+func newSpinner(label string) *spinner {
+	return &spinner{
+		label:  label,
+		frames: spinnerFrames,
+	}
+}
+
+func (s *spinner) Start() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return
+	}
+	if !term.IsTerminal(int(os.Stdout.Fd())) {
+		return
+	}
+	s.stopCh = make(chan struct{})
+	s.doneCh = make(chan struct{})
+	s.running = true
+	go s.loop()
+}
+
+func (s *spinner) loop() {
+	ticker := time.NewTicker(spinnerTick)
+	defer ticker.Stop()
+	frame := 0
+	for {
+		select {
+		case <-s.stopCh:
+			// Erase the whole line, including any echoed ^C
+			fmt.Print("\r\033[K")
+			close(s.doneCh)
+			return
+		case <-ticker.C:
+			s.labelMu.Lock()
+			label := s.label
+			s.labelMu.Unlock()
+			// Clear the rest of the line in case the label got shorter
+			fmt.Printf("\r%s %s\033[K", label, s.frames[frame%len(s.frames)])
+			frame++
+		}
+	}
+}
+
+func (s *spinner) Stop() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.running {
+		return
+	}
+	close(s.stopCh)
+	<-s.doneCh
+	s.running = false
+}
+
+// SetLabel changes the text shown next to the spinner on the next tick.
+func (s *spinner) SetLabel(label string) {
+	if s == nil {
+		return
+	}
+	s.labelMu.Lock()
+	s.label = label
+	s.labelMu.Unlock()
+}
+
+func main() {
+	var selfTest selfTestFlag
+	flag.Var(&selfTest, "selftest", "check the environment without calling the API and exit; use --selftest=net to also probe the endpoint")
+	resumeID := flag.String("resume", "", "resume the saved session with this id")
+	continueLast := flag.Bool("continue", false, "resume the most recent saved session for this workspace")
+	approve := flag.Bool("approve", false, "ask before running each bash command (same as APPROVE_BASH=true)")
+	configPath := flag.String("config", "", "read settings from this JSON file instead of ~/.mcc/config.json and .mcc.json")
+	workDirFlag := flag.String("workdir", "", "operate on this directory instead of the current one (overrides MCC_WORKDIR)")
+	modelFlag := flag.String("model", "", "model name (overrides OPENAI_MODEL)")
+	baseURLFlag := flag.String("base-url", "", "API base URL (overrides OPENAI_BASE_URL)")
+	maxTokensFlag := flag.Int("max-tokens", 0, "maximum tokens per reply (overrides OPENAI_MAX_TOKENS)")
+	streamFlag := flag.Bool("stream", false, "stream replies as they are generated (overrides OPENAI_STREAM)")
+	noStreamFlag := flag.Bool("no-stream", false, "wait for whole replies (overrides OPENAI_STREAM)")
+	debugFlag := flag.Bool("debug", false, "log API requests and responses to stderr (same as DEBUG=true)")
+	dryRunFlag := flag.Bool("dry-run", false, "simulate file changes and allow only read-only bash commands (same as MCC_READONLY=true)")
+	var oneShot string
+	flag.StringVar(&oneShot, "p", "", "run this one prompt non-interactively and exit (- reads it from stdin)")
+	flag.StringVar(&oneShot, "prompt", "", "same as -p")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [prompt...]\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(flag.CommandLine.Output(), "A prompt given as arguments (joined with spaces) runs as the first turn.\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	// Arguments after the flags seed the first turn: mcc "fix the failing test"
+	initialPrompt := strings.TrimSpace(strings.Join(flag.Args(), " "))
+
+	if oneShot != "" && initialPrompt != "" {
+		log.Fatal("give the prompt either with -p or as arguments, not both")
+	}
+	if oneShot == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatalf("-p -: reading stdin: %v", err)
+		}
+		oneShot = string(data)
+		if strings.TrimSpace(oneShot) == "" {
+			log.Fatal("-p -: stdin was empty")
+		}
+	}
+	if *streamFlag && *noStreamFlag {
+		log.Fatal("--stream and --no-stream cannot be combined")
+	}
+	if *maxTokensFlag < 0 {
+		log.Fatal("--max-tokens must be positive")
+	}
+	setFlag := func(name, value string) {
+		if value != "" {
+			flagSettings[name] = value
+		}
+	}
+	setFlag("OPENAI_MODEL", strings.TrimSpace(*modelFlag))
+	setFlag("OPENAI_BASE_URL", strings.TrimSpace(*baseURLFlag))
+	if *maxTokensFlag > 0 {
+		setFlag("OPENAI_MAX_TOKENS", strconv.Itoa(*maxTokensFlag))
+	}
+	if *streamFlag {
+		setFlag("OPENAI_STREAM", "true")
+	}
+	if *noStreamFlag {
+		setFlag("OPENAI_STREAM", "false")
+	}
+	if *debugFlag {
+		setFlag("DEBUG", "true")
+	}
+	if *dryRunFlag {
+		setFlag("MCC_READONLY", "true")
+	}
+
+	workDir, err := resolveWorkDir(*workDirFlag)
+	if err != nil {
+		log.Fatalf("workspace (--workdir or MCC_WORKDIR): %v", err)
+	}
+	configSources, err := loadConfigFiles(*configPath, workDir)
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	cfg := loadConfig(workDir)
+	if *approve {
+		cfg.ApproveBash = true
+	}
+	if selfTest.mode != "" {
+		os.Exit(runSelfTest(cfg, selfTest.mode == "net"))
+	}
+	if cfg.APIKey == "" {
+		log.Fatal("OPENAI_API_KEY required")
+	}
+	turnRetries.Reset(cfg.RetryBudget)
+	if cfg.AuditLog != "" {
+		if err := audit.Open(cfg.AuditLog); err != nil {
+			log.Fatalf("AUDIT_LOG: %v", err)
+		}
+	}
+	if cfg.ObservationsSource != "" {
+		if err := observations.Start(cfg.ObservationsSource); err != nil {
+			log.Fatalf("OBSERVATIONS_SOURCE: %v", err)
+		}
+	}
+	if cfg.OutputFormat == "json" {
+		// Events own stdout; everything printed for humans goes to stderr
+		events.Enable(os.Stdout)
+		os.Stdout = os.Stderr
+	}
+	st := &replState{cfg: cfg, history: make([]Message, 0), session: newSession(cfg)}
+
+	if *resumeID != "" || *continueLast {
+		var loaded *Session
+		var err error
+		if *resumeID != "" {
+			loaded, err = loadSession(cfg, *resumeID)
+		} else {
+			loaded, err = latestSession(cfg)
+		}
+		if err != nil {
+			log.Fatalf("resume session: %v", err)
+		}
+		st.session = loaded
+		st.history = loaded.History
+		if len(loaded.Todos) > 0 {
+			if _, err := todoBoard.Update(loaded.Todos, cfg.MaxTodoItems); err != nil {
+				fmt.Printf("Warning: could not restore todos: %v\n", err)
+			}
+		}
+		approvals.Restore(loaded.AllowRules, loaded.DenyRules)
+		sessionEnv.Restore(loaded.Env)
+		fmt.Printf("Resumed session %s (%d messages, last used %s)\n",
+			loaded.ID, len(loaded.History), loaded.UpdatedAt.Local().Format("2006-01-02 15:04"))
+	}
+
+	// A resumed session brings its own board; otherwise pick up the last one
+	var restoredTodos []string
+	if len(todoBoard.Items()) == 0 {
+		if items, err := loadTodos(cfg); err != nil {
+			fmt.Printf("Warning: could not load todos: %v\n", err)
+		} else if len(items) > 0 {
+			if _, err := todoBoard.Update(items, cfg.MaxTodoItems); err != nil {
+				fmt.Printf("Warning: could not restore todos from %s: %v\n", todosFile, err)
+			} else {
+				stats := todoBoard.Stats()
+				fmt.Printf("Restored %d todos from %s (%d completed); /todos shows them\n", stats["total"], todosFile, stats["completed"])
+				for _, item := range todoBoard.Items() {
+					restoredTodos = append(restoredTodos, fmt.Sprintf("- [%s] %s", item.Status, item.Content))
+				}
+			}
+		}
+	}
+
+	// Initialize with initial reminder
+	pendingContext.Ensure(initialReminder)
+	if len(restoredTodos) > 0 {
+		pendingContext.Ensure(fmt.Sprintf(todosRestoredReminder, strings.Join(restoredTodos, "\n")))
+	}
+	if cfg.MemoryInject {
+		if items, err := memory.Items(cfg); err != nil {
+			fmt.Printf("Warning: could not load memory: %v\n", err)
+		} else if digest, n := memoryDigest(items); n > 0 {
+			pendingContext.Ensure(fmt.Sprintf(memoryReminder, digest))
+			fmt.Printf("Loaded %d of %d memories from %s\n", n, len(items), memoryFile)
+		}
+	}
+
+	// Turns never start after the deadline; a running turn is left to finish,
+	// except with -p, where the deadline cancels the one turn
+	ctx := context.Background()
+	if cfg.SessionTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.SessionTimeout)
+		defer cancel()
+	}
+	started := time.Now()
+	turns := 0
+
+	// Ctrl-C cancels the running turn; at the prompt it exits
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	st.interrupts = interrupts
+
+	if strings.TrimSpace(oneShot) != "" {
+		os.Exit(st.runOnce(ctx, oneShot))
+	}
+
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		lineInput = newLineEditor(filepath.Join(mccHomeDir(), historyFile), cfg.WorkDir)
+	}
+
+	fmt.Printf("Tiny CC Agent (Go) -- cwd: %s\n", cfg.WorkDir)
+	if len(configSources) > 0 {
+		fmt.Printf("Config: %s\n", strings.Join(configSources, ", "))
+	}
+	if cfg.AgentName != "" {
+		fmt.Printf("Name: %s\n", cfg.AgentName)
+	}
+	if cfg.Persona != "" {
+		fmt.Printf("Persona: %s\n", cfg.Persona)
+	}
+	if cfg.ProjectContextFile != "" {
+		fmt.Printf("Project context: %s (%d chars)\n", cfg.ProjectContextFile, utf8.RuneCountInString(cfg.ProjectContext))
+	}
+	if cfg.EnabledTools != nil {
+		var names []string
+		for _, def := range toolDefinitions(cfg) {
+			names = append(names, toolName(def))
+		}
+		fmt.Printf("Tools: %s\n", strings.Join(names, ", "))
+	}
+	if cfg.DryRun {
+		fmt.Println("Dry run: file changes are simulated and bash is limited to read-only commands.")
+	}
+	fmt.Println("Type \"exit\" or \"quit\" to leave.")
+	fmt.Println()
+
+	for {
+		if ctx.Err() != nil {
+			break
+		}
+		var line string
+		if initialPrompt != "" {
+			line, initialPrompt = initialPrompt, ""
+			fmt.Printf("User: %s\n", line)
+		} else {
+			var ok bool
+			line, ok = readMessage(ctx, interrupts, "User: ")
+			if !ok {
+				break
+			}
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+		lower := strings.ToLower(trimmed)
+		if lower == "exit" || lower == "quit" || lower == "q" {
+			break
+		}
+
+		if strings.HasPrefix(trimmed, "/") {
+			prompt, send := handleSlashCommand(st, trimmed)
+			if !send {
+				continue
+			}
+			line = prompt
+		}
+
+		// Attach @file mentions, then inject reminders into user message
+		attachMentions(st.cfg, line)
+		content := pendingContext.Inject(line)
+		st.history = append(st.history, Message{Role: "user", Content: content})
+
+		turnCfg := st.cfg
+		if st.nextToolChoice != "" {
+			turnCfg.ToolChoice, st.nextToolChoice = st.nextToolChoice, ""
+		}
+		turnRetries.Reset(st.cfg.RetryBudget)
+		turnCtx, release := st.interruptible(context.Background())
+		updated, err := query(turnCtx, turnCfg, st.history)
+		if st.cfg.Debug {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Turn retry budget left: %d of %d\n", turnRetries.Remaining(), st.cfg.RetryBudget)
+		}
+		if release() {
+			// Keep what completed so the conversation can carry on
+			st.history = updated
+			if term.IsTerminal(int(os.Stdout.Fd())) {
+				fmt.Print("\r\033[K")
+			} else {
+				fmt.Println()
+			}
+			fmt.Println("(interrupted)")
+			continue
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			continue
+		}
+		st.history = updated
+		turns++
+
+		if st.cfg.SessionAutosave {
+			if err := saveSession(st.cfg, st.session, st.history); err != nil {
+				fmt.Printf("Warning: could not save session: %v\n", err)
+			}
+		}
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		fmt.Println()
+		stats := todoBoard.Stats()
+		fmt.Printf("Session timeout (%s) reached after %s: %d turns, %d messages, todos %d/%d completed.\n",
+			cfg.SessionTimeout, time.Since(started).Round(time.Second), turns, len(st.history),
+			stats["completed"], stats["total"])
+		st.saveOnExit()
+		os.Exit(exitSessionTimeout)
+	}
+	st.saveOnExit()
+}
+
+// exitSessionTimeout is the exit status when SESSION_TIMEOUT ends the run,
+// matching timeout(1) so scripts can tell it apart from failures.
+const exitSessionTimeout = 124
+
+// readLine shows prompt and reads one line of input, giving up when ctx is
+// done or on Ctrl-C. On a terminal it goes through lineInput.
+func readLine(ctx context.Context, interrupts <-chan os.Signal, prompt string) (string, bool) {
+	if lineInput != nil {
+		type result struct {
+			text string
+			err  error
+		}
+		done := make(chan result, 1)
+		go func() {
+			text, err := lineInput.ReadLine(prompt)
+			done <- result{text, err}
+		}()
+		select {
+		case r := <-done:
+			return r.text, r.err == nil
+		case <-ctx.Done():
+			lineInput.Restore()
+			fmt.Println()
+			return "", false
+		}
+	}
+	fmt.Print(prompt)
+	done := make(chan bool, 1)
+	go func() { done <- stdinScanner.Scan() }()
+	select {
+	case ok := <-done:
+		return stdinScanner.Text(), ok
+	case <-ctx.Done():
+		return "", false
+	case <-interrupts:
+		fmt.Println()
+		return "", false
+	}
+}
+
+// messageFence opens and closes a multi-line message at the prompt.
+const messageFence = `"""`
+
+// readMessage reads one message at the prompt. A line that starts with """
+// collects everything up to a closing """ line, blank lines included, and a
+// trailing backslash joins the next line on.
+func readMessage(ctx context.Context, interrupts <-chan os.Signal, prompt string) (string, bool) {
+	line, ok := readLine(ctx, interrupts, prompt)
+	if !ok {
+		return "", false
+	}
+	if rest, found := strings.CutPrefix(strings.TrimSpace(line), messageFence); found {
+		var lines []string
+		if rest != "" {
+			lines = append(lines, rest)
+		}
+		for {
+			next, ok := readLine(ctx, interrupts, continuationPrompt)
+			if !ok {
+				return "", false
+			}
+			if strings.TrimSpace(next) == messageFence {
+				return strings.Join(lines, "\n"), true
+			}
+			lines = append(lines, next)
+		}
+	}
+	var lines []string
+	for strings.HasSuffix(line, "\\") {
+		lines = append(lines, strings.TrimSuffix(line, "\\"))
+		if line, ok = readLine(ctx, interrupts, continuationPrompt); !ok {
+			return "", false
+		}
+	}
+	return strings.Join(append(lines, line), "\n"), true
+}
+
+// historyFile is the REPL input history, under mccHomeDir. maxHistoryEntries
+// caps what is loaded and kept; the file is compacted once it holds twice that.
+const (
+	historyFile        = "history"
+	maxHistoryEntries  = 1000
+	continuationPrompt = "... "
+)
+
+var (
+	pasteStartMarker = []byte("\x1b[200~")
+	pasteEndMarker   = []byte("\x1b[201~")
+)
+
+// lineInput edits REPL input in place when stdin is a terminal; it is nil
+// for piped input, which keeps using stdinScanner.
+var lineInput *lineEditor
+
+// editorIO lets the line editor be replayed against saved history before it
+// is pointed at the real terminal. It also watches for bracketed paste
+// markers and turns every pasted line break into a plain Enter, counting them
+// so ReadLine can tell pasted lines from the one the user submits.
+type editorIO struct {
+	r       io.Reader
+	w       io.Writer
+	window  []byte
+	pasting bool
+	lastCR  bool
+	breaks  int
+}
+
+func (e *editorIO) Write(p []byte) (int, error) { return e.w.Write(p) }
+
+func (e *editorIO) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	out := p[:0]
+	for _, c := range p[:n] {
+		e.window = append(e.window, c)
+		if len(e.window) > len(pasteEndMarker) {
+			e.window = e.window[1:]
+		}
+		if bytes.Equal(e.window, pasteStartMarker) {
+			e.pasting = true
+		} else if bytes.Equal(e.window, pasteEndMarker) {
+			e.pasting = false
+		}
+		if e.pasting && (c == '\r' || c == '\n') {
+			if c == '\n' && e.lastCR {
+				e.lastCR = false
+				continue
+			}
+			e.lastCR = c == '\r'
+			e.breaks++
+			c = '\r'
+		} else {
+			e.lastCR = false
+		}
+		out = append(out, c)
+	}
+	return len(out), err
+}
+
+// takeBreak reports whether a pasted line break is still waiting to be read,
+// consuming it.
+func (e *editorIO) takeBreak() bool {
+	if e.breaks == 0 {
+		return false
+	}
+	e.breaks--
+	return true
+}
+
+// lineEditor is a readline-style prompt built on term.Terminal: arrow keys
+// move the cursor and walk history, and a bracketed paste of several lines
+// arrives as one message. The terminal is only in raw mode while reading.
+type lineEditor struct {
+	fd      int
+	term    *term.Terminal
+	io      *editorIO
+	path    string
+	last    string
+	mu      sync.Mutex
+	restore *term.State
+}
+
+// newLineEditor loads the history at path into a fresh editor whose Tab key
+// completes file paths under workDir.
+func newLineEditor(path, workDir string) *lineEditor {
+	entries := loadHistory(path)
+	var seed strings.Builder
+	seeded := 0
+	for _, e := range entries {
+		// term.Terminal keeps single lines only; multi-line entries stay in the file
+		if strings.ContainsFunc(e, unicode.IsControl) {
+			continue
+		}
+		seed.WriteString(e + "\r")
+		seeded++
+	}
+	rw := &editorIO{r: strings.NewReader(seed.String()), w: io.Discard}
+	t := term.NewTerminal(rw, "")
+	for i := 0; i < seeded; i++ {
+		if _, err := t.ReadLine(); err != nil {
+			break
+		}
+	}
+	rw.r, rw.w = os.Stdin, os.Stdout
+	le := &lineEditor{fd: int(os.Stdin.Fd()), term: t, io: rw, path: path}
+	if len(entries) > 0 {
+		le.last = entries[len(entries)-1]
+	}
+	t.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+		newLine, newPos, matches := completePath(workDir, line, pos)
+		if newLine != "" {
+			return newLine, newPos, true
+		}
+		if len(matches) > 1 {
+			// nothing more in common: list the choices above the prompt
+			t.Write([]byte(strings.Join(matches, "  ") + "\n"))
+		}
+		return "", 0, false
+	}
+	return le
+}
+
+// completePath completes the word before pos in line when it is an @mention
+// or looks like a path, against entries of the workspace directory it names.
+// It returns the completed line and cursor, or when the matches share nothing
+// beyond what was typed, an empty line and the matches. Directories end in a
+// slash so the next Tab continues into them.
+func completePath(workDir, line string, pos int) (string, int, []string) {
+	start := strings.LastIndexAny(line[:pos], " \t") + 1
+	word := strings.TrimPrefix(line[start:pos], "@")
+	if word == line[start:pos] && !strings.ContainsAny(word, "/.") {
+		return "", 0, nil
+	}
+	dir, base := word[:strings.LastIndex(word, "/")+1], word[strings.LastIndex(word, "/")+1:]
+	abs, err := safePath(workDir, dir+".")
+	if err != nil {
+		return "", 0, nil
+	}
+	entries, err := os.ReadDir(abs)
+	if err != nil {
+		return "", 0, nil
+	}
+	var matches []string
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, base) || (strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".")) {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(abs, name)); err == nil && info.IsDir() {
+			name += "/"
+		}
+		matches = append(matches, name)
+	}
+	if len(matches) == 0 {
+		return "", 0, nil
+	}
+	common := []rune(matches[0])
+	for _, m := range matches[1:] {
+		r := []rune(m)
+		n := 0
+		for n < len(common) && n < len(r) && common[n] == r[n] {
+			n++
+		}
+		common = common[:n]
+	}
+	if len(matches) > 1 && len(string(common)) == len(base) {
+		return "", 0, matches
+	}
+	head := line[:pos-len(base)] + string(common)
+	return head + line[pos:], len(head), matches
+}
+
+// ReadLine shows prompt and returns the entered text. io.EOF means Ctrl-D on
+// an empty line or Ctrl-C.
+func (le *lineEditor) ReadLine(prompt string) (string, error) {
+	state, err := term.MakeRaw(le.fd)
+	if err != nil {
+		return "", err
+	}
+	le.mu.Lock()
+	le.restore = state
+	le.mu.Unlock()
+	defer le.Restore()
+
+	if w, h, err := term.GetSize(int(os.Stdout.Fd())); err == nil && w > 0 {
+		le.term.SetSize(w, h)
+	}
+	le.term.SetPrompt(prompt)
+	le.term.SetBracketedPasteMode(true)
+	defer le.term.SetBracketedPasteMode(false)
+	var lines []string
+	for {
+		line, err := le.term.ReadLine()
+		if err != nil && err != term.ErrPasteIndicator {
+			return "", err
+		}
+		if le.io.takeBreak() {
+			lines = append(lines, line)
+			le.term.SetPrompt(continuationPrompt)
+			continue
+		}
+		// a paste ending in a newline leaves an empty line for the final Enter
+		if line != "" || len(lines) == 0 {
+			lines = append(lines, line)
+		}
+		break
+	}
+	text := strings.Join(lines, "\n")
+	le.remember(text)
+	return text, nil
+}
+
+// Restore puts the terminal back in its normal mode; it is safe to call
+// while ReadLine is blocked, e.g. when the session times out.
+func (le *lineEditor) Restore() {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	if le.restore != nil {
+		term.Restore(le.fd, le.restore)
+		le.restore = nil
+	}
+}
+
+// remember appends text to the history file, skipping blanks and repeats.
+func (le *lineEditor) remember(text string) {
+	if strings.TrimSpace(text) == "" || text == le.last {
+		return
+	}
+	le.last = text
+	if err := os.MkdirAll(filepath.Dir(le.path), 0o755); err != nil {
+		return
+	}
+	f, err := os.OpenFile(le.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	data, _ := json.Marshal(text)
+	f.Write(append(data, '\n'))
+}
+
+// loadHistory reads the newest maxHistoryEntries entries from path, one JSON
+// string per line, and compacts the file when it has grown too long.
+func loadHistory(path string) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var entries []string
+	for _, line := range strings.Split(string(data), "\n") {
+		var e string
+		if line != "" && json.Unmarshal([]byte(line), &e) == nil {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) <= maxHistoryEntries {
+		return entries
+	}
+	compact := len(entries) > 2*maxHistoryEntries
+	entries = entries[len(entries)-maxHistoryEntries:]
+	if compact {
+		var b bytes.Buffer
+		for _, e := range entries {
+			line, _ := json.Marshal(e)
+			b.Write(append(line, '\n'))
+		}
+		writeFileAtomic(path, b.Bytes())
+	}
+	return entries
+}
+
+// replState is the interactive loop's mutable state, shared with slash commands.
+type replState struct {
+	cfg        Config
+	history    []Message
+	session    *Session
+	interrupts <-chan os.Signal
+	// nextToolChoice overrides cfg.ToolChoice for the next turn (/tools)
+	nextToolChoice string
+}
+
+// interruptible returns a child of parent that Ctrl-C cancels until release
+// is called; release reports whether an interrupt arrived.
+func (st *replState) interruptible(parent context.Context) (context.Context, func() bool) {
+	ctx, cancel := context.WithCancel(parent)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-st.interrupts:
+			cancel()
+		case <-done:
+		}
+	}()
+	return ctx, func() bool {
+		close(done)
+		interrupted := ctx.Err() != nil && parent.Err() == nil
+		cancel()
+		return interrupted
+	}
+}
+
+// runOnce runs a single prompt for -p and returns the exit status: 0 when
+// the turn completed, 1 on error, 130 when interrupted and
+// exitSessionTimeout when ctx's deadline cut it short. Only the reply and
+// tool activity go to stdout.
+func (st *replState) runOnce(ctx context.Context, prompt string) int {
+	attachMentions(st.cfg, prompt)
+	st.history = append(st.history, Message{Role: "user", Content: pendingContext.Inject(prompt)})
+	turnRetries.Reset(st.cfg.RetryBudget)
+	turnCtx, release := st.interruptible(ctx)
+	updated, err := query(turnCtx, st.cfg, st.history)
+	interrupted := release()
+	if updated != nil {
+		st.history = updated
+	}
+	if st.cfg.SessionSave {
+		if err := saveSession(st.cfg, st.session, st.history); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not save session: %v\n", err)
+		}
+	}
+	switch {
+	case interrupted:
+		fmt.Fprintln(os.Stderr, "(interrupted)")
+		return 130
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		fmt.Fprintf(os.Stderr, "Session timeout (%s) reached\n", st.cfg.SessionTimeout)
+		return exitSessionTimeout
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// saveOnExit saves a non-empty conversation when session saving is enabled.
+func (st *replState) saveOnExit() {
+	if !st.cfg.SessionSave || len(st.history) == 0 {
+		return
+	}
+	if err := saveSession(st.cfg, st.session, st.history); err != nil {
+		fmt.Printf("Warning: could not save session: %v\n", err)
+		return
+	}
+	fmt.Printf("Session saved: %s (resume with --resume %s)\n", st.session.ID, st.session.ID)
+}
+
+// slashCommands lists the REPL commands shown by /help.
+var slashCommands = []struct{ usage, help string }{
+	{"/help", "show this list"},
+	{"/run <template> [key=value ...]", "send a prompt template from .mcc/templates with variables filled in"},
+	{"/export <path>", "write the conversation to a Markdown file"},
+	{"/model [name]", "show or switch the model for later turns"},
+	{"/tools [auto|none|required|<tool>]", "show or set the tool choice for the next turn"},
+	{"/clear", "start a fresh conversation (alias /reset)"},
+	{"/todos", "show the todo board"},
+	{"/undo", "revert the agent's last file change"},
+	{"/env [set KEY=VALUE|unset KEY]", "list or change variables every bash command sees"},
+	{"/macro record <name>|stop|list", "record the agent's tool calls as a macro"},
+	{"/macro play <name> [key=value ...]", "replay a macro's tool calls without the model"},
+}
+
+// handleSlashCommand runs a REPL command. When send is true, prompt is sent
+// to the model as if the user had typed it.
+func handleSlashCommand(st *replState, line string) (prompt string, send bool) {
+	args, err := splitArgs(line)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return "", false
+	}
+	name, args := strings.ToLower(args[0]), args[1:]
+
+	switch name {
+	case "/help":
+		for _, c := range slashCommands {
+			fmt.Printf("  %-36s %s\n", c.usage, c.help)
+		}
+	case "/run":
+		if len(args) == 0 {
+			fmt.Println("Usage: /run <template> [key=value ...]")
+			return "", false
+		}
+		text, err := renderTemplate(st.cfg.WorkDir, args[0], args[1:])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return "", false
+		}
+		return text, true
+	case "/model":
+		if len(args) == 0 {
+			fmt.Printf("Current model: %s\n", st.cfg.Model)
+			return "", false
+		}
+		if len(args) != 1 || strings.TrimSpace(args[0]) == "" {
+			fmt.Println("Usage: /model [name]")
+			return "", false
+		}
+		previous := st.cfg.Model
+		st.cfg.Model = strings.TrimSpace(args[0])
+		// A deployment that defaulted to the model name follows it
+		if st.cfg.Deployment == previous {
+			st.cfg.Deployment = st.cfg.Model
+		}
+		fmt.Printf("Model changed: %s -> %s\n", previous, st.cfg.Model)
+	case "/tools":
+		if len(args) == 0 {
+			if st.nextToolChoice != "" {
+				fmt.Printf("Tool choice: %s (next turn: %s)\n", st.cfg.ToolChoice, st.nextToolChoice)
+			} else {
+				fmt.Printf("Tool choice: %s\n", st.cfg.ToolChoice)
+			}
+			return "", false
+		}
+		if len(args) != 1 {
+			fmt.Println("Usage: /tools [auto|none|required|<tool>]")
+			return "", false
+		}
+		choice, err := parseToolChoice(args[0], st.cfg)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return "", false
+		}
+		st.nextToolChoice = choice
+		fmt.Printf("Tool choice for the next turn: %s\n", choice)
+	case "/export":
+		if len(args) != 1 {
+			fmt.Println("Usage: /export <path>")
+			return "", false
+		}
+		path := args[0]
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(st.cfg.WorkDir, path)
+		}
+		if err := os.WriteFile(path, []byte(exportMarkdown(st.cfg, st.history)), 0o644); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return "", false
+		}
+		fmt.Printf("Exported %d messages to %s\n", len(st.history), path)
+	case "/clear", "/reset":
+		// Keep the old conversation resumable before starting over
+		st.saveOnExit()
+		st.history = make([]Message, 0)
+		st.session = newSession(st.cfg)
+		todoBoard.Reset()
+		publishTodos()
+		if err := saveTodos(st.cfg); err != nil {
+			fmt.Printf("Warning: could not save %s: %v\n", todosFile, err)
+		}
+		lastWrites.Reset()
+		edits.Reset()
+		builds.Invalidate()
+		agentState.mu.Lock()
+		agentState.roundsWithoutTodo = 0
+		agentState.mu.Unlock()
+		pendingContext.Take()
+		pendingContext.Ensure(initialReminder)
+		fmt.Println("Conversation cleared; todo board reset.")
+	case "/todos":
+		fmt.Println(todoBoard.Render())
+	case "/undo":
+		// The model learns of the revert through the stale-file notice
+		_, result, err := undoLastEdit(st.cfg)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return "", false
+		}
+		builds.Invalidate()
+		fmt.Println(result)
+	case "/macro":
+		handleMacroCommand(st, args)
+	case "/env":
+		handleEnvCommand(st.cfg, args)
+	default:
+		fmt.Printf("Unknown command %s (type /help for a list)\n", name)
+	}
+	return "", false
+}
+
+// handleEnvCommand implements /env list, /env set KEY=VALUE and /env unset KEY.
+func handleEnvCommand(cfg Config, args []string) {
+	sub := "list"
+	if len(args) > 0 {
+		sub = strings.ToLower(args[0])
+	}
+	switch {
+	case sub == "list" && len(args) <= 1:
+		vars := sessionEnv.Vars()
+		if len(vars) == 0 {
+			fmt.Println("No session variables (set one with /env set KEY=VALUE)")
+			return
+		}
+		keys := make([]string, 0, len(vars))
+		for k := range vars {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Printf("  %s=%s\n", k, maskEnvValue(cfg, k, vars[k]))
+		}
+	case sub == "set" && len(args) == 2:
+		key, value, ok := strings.Cut(args[1], "=")
+		if !ok || !envKeyPattern.MatchString(key) {
+			fmt.Println("Usage: /env set KEY=VALUE")
+			return
+		}
+		value = sessionEnv.Set(key, value)
+		builds.Invalidate()
+		fmt.Printf("Set %s=%s for later bash commands\n", key, maskEnvValue(cfg, key, value))
+	case sub == "unset" && len(args) == 2:
+		if sessionEnv.Unset(args[1]) {
+			builds.Invalidate()
+			fmt.Printf("Unset %s\n", args[1])
+		} else {
+			fmt.Printf("%s is not set\n", args[1])
+		}
+	default:
+		fmt.Println("Usage: /env [list | set KEY=VALUE | unset KEY]")
+	}
+}
+
+// exportMarkdown renders the conversation as Markdown, with tool arguments and
+// results in fenced code blocks. Injected system reminders are left out.
+func exportMarkdown(cfg Config, history []Message) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Transcript\n\n- Date: %s\n- Model: %s\n- Workspace: %s\n\n",
+		time.Now().Format("2006-01-02 15:04"), cfg.Model, cfg.WorkDir)
+
+	for _, msg := range history {
+		switch msg.Role {
+		case "user":
+			var parts []string
+			for _, text := range contentTexts(msg.Content) {
+				if !strings.HasPrefix(strings.TrimSpace(text), "<reminder") {
+					parts = append(parts, text)
+				}
+			}
+			if len(parts) == 0 {
+				continue
+			}
+			fmt.Fprintf(&b, "## User\n\n%s\n\n", strings.Join(parts, "\n\n"))
+		case "assistant":
+			if text := contentText(msg.Content); text != "" {
+				fmt.Fprintf(&b, "## Assistant\n\n%s\n\n", text)
+			}
+			for _, tc := range msg.ToolCalls {
+				args := tc.Function.Arguments
+				var pretty bytes.Buffer
+				if err := json.Indent(&pretty, []byte(args), "", "  "); err == nil {
+					args = pretty.String()
+				}
+				fmt.Fprintf(&b, "### Tool call: %s\n\n%s\n\n", tc.Function.Name, fenced(args, "json"))
+			}
+		case "tool":
+			fmt.Fprintf(&b, "### Tool result: %s\n\n%s\n\n", msg.Name, fenced(contentText(msg.Content), ""))
+		}
+	}
+	return b.String()
+}
+
+// fenced wraps text in a code fence longer than any backtick run inside it.
+func fenced(text, lang string) string {
+	fence := "```"
+	for strings.Contains(text, fence) {
+		fence += "`"
+	}
+	return fence + lang + "\n" + strings.TrimRight(text, "\n") + "\n" + fence
+}
+
+// templateVarPattern matches {{name}} placeholders in prompt templates.
+var templateVarPattern = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// renderTemplate loads .mcc/templates/<name>(.md|.txt) from the workspace and
+// substitutes key=value assignments. Every placeholder must be given a value.
+func renderTemplate(workDir, name string, assignments []string) (string, error) {
+	dir := filepath.Join(workDir, ".mcc", "templates")
+	base := filepath.Base(name)
+	var data []byte
+	var err error
+	for _, candidate := range []string{base, base + ".md", base + ".txt"} {
+		data, err = os.ReadFile(filepath.Join(dir, candidate))
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("template %q not found in %s", name, dir)
+	}
+
+	values, err := parseAssignments(assignments)
+	if err != nil {
+		return "", err
+	}
+
+	var missing []string
+	seen := make(map[string]bool)
+	for _, match := range templateVarPattern.FindAllStringSubmatch(string(data), -1) {
+		key := match[1]
+		if _, ok := values[key]; !ok && !seen[key] {
+			missing = append(missing, key)
+		}
+		seen[key] = true
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("template %q needs: %s", name, strings.Join(missing, ", "))
+	}
+	for key := range values {
+		if !seen[key] {
+			fmt.Printf("Warning: template %q has no {{%s}} placeholder\n", name, key)
+		}
+	}
+
+	return templateVarPattern.ReplaceAllStringFunc(string(data), func(m string) string {
+		return values[templateVarPattern.FindStringSubmatch(m)[1]]
+	}), nil
+}
+
+// parseAssignments turns key=value arguments into a map.
+func parseAssignments(assignments []string) (map[string]string, error) {
+	values := make(map[string]string, len(assignments))
+	for _, assignment := range assignments {
+		key, value, ok := strings.Cut(assignment, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid argument %q (want key=value)", assignment)
+		}
+		values[strings.TrimSpace(key)] = value
+	}
+	return values, nil
+}
+
+// Macro is a recorded sequence of tool calls that /macro play replays
+// without the model. Arguments may contain {{name}} placeholders, filled in
+// from key=value arguments at play time.
+type Macro struct {
+	Name      string     `json:"name"`
+	CreatedAt time.Time  `json:"created_at"`
+	Calls     []ToolCall `json:"calls"`
+}
+
+// MacroRecorder collects the tool calls dispatched between /macro record
+// and /macro stop.
+type MacroRecorder struct {
+	mu    sync.Mutex
+	name  string
+	calls []ToolCall
+}
+
+// Start begins recording under name (thread-safe)
+func (mr *MacroRecorder) Start(name string) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if mr.name != "" {
+		return fmt.Errorf("already recording macro %q", mr.name)
+	}
+	mr.name = name
+	mr.calls = nil
+	return nil
+}
+
+// Capture appends a dispatched tool call while recording (thread-safe)
+func (mr *MacroRecorder) Capture(tc ToolCall) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if mr.name != "" {
+		mr.calls = append(mr.calls, tc)
+	}
+}
+
+// Stop ends recording and returns the macro, or false if none was active
+func (mr *MacroRecorder) Stop() (*Macro, bool) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if mr.name == "" {
+		return nil, false
+	}
+	m := &Macro{Name: mr.name, CreatedAt: time.Now().UTC(), Calls: mr.calls}
+	mr.name = ""
+	mr.calls = nil
+	return m, true
+}
+
+// macroDir holds the workspace's saved macros, one JSON file each.
+func macroDir(workDir string) string {
+	return filepath.Join(workDir, ".mcc", "macros")
+}
+
+func saveMacro(workDir string, m *Macro) (string, error) {
+	if err := os.MkdirAll(macroDir(workDir), 0o755); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(macroDir(workDir), filepath.Base(m.Name)+".json")
+	return path, os.WriteFile(path, data, 0o644)
+}
+
+func loadMacro(workDir, name string) (*Macro, error) {
+	data, err := os.ReadFile(filepath.Join(macroDir(workDir), filepath.Base(name)+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("macro %q not found in %s", name, macroDir(workDir))
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m Macro
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("macro %q: %v", name, err)
+	}
+	return &m, nil
+}
+
+// handleMacroCommand implements /macro record|stop|list|play.
+func handleMacroCommand(st *replState, args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: /macro record <name> | stop | list | play <name> [key=value ...]")
+		return
+	}
+	switch strings.ToLower(args[0]) {
+	case "record":
+		if len(args) != 2 {
+			fmt.Println("Usage: /macro record <name>")
+			return
+		}
+		if err := macroRecorder.Start(args[1]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Printf("Recording macro %q; tool calls from the next turns are captured until /macro stop.\n", args[1])
+	case "stop":
+		m, ok := macroRecorder.Stop()
+		if !ok {
+			fmt.Println("Not recording a macro.")
+			return
+		}
+		if len(m.Calls) == 0 {
+			fmt.Printf("Macro %q recorded no tool calls; nothing saved.\n", m.Name)
+			return
+		}
+		path, err := saveMacro(st.cfg.WorkDir, m)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Printf("Saved macro %q (%d tool calls) to %s\n", m.Name, len(m.Calls), path)
+	case "list":
+		entries, err := os.ReadDir(macroDir(st.cfg.WorkDir))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		found := false
+		for _, entry := range entries {
+			name, ok := strings.CutSuffix(entry.Name(), ".json")
+			if !ok || entry.IsDir() {
+				continue
+			}
+			m, err := loadMacro(st.cfg.WorkDir, name)
+			if err != nil {
+				fmt.Printf("  %-20s (unreadable: %v)\n", name, err)
+				continue
+			}
+			fmt.Printf("  %-20s %d tool calls\n", name, len(m.Calls))
+			found = true
+		}
+		if !found {
+			fmt.Println("No macros saved yet.")
+		}
+	case "play":
+		if len(args) < 2 {
+			fmt.Println("Usage: /macro play <name> [key=value ...]")
+			return
+		}
+		m, err := loadMacro(st.cfg.WorkDir, args[1])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		ctx, release := st.interruptible(context.Background())
+		n, err := playMacro(ctx, st.cfg, m, args[2:])
+		if release() {
+			fmt.Println("(interrupted)")
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Printf("Replayed %d of %d tool calls from macro %q\n", n, len(m.Calls), m.Name)
+	default:
+		fmt.Printf("Unknown /macro subcommand %q\n", args[0])
+	}
+}
+
+// playMacro fills placeholders in every call, then dispatches the calls in
+// order and tells the model about it through a reminder. It returns how
+// many calls ran.
+func playMacro(ctx context.Context, cfg Config, m *Macro, assignments []string) (int, error) {
+	values, err := parseAssignments(assignments)
+	if err != nil {
+		return 0, err
+	}
+
+	calls := make([]ToolCall, len(m.Calls))
+	var missing []string
+	seen := make(map[string]bool)
+	for i, tc := range m.Calls {
+		tc.Function.Arguments = templateVarPattern.ReplaceAllStringFunc(tc.Function.Arguments, func(match string) string {
+			key := templateVarPattern.FindStringSubmatch(match)[1]
+			value, ok := values[key]
+			if !ok {
+				if !seen[key] {
+					missing = append(missing, key)
+				}
+				seen[key] = true
+				return match
+			}
+			// Values land inside JSON strings, so escape them as such
+			quoted, _ := json.Marshal(value)
+			return string(quoted[1 : len(quoted)-1])
+		})
+		calls[i] = tc
+	}
+	if len(missing) > 0 {
+		return 0, fmt.Errorf("macro %q needs: %s", m.Name, strings.Join(missing, ", "))
+	}
+
+	var names []string
+	for _, tc := range calls {
+		if ctx.Err() != nil {
+			break
+		}
+		dispatchToolCall(ctx, cfg, tc)
+		names = append(names, tc.Function.Name)
+	}
+	if len(names) > 0 {
+		pendingContext.Ensure(fmt.Sprintf(macroPlayedReminder, m.Name, len(names), strings.Join(names, ", ")))
+	}
+	return len(names), nil
+}
+
+// splitArgs splits a command line on whitespace, honoring single and double
+// quotes so values like msg="fix the bug" stay together.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return args, nil
+}
+
+func loadConfig(workDir string) Config {
+	apiKey := strings.TrimSpace(os.Getenv("OPENAI_API_KEY"))
+	apiType := strings.ToLower(strings.TrimSpace(getenv("OPENAI_API_TYPE")))
+	if apiType == "" {
+		apiType = "openai"
+	}
+	if apiType != "openai" && apiType != "azure" && apiType != "anthropic" {
+		log.Fatalf("OPENAI_API_TYPE must be openai, azure or anthropic, got %q", apiType)
+	}
+
+	baseURL := strings.TrimSpace(getenv("OPENAI_BASE_URL"))
+	if baseURL == "" {
+		baseURL = "https://api.openai.com"
+		if apiType == "anthropic" {
+			baseURL = "https://api.anthropic.com"
+		}
+	}
+
+	model := strings.TrimSpace(getenv("OPENAI_MODEL"))
+	if model == "" {
+		model = "gpt-4"
+	}
+
+	maxTokens := defaultMaxTokens
+	if maxTokensStr := strings.TrimSpace(getenv("OPENAI_MAX_TOKENS")); maxTokensStr != "" {
+		if parsed, err := strconv.Atoi(maxTokensStr); err == nil && parsed > 0 {
+			maxTokens = parsed
+		}
+	}
+
+	maxIterations := defaultIterations
+	if raw := strings.TrimSpace(os.Getenv("AGENT_MAX_ITERATIONS")); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed > 0 {
+			maxIterations = parsed
+		}
+	}
+	maxToolResultChars := defaultToolResults
+	if raw := strings.TrimSpace(os.Getenv("MAX_TOOL_RESULT_CHARS")); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed > 0 {
+			maxToolResultChars = parsed
+		}
+	}
+	searchWorkers := runtime.NumCPU()
+	if searchWorkers > maxSearchWorkers {
+		searchWorkers = maxSearchWorkers
+	}
+	if raw := strings.TrimSpace(os.Getenv("SEARCH_WORKERS")); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed > 0 {
+			searchWorkers = clampInt(parsed, 1, 64)
+		}
+	}
+	maxTodoItems := defaultTodoItems
+	if raw := strings.TrimSpace(os.Getenv("MAX_TODO_ITEMS")); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed > 0 {
+			maxTodoItems = parsed
+		}
+	}
+
+	todoNagRounds := defaultTodoNag
+	if raw := strings.TrimSpace(os.Getenv("TODO_NAG_ROUNDS")); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed >= 0 {
+			todoNagRounds = parsed
+		}
+	}
+
+	deployment := strings.TrimSpace(os.Getenv("OPENAI_DEPLOYMENT"))
+	if deployment == "" {
+		deployment = model
+	}
+	apiVersion := strings.TrimSpace(os.Getenv("OPENAI_API_VERSION"))
+	if apiVersion == "" {
+		apiVersion = defaultAzureAPIVersion
+	}
+	anthropicVersion := strings.TrimSpace(os.Getenv("ANTHROPIC_VERSION"))
+	if anthropicVersion == "" {
+		anthropicVersion = defaultAnthropicVersion
+	}
+
+	debug := strings.ToLower(strings.TrimSpace(getenv("DEBUG"))) == "true"
+	temperature := optionalFloatEnv("OPENAI_TEMPERATURE", 0, 2, debug)
+	topP := optionalFloatEnv("OPENAI_TOP_P", 0, 1, debug)
+
+	var seed *int64
+	if raw := strings.TrimSpace(os.Getenv("OPENAI_SEED")); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			log.Fatalf("OPENAI_SEED must be an integer, got %q", raw)
+		}
+		seed = &n
+	}
+
+	stop, err := parseList(os.Getenv("OPENAI_STOP"))
+	if err != nil {
+		log.Fatalf("OPENAI_STOP: %v", err)
+	}
+
+	reasoning := strings.ToLower(strings.TrimSpace(os.Getenv("OPENAI_REASONING")))
+	if reasoning == "" {
+		reasoning = "auto"
+	}
+	if reasoning != "auto" && reasoning != "true" && reasoning != "false" {
+		log.Fatalf("OPENAI_REASONING must be auto, true or false, got %q", reasoning)
+	}
+	reasoningEffort := strings.ToLower(strings.TrimSpace(os.Getenv("OPENAI_REASONING_EFFORT")))
+	switch reasoningEffort {
+	case "", "minimal", "low", "medium", "high":
+	default:
+		log.Fatalf("OPENAI_REASONING_EFFORT must be minimal, low, medium or high, got %q", reasoningEffort)
+	}
+	verbosity := strings.ToLower(strings.TrimSpace(os.Getenv("OPENAI_VERBOSITY")))
+	switch verbosity {
+	case "", "low", "medium", "high":
+	default:
+		log.Fatalf("OPENAI_VERBOSITY must be low, medium or high, got %q", verbosity)
+	}
+	reasoningPrefixes := defaultReasoningPrefixes
+	if raw, ok := os.LookupEnv("OPENAI_REASONING_MODELS"); ok {
+		reasoningPrefixes, err = parseList(strings.ToLower(raw))
+		if err != nil {
+			log.Fatalf("OPENAI_REASONING_MODELS: %v", err)
+		}
+	}
+
+	contextTokens := 0
+	if raw := strings.TrimSpace(os.Getenv("OPENAI_CONTEXT_TOKENS")); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed > 0 {
+			contextTokens = parsed
+		}
+	}
+
+	compactTokens := 100000
+	if contextTokens > 0 {
+		// Compact before trimming would start dropping messages
+		compactTokens = contextTokens * 8 / 10
+	}
+	if raw := strings.TrimSpace(os.Getenv("OPENAI_COMPACT_TOKENS")); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed > 0 {
+			compactTokens = parsed
+		}
+	}
+	compactKeepTurns := 4
+	if raw := strings.TrimSpace(os.Getenv("OPENAI_COMPACT_KEEP_TURNS")); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed > 0 {
+			compactKeepTurns = parsed
+		}
+	}
+
+	maxRetries := 3
+	if raw := strings.TrimSpace(os.Getenv("OPENAI_MAX_RETRIES")); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed >= 0 {
+			maxRetries = parsed
+		}
+	}
+	retryBudget := 10
+	if raw := strings.TrimSpace(os.Getenv("RETRY_BUDGET")); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed >= 0 {
+			retryBudget = parsed
+		}
+	}
+
+	knownContentChars := 4000
+	if raw := strings.TrimSpace(os.Getenv("KNOWN_CONTENT_CHARS")); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed >= 0 {
+			knownContentChars = parsed
+		}
+	}
+
+	sessionsDir := strings.TrimSpace(os.Getenv("MCC_SESSIONS_DIR"))
+	if sessionsDir == "" {
+		sessionsDir = filepath.Join(mccHomeDir(), "sessions")
+	}
+
+	outputFormat := strings.ToLower(strings.TrimSpace(os.Getenv("OUTPUT_FORMAT")))
+	if outputFormat == "" {
+		outputFormat = "text"
+	}
+	if outputFormat != "text" && outputFormat != "json" {
+		log.Fatalf("OUTPUT_FORMAT must be text or json, got %q", outputFormat)
+	}
+
+	planCapture := strings.ToLower(strings.TrimSpace(os.Getenv("TODO_PLAN_CAPTURE")))
+	if planCapture != "ask" && planCapture != "auto" {
+		planCapture = "off"
+	}
+
+	agentName, err := parseAgentName(os.Getenv("AGENT_NAME"))
+	if err != nil {
+		log.Fatalf("AGENT_NAME: %v", err)
+	}
+	persona, err := parsePersona(os.Getenv("AGENT_PERSONA"))
+	if err != nil {
+		log.Fatalf("AGENT_PERSONA: %v", err)
+	}
+
+	observationsSource := strings.TrimSpace(os.Getenv("OBSERVATIONS_SOURCE"))
+	if observationsSource != "" && !filepath.IsAbs(observationsSource) {
+		observationsSource = filepath.Join(workDir, observationsSource)
+	}
+
+	auditLog := strings.TrimSpace(os.Getenv("AUDIT_LOG"))
+	if auditLog != "" && !filepath.IsAbs(auditLog) {
+		auditLog = filepath.Join(workDir, auditLog)
+	}
+
+	wrapWidth := 0
+	switch raw := strings.ToLower(strings.TrimSpace(os.Getenv("WRAP_WIDTH"))); raw {
+	case "", "auto":
+	case "off", "false", "0":
+		wrapWidth = -1
+	default:
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < minWrapWidth {
+			log.Fatalf("WRAP_WIDTH must be auto, off or a width of at least %d columns, got %q", minWrapWidth, raw)
+		}
+		wrapWidth = n
+	}
+
+	streamFormat := strings.ToLower(strings.TrimSpace(os.Getenv("STREAM_FORMAT")))
+	if streamFormat == "" {
+		streamFormat = "auto"
+	}
+	if streamFormat != "auto" && streamFormat != "sse" && streamFormat != "ndjson" {
+		log.Fatalf("STREAM_FORMAT must be auto, sse or ndjson, got %q", streamFormat)
+	}
+
+	streamMaxLine := defaultStreamMaxLine
+	if raw := strings.TrimSpace(os.Getenv("STREAM_MAX_LINE")); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < bufio.MaxScanTokenSize {
+			log.Fatalf("STREAM_MAX_LINE must be a byte count of at least %d, got %q", bufio.MaxScanTokenSize, raw)
+		}
+		streamMaxLine = n
+	}
+
+	contentFilter := strings.ToLower(strings.TrimSpace(os.Getenv("CONTENT_FILTER")))
+	if contentFilter == "" {
+		contentFilter = "warn"
+	}
+	if contentFilter != "warn" && contentFilter != "retry" && contentFilter != "error" {
+		log.Fatalf("CONTENT_FILTER must be warn, retry or error, got %q", contentFilter)
+	}
+
+	extraHeaders, err := parseExtraHeaders(os.Getenv("OPENAI_EXTRA_HEADERS"))
+	if err != nil {
+		log.Fatalf("OPENAI_EXTRA_HEADERS: %v", err)
+	}
+
+	responseFormat, err := parseResponseFormat(os.Getenv("OPENAI_RESPONSE_FORMAT"))
+	if err != nil {
+		log.Fatalf("OPENAI_RESPONSE_FORMAT: %v", err)
+	}
+
+	sessionTimeout, err := parseSessionTimeout(os.Getenv("SESSION_TIMEOUT"))
+	if err != nil {
+		log.Fatalf("SESSION_TIMEOUT: %v", err)
+	}
+
+	projectContext, projectContextFile := "", ""
+	if strings.ToLower(strings.TrimSpace(os.Getenv("PROJECT_CONTEXT"))) != "false" {
+		projectContext, projectContextFile = loadProjectContext(workDir)
+	}
+
+	enabledTools, err := parseEnabledTools(os.Getenv("MCC_TOOLS"),
+		strings.ToLower(strings.TrimSpace(os.Getenv("DISABLE_BASH"))) == "true")
+	if err != nil {
+		log.Fatalf("MCC_TOOLS: %v", err)
+	}
+	toolChoice, err := parseToolChoice(os.Getenv("OPENAI_TOOL_CHOICE"), Config{EnabledTools: enabledTools})
+	if err != nil {
+		log.Fatalf("OPENAI_TOOL_CHOICE: %v", err)
+	}
+
+	bashDeny, err := parseCommandRules(getenv("BASH_DENY"))
+	if err != nil {
+		log.Fatalf("BASH_DENY: %v", err)
+	}
+	bashAllow, err := parseList(os.Getenv("BASH_ALLOW"))
+	if err != nil {
+		log.Fatalf("BASH_ALLOW: %v", err)
+	}
+
+	var redactPatterns []*regexp.Regexp
+	if strings.ToLower(strings.TrimSpace(os.Getenv("REDACT_SECRETS"))) != "false" {
+		redactPatterns, err = parseRedactPatterns(os.Getenv("REDACT_PATTERNS"))
+		if err != nil {
+			log.Fatalf("REDACT_PATTERNS: %v", err)
+		}
+	}
+
+	cfg := Config{
+		APIKey:             apiKey,
+		BaseURL:            baseURL,
+		Model:              model,
+		WorkDir:            workDir,
+		MaxResult:          maxTokens,
+		MaxIterations:      maxIterations,
+		MaxToolResultChars: maxToolResultChars,
+		MaxTodoItems:       maxTodoItems,
+		TodoNagRounds:      todoNagRounds,
+		SearchWorkers:      searchWorkers,
+		Temperature:        temperature,
+		TopP:               topP,
+		Seed:               seed,
+		ResponseFormat:     responseFormat,
+		Stop:               stop,
+		Reasoning:          reasoning,
+		ReasoningPrefixes:  reasoningPrefixes,
+		ReasoningEffort:    reasoningEffort,
+		Verbosity:          verbosity,
+		Debug:              debug,
+		Stream:             strings.ToLower(strings.TrimSpace(getenv("OPENAI_STREAM"))) != "false",
+		StreamHybrid:       strings.ToLower(strings.TrimSpace(getenv("OPENAI_STREAM"))) == "hybrid",
+		ApproveBash:        strings.ToLower(strings.TrimSpace(os.Getenv("APPROVE_BASH"))) == "true",
+		PlanCapture:        planCapture,
+		ContentFilter:      contentFilter,
+		StreamFormat:       streamFormat,
+		StreamMaxLine:      streamMaxLine,
+		WrapWidth:          wrapWidth,
+		AgentName:          agentName,
+		Persona:            persona,
+		ObservationsSource: observationsSource,
+		AuditLog:           auditLog,
+		ContextTokens:      contextTokens,
+		SessionSave:        strings.ToLower(strings.TrimSpace(os.Getenv("SESSION_SAVE"))) != "false",
+		SessionAutosave:    strings.ToLower(strings.TrimSpace(os.Getenv("SESSION_AUTOSAVE"))) == "true",
+		SessionsDir:        sessionsDir,
+		DedupeReads:        strings.ToLower(strings.TrimSpace(os.Getenv("DEDUPE_READS"))) != "false",
+		AutoCompact:        strings.ToLower(strings.TrimSpace(os.Getenv("OPENAI_AUTO_COMPACT"))) == "true",
+		CompactTokens:      compactTokens,
+		CompactKeepTurns:   compactKeepTurns,
+		ExtraHeaders:       extraHeaders,
+		SessionTimeout:     sessionTimeout,
+		RedactPatterns:     redactPatterns,
+		BashDeny:           bashDeny,
+		BashAllow:          bashAllow,
+		KnownContentChars:  knownContentChars,
+		WriteBackup:        strings.ToLower(strings.TrimSpace(os.Getenv("WRITE_BACKUP"))) == "true",
+		PageResults:        strings.ToLower(strings.TrimSpace(os.Getenv("PAGE_RESULTS"))) == "true",
+		MemoryInject:       strings.ToLower(strings.TrimSpace(os.Getenv("MEMORY_INJECT"))) != "false",
+		DryRun:             strings.ToLower(strings.TrimSpace(getenv("MCC_READONLY"))) == "true",
+		EnabledTools:       enabledTools,
+		ToolChoice:         toolChoice,
+		ParallelTools:      strings.ToLower(strings.TrimSpace(os.Getenv("OPENAI_PARALLEL_TOOLS"))) != "false",
+		ProjectContext:     projectContext,
+		ProjectContextFile: projectContextFile,
+		OutputFormat:       outputFormat,
+		MaxRetries:         maxRetries,
+		RetryBudget:        retryBudget,
+	}
+
+	return cfg
+}
+
+var agentNamePattern = regexp.MustCompile(`^[\p{L}\p{N}][\p{L}\p{N} ._-]*$`)
+
+// parseAgentName validates AGENT_NAME: a short name of letters, digits,
+// spaces and ._-.
+func parseAgentName(raw string) (string, error) {
+	name := strings.TrimSpace(raw)
+	if name == "" {
+		return "", nil
+	}
+	if len([]rune(name)) > maxAgentNameChars {
+		return "", fmt.Errorf("longer than %d characters", maxAgentNameChars)
+	}
+	if !agentNamePattern.MatchString(name) {
+		return "", errors.New("use only letters, digits, spaces and ._-")
+	}
+	return name, nil
+}
+
+var personaOverridePattern = regexp.MustCompile(`(?i)\b(ignore|disregard|override|forget|replace)\b.{0,40}\b(rules?|instructions?|prompt|tools?)\b|\bsystem prompt\b`)
+
+// parsePersona normalizes AGENT_PERSONA to a single line of plain text and
+// rejects text that tries to change the tool rules rather than tone and focus.
+func parsePersona(raw string) (string, error) {
+	persona := strings.Join(strings.FieldsFunc(raw, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}), " ")
+	if persona == "" {
+		return "", nil
+	}
+	if len([]rune(persona)) > maxPersonaChars {
+		return "", fmt.Errorf("longer than %d characters", maxPersonaChars)
+	}
+	if strings.ContainsAny(persona, "<>`") {
+		return "", errors.New("must be plain text without <, > or backticks")
+	}
+	if personaOverridePattern.MatchString(persona) {
+		return "", errors.New("describe tone and focus only; it can't change the agent's rules or tools")
+	}
+	lower := strings.ToLower(persona)
+	for _, def := range toolDefinitions(Config{}) {
+		name := def["function"].(map[string]interface{})["name"].(string)
+		// Plain words like bash or grep are fine in a persona
+		if (strings.Contains(name, "_") || name == "TodoWrite") && strings.Contains(lower, strings.ToLower(name)) {
+			return "", fmt.Errorf("mentions the %s tool; describe tone and focus only", name)
+		}
+	}
+	return persona, nil
+}
+
+// buildSystemPrompt fills in the system prompt for the workspace, naming the
+// agent and adding the persona after the rules, which take precedence.
+func buildSystemPrompt(cfg Config) string {
+	who := "a coding agent"
+	if cfg.AgentName != "" {
+		who = cfg.AgentName + ", " + who
+	}
+	prompt := fmt.Sprintf(systemPrompt, who, cfg.WorkDir)
+	if cfg.Persona != "" {
+		prompt += fmt.Sprintf(personaSection, cfg.Persona)
+	}
+	if cfg.DryRun {
+		prompt += dryRunSection
+	}
+	if cfg.ResponseFormat != nil {
+		// json_object mode also requires "JSON" to appear in the messages
+		prompt += responseFormatSection
+	}
+	if cfg.ProjectContext != "" {
+		prompt += fmt.Sprintf(projectContextSection, cfg.ProjectContextFile, cfg.ProjectContext)
+	}
+	return prompt
+}
+
+// projectContextFiles are checked in order; the first one found in the
+// workspace is added to the system prompt.
+var projectContextFiles = []string{"MCC.md", "AGENTS.md", "CLAUDE.md"}
+
+// loadProjectContext reads the workspace's project context file, cut to
+// maxProjectContextChars with a note saying so. It returns the file name
+// too, or two empty strings when there is none. A candidate that resolves
+// outside the workspace, isn't a regular file or can't be read is skipped
+// with a warning.
+func loadProjectContext(workDir string) (string, string) {
+	for _, name := range projectContextFiles {
+		path, err := safePath(workDir, name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipping %s: %v\n", name, err)
+			continue
+		}
+		info, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err == nil && !info.Mode().IsRegular() {
+			err = errors.New("not a regular file")
+		}
+		var data []byte
+		if err == nil {
+			data, err = os.ReadFile(path)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipping %s: %v\n", name, err)
+			continue
+		}
+		text := strings.TrimSpace(string(data))
+		if n := utf8.RuneCountInString(text); n > maxProjectContextChars {
+			text = string([]rune(text)[:maxProjectContextChars]) +
+				fmt.Sprintf("\n[%s truncated: only the first %d of %d characters are included; read the file for the rest]", name, maxProjectContextChars, n)
+		}
+		return text, name
+	}
+	return "", ""
+}
+
+// defaultRedactPatterns match common credential formats. They require the
+// distinctive prefix or structure of each format to keep false positives low.
+var defaultRedactPatterns = []string{
+	`\bsk-[A-Za-z0-9_-]*[A-Za-z0-9]{20}[A-Za-z0-9_-]*`,                   // OpenAI / Anthropic API keys
+	`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`,                                      // AWS access key IDs
+	`(?i)aws_secret_access_key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})`,  // AWS secret keys
+	`\bgh[pousr]_[A-Za-z0-9]{36,}\b`,                                     // GitHub tokens
+	`\bgithub_pat_[A-Za-z0-9_]{22,}`,                                     // GitHub fine-grained tokens
+	`\bxox[abposr]-[A-Za-z0-9-]{10,}`,                                    // Slack tokens
+	`\bAIza[0-9A-Za-z_-]{35}\b`,                                          // Google API keys
+	`\beyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`, // JWTs
+	// Authorization header values and bare bearer tokens
+	`(?i)\bauthorization["']?\s*[:=]\s*["']?(?:bearer|basic|token)\s+([A-Za-z0-9._~+/=-]{8,})`,
+	`(?i)\bbearer\s+([A-Za-z0-9._~+/-]{20,}=*)`,
+	// PEM private keys, masked to the end of the text when the block is cut off
+	`-----BEGIN [A-Z ]*PRIVATE KEY-----(?:[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----|[\s\S]*)`,
+}
+
+// parseRedactPatterns compiles the defaults plus REDACT_PATTERNS, given as a
+// JSON array of regexes, "@path" to a file with one regex per line ('#'
+// starts a comment), or a single regex.
+func parseRedactPatterns(raw string) ([]*regexp.Regexp, error) {
+	sources := append([]string{}, defaultRedactPatterns...)
+	raw = strings.TrimSpace(raw)
+	switch {
+	case raw == "":
+	case strings.HasPrefix(raw, "["):
+		var extra []string
+		if err := json.Unmarshal([]byte(raw), &extra); err != nil {
+			return nil, fmt.Errorf("invalid JSON array: %v", err)
+		}
+		sources = append(sources, extra...)
+	case strings.HasPrefix(raw, "@"):
+		data, err := os.ReadFile(strings.TrimPrefix(raw, "@"))
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				sources = append(sources, line)
+			}
+		}
+	default:
+		sources = append(sources, raw)
+	}
+
+	patterns := make([]*regexp.Regexp, 0, len(sources))
+	for _, src := range sources {
+		re, err := regexp.Compile(src)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", src, err)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+// parseSessionTimeout accepts a Go duration ("30m", "1h30m") or a bare
+// number of seconds; empty or zero disables the limit.
+func parseSessionTimeout(raw string) (time.Duration, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 0, nil
+	}
+	if secs, err := strconv.Atoi(raw); err == nil {
+		if secs < 0 {
+			return 0, fmt.Errorf("must not be negative, got %q", raw)
+		}
+		return time.Duration(secs) * time.Second, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", raw)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("must not be negative, got %q", raw)
+	}
+	return d, nil
+}
+
+// mccHomeDir is the per-user state directory (~/.mcc), falling back to a
+// workspace-local .mcc when the home directory is unknown.
+func mccHomeDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" {
+		return ".mcc"
+	}
+	return filepath.Join(home, ".mcc")
+}
+
+// flagSettings and fileSettings hold values from command-line flags and
+// config files, keyed by the environment variable each one stands in for.
+// getenv looks in flags first, then the environment, then the files.
+var (
+	flagSettings = map[string]string{}
+	fileSettings = map[string]string{}
+)
+
+// getenv is os.Getenv with flags layered on top and config files below
+func getenv(name string) string {
+	if val, ok := flagSettings[name]; ok {
+		return val
+	}
+	if val := os.Getenv(name); strings.TrimSpace(val) != "" {
+		return val
+	}
+	return fileSettings[name]
+}
+
+// resolveWorkDir returns the workspace: the --workdir flag, else
+// MCC_WORKDIR, else the current directory. A leading ~/ is expanded, and
+// the result must be an existing directory.
+func resolveWorkDir(flagDir string) (string, error) {
+	dir := strings.TrimSpace(flagDir)
+	if dir == "" {
+		dir = strings.TrimSpace(os.Getenv("MCC_WORKDIR"))
+	}
+	if dir == "" {
+		return os.Getwd()
+	}
+	if rest, ok := strings.CutPrefix(dir, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, rest)
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", abs)
+	}
+	return abs, nil
+}
+
+// configFileName is the per-user config inside mccHomeDir;
+// workspaceConfigFile is the per-project one in the working directory.
+const (
+	configFileName      = "config.json"
+	workspaceConfigFile = ".mcc.json"
+)
+
+// configFile is the layout of a config file. Every field is optional.
+type configFile struct {
+	APIType     *string     `json:"api_type"`
+	Model       *string     `json:"model"`
+	BaseURL     *string     `json:"base_url"`
+	MaxTokens   *int        `json:"max_tokens"`
+	Temperature *float64    `json:"temperature"`
+	Stream      interface{} `json:"stream"` // true, false or "hybrid"
+	BashDeny    []string    `json:"bash_deny"`
+}
+
+// loadConfigFiles fills fileSettings from the file given with --config, or
+// else from ~/.mcc/config.json followed by the workspace's .mcc.json, whose
+// values win. It returns the files that were read.
+func loadConfigFiles(explicit, workDir string) ([]string, error) {
+	if explicit != "" {
+		if err := applyConfigFile(explicit, true); err != nil {
+			return nil, err
+		}
+		return []string{explicit}, nil
+	}
+	var sources []string
+	for _, candidate := range []struct {
+		path    string
+		trusted bool
+	}{
+		{filepath.Join(mccHomeDir(), configFileName), true},
+		{filepath.Join(workDir, workspaceConfigFile), false},
+	} {
+		if _, err := os.Stat(candidate.path); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err := applyConfigFile(candidate.path, candidate.trusted); err != nil {
+			return nil, err
+		}
+		sources = append(sources, candidate.path)
+	}
+	return sources, nil
+}
+
+// applyConfigFile reads one config file into fileSettings. A workspace file
+// comes with the repository, so it may not redirect requests (and the API
+// key) to another endpoint.
+func applyConfigFile(path string, trusted bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file configFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if !trusted && (file.BaseURL != nil || file.APIType != nil) {
+		return fmt.Errorf("%s: base_url and api_type may only be set in %s or a --config file",
+			path, filepath.Join(mccHomeDir(), configFileName))
+	}
+	if file.APIType != nil {
+		fileSettings["OPENAI_API_TYPE"] = *file.APIType
+	}
+	if file.Model != nil {
+		fileSettings["OPENAI_MODEL"] = *file.Model
+	}
+	if file.BaseURL != nil {
+		fileSettings["OPENAI_BASE_URL"] = *file.BaseURL
+	}
+	if file.MaxTokens != nil {
+		if *file.MaxTokens <= 0 {
+			return fmt.Errorf("%s: max_tokens must be positive", path)
+		}
+		fileSettings["OPENAI_MAX_TOKENS"] = strconv.Itoa(*file.MaxTokens)
+	}
+	if file.Temperature != nil {
+		if *file.Temperature < 0 || *file.Temperature > 2 {
+			return fmt.Errorf("%s: temperature must be between 0 and 2", path)
+		}
+		fileSettings["OPENAI_TEMPERATURE"] = strconv.FormatFloat(*file.Temperature, 'f', -1, 64)
+	}
+	switch v := file.Stream.(type) {
+	case nil:
+	case bool:
+		fileSettings["OPENAI_STREAM"] = strconv.FormatBool(v)
+	case string:
+		if v != "hybrid" {
+			return fmt.Errorf("%s: stream must be true, false or \"hybrid\"", path)
+		}
+		fileSettings["OPENAI_STREAM"] = v
+	default:
+		return fmt.Errorf("%s: stream must be true, false or \"hybrid\"", path)
+	}
+	if file.BashDeny != nil {
+		rules, err := json.Marshal(file.BashDeny)
+		if err != nil {
+			return err
+		}
+		fileSettings["BASH_DENY"] = string(rules)
+	}
+	return nil
+}
+
+// optionalFloatEnv reads a float from the environment, returning nil when it
+// is unset, unparsable or outside [min, max].
+func optionalFloatEnv(name string, min, max float64, debug bool) *float64 {
+	raw := strings.TrimSpace(getenv(name))
+	if raw == "" {
+		return nil
+	}
+	val, err := strconv.ParseFloat(raw, 64)
+	if err != nil || val < min || val > max {
+		if debug {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Ignoring %s=%q: want a number in [%g, %g]\n", name, raw, min, max)
+		}
+		return nil
+	}
+	return &val
+}
+
+// parseList accepts a JSON array of strings or a comma-separated list, the
+// two forms every list-valued setting (OPENAI_STOP, BASH_ALLOW, BASH_DENY,
+// MCC_TOOLS, OPENAI_REASONING_MODELS) takes.
+func parseList(raw string) ([]string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(raw, "[") {
+		var items []string
+		if err := json.Unmarshal([]byte(raw), &items); err != nil {
+			return nil, fmt.Errorf("invalid JSON array: %v", err)
+		}
+		return items, nil
+	}
+	var items []string
+	for _, part := range strings.Split(raw, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			items = append(items, part)
+		}
+	}
+	return items, nil
+}
+
+// parseResponseFormat accepts "json_object" (or "json"), a JSON object, or
+// "@path" naming a file with one. An object whose type is a response_format
+// type (text, json_object, json_schema) is sent as is; any other object is
+// taken as a JSON schema.
+// Empty or "text" means the field is left out.
+func parseResponseFormat(raw string) (map[string]interface{}, error) {
+	raw = strings.TrimSpace(raw)
+	switch strings.ToLower(raw) {
+	case "", "text":
+		return nil, nil
+	case "json", "json_object":
+		return map[string]interface{}{"type": "json_object"}, nil
+	}
+	if strings.HasPrefix(raw, "@") {
+		data, err := os.ReadFile(strings.TrimPrefix(raw, "@"))
+		if err != nil {
+			return nil, err
+		}
+		raw = string(data)
+	}
+	var format map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &format); err != nil {
+		return nil, fmt.Errorf("want json_object, a JSON object or @path, got %q: %v", clampText(raw, 80), err)
+	}
+	switch format["type"] {
+	case "text", "json_object", "json_schema":
+		return format, nil
+	}
+	// Anything else is a bare schema, e.g. {"type": "object", "properties": ...}
+	return map[string]interface{}{
+		"type":        "json_schema",
+		"json_schema": map[string]interface{}{"name": "response", "schema": format},
+	}, nil
+}
+
+// parseExtraHeaders accepts "Key1:Val1,Key2:Val2", or "@path" naming a file
+// with one "Key: Value" header per line ('#' starts a comment).
+func parseExtraHeaders(raw string) (map[string]string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+	var entries []string
+	if strings.HasPrefix(raw, "@") {
+		data, err := os.ReadFile(strings.TrimPrefix(raw, "@"))
+		if err != nil {
+			return nil, err
+		}
+		entries = strings.Split(string(data), "\n")
+	} else {
+		entries = strings.Split(raw, ",")
+	}
+
+	headers := make(map[string]string)
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(entry, ":")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid header %q (want Key:Value)", entry)
+		}
+		headers[http.CanonicalHeaderKey(key)] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
+
+// selfTestFlag backs --selftest, which may be given bare or as --selftest=net.
+type selfTestFlag struct {
+	mode string // "" (off), "basic" or "net"
+}
+
+func (f *selfTestFlag) String() string   { return f.mode }
+func (f *selfTestFlag) IsBoolFlag() bool { return true }
+
+func (f *selfTestFlag) Set(value string) error {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "true", "basic":
+		f.mode = "basic"
+	case "net":
+		f.mode = "net"
+	case "false":
+		f.mode = ""
+	default:
+		return fmt.Errorf("want --selftest or --selftest=net, got %q", value)
+	}
+	return nil
+}
+
+// runSelfTest checks the local environment (and optionally the endpoint)
+// without spending an API call. It returns the process exit status.
+func runSelfTest(cfg Config, withNet bool) int {
+	type check struct {
+		name string
+		run  func() (string, error)
+	}
+	checks := []check{
+		{"workspace readable", func() (string, error) {
+			entries, err := os.ReadDir(cfg.WorkDir)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s (%d entries)", cfg.WorkDir, len(entries)), nil
+		}},
+		{"workspace writable", func() (string, error) {
+			f, err := os.CreateTemp(cfg.WorkDir, ".mcc-selftest-*")
+			if err != nil {
+				return "", err
+			}
+			name := f.Name()
+			_, werr := f.WriteString("ok")
+			cerr := f.Close()
+			os.Remove(name)
+			if werr != nil {
+				return "", werr
+			}
+			return "created and removed a temp file", cerr
+		}},
+		{"bash available", func() (string, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			out, err := exec.CommandContext(ctx, "bash", "-lc", "echo ok").Output()
+			if err != nil {
+				return "", err
+			}
+			if strings.TrimSpace(string(out)) != "ok" {
+				return "", fmt.Errorf("unexpected output %q", strings.TrimSpace(string(out)))
+			}
+			return "bash -lc 'echo ok' succeeded", nil
+		}},
+		{"API key present", func() (string, error) {
+			if cfg.APIKey == "" {
+				return "", errors.New("OPENAI_API_KEY is not set")
+			}
+			return "OPENAI_API_KEY is set", nil
+		}},
+	}
+	if withNet {
+		checks = append(checks, check{"endpoint reachable", func() (string, error) {
+			endpoint := chatEndpoint(cfg)
+			if cfg.APIType == "anthropic" {
+				endpoint = messagesEndpoint(cfg)
+			}
+			req, err := http.NewRequest("HEAD", endpoint, nil)
+			if err != nil {
+				return "", err
+			}
+			client := &http.Client{Timeout: 5 * time.Second}
+			resp, err := client.Do(req)
+			if err != nil {
+				return "", err
+			}
+			resp.Body.Close()
+			// Any HTTP status proves the host answers; HEAD is rarely allowed on the API itself
+			return fmt.Sprintf("%s answered %s", endpoint, resp.Status), nil
+		}})
+	}
+
+	failed := 0
+	for _, c := range checks {
+		detail, err := c.run()
+		if err != nil {
+			failed++
+			fmt.Printf("[FAIL] %s: %v\n", c.name, err)
+			continue
+		}
+		fmt.Printf("[PASS] %s: %s\n", c.name, detail)
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d checks failed\n", failed, len(checks))
+		return 1
+	}
+	fmt.Printf("all %d checks passed\n", len(checks))
+	return 0
+}
+
+func query(ctx context.Context, cfg Config, messages []Message) ([]Message, error) {
+	sysPrompt := buildSystemPrompt(cfg)
+
+	// 在消息前面添加 system message
+	fullMessages := make([]Message, 0, len(messages)+1)
+	fullMessages = append(fullMessages, Message{
+		Role:    "system",
+		Content: sysPrompt,
+	})
+	fullMessages = append(fullMessages, messages...)
+
+	filterRetried := false
+	for idx := 0; idx < cfg.MaxIterations; idx++ {
+		if cfg.AutoCompact && estimateTokens(fullMessages) > cfg.CompactTokens {
+			compacted, err := compactHistory(ctx, cfg, messages)
+			if err != nil {
+				fmt.Printf("[context] compaction failed: %v\n", err)
+			} else if len(compacted) < len(messages) {
+				fmt.Printf("[context] summarized %d earlier messages\n", len(messages)-len(compacted)+1)
+				messages = compacted
+				fullMessages = append(fullMessages[:1], messages...)
+			}
+		}
+
+		if stale := lastWrites.Changed(); len(stale) > 0 {
+			for i, path := range stale {
+				if rel, err := filepath.Rel(cfg.WorkDir, path); err == nil {
+					stale[i] = rel
+				}
+			}
+			notice := Message{Role: "user", Content: fmt.Sprintf(staleWritesReminder, strings.Join(stale, ", "))}
+			messages = append(messages, notice)
+			fullMessages = append(fullMessages, notice)
+		}
+		if text := observations.Drain(); text != "" {
+			source := cfg.ObservationsSource
+			if rel, err := filepath.Rel(cfg.WorkDir, source); err == nil && !strings.HasPrefix(rel, "..") {
+				source = rel
+			}
+			fmt.Printf("[observation] %d bytes from %s\n", len(text), source)
+			notice := Message{Role: "user", Content: fmt.Sprintf(observationNotice, source, text)}
+			messages = append(messages, notice)
+			fullMessages = append(fullMessages, notice)
+		}
+
+		spin := newSpinner("Waiting for model")
+		spin.Start()
+		resp, err := callOpenAI(ctx, cfg, trimContext(cfg, collapseDuplicateReads(cfg, fullMessages)), spin)
+		spin.Stop()
+		if cfg.ToolChoice != "none" {
+			// Forcing a tool on every request would never let the turn end
+			cfg.ToolChoice = "auto"
+		}
+		if err != nil {
+			return messages, err
+		}
+
+		if len(resp.Choices) == 0 {
+			return messages, errors.New("no choices in response")
+		}
+
+		choice := resp.Choices[0]
+		assistantMsg := choice.Message
+
+		if choice.FinishReason == "content_filter" {
+			// Calls cut off by the filter may be incomplete; never run them
+			assistantMsg.ToolCalls = nil
+			action := cfg.ContentFilter
+			if action == "retry" && filterRetried {
+				action = "warn"
+			}
+			events.Emit("content_filter", map[string]interface{}{"action": action, "partial": contentText(assistantMsg.Content)})
+			switch action {
+			case "error":
+				return messages, errors.New("the provider's content filter blocked the reply")
+			case "retry":
+				filterRetried = true
+				fmt.Fprintln(os.Stderr, "[content filter] the provider filtered the reply; asking the model to rephrase")
+				fullMessages = append(fullMessages, Message{Role: "user", Content: contentFilterReminder})
+				continue
+			default:
+				fmt.Fprintln(os.Stderr, "[content filter] the provider filtered the reply; it may be partial or empty")
+			}
+		}
+
+		// 打印文本内容 (streamed replies were already printed as they arrived),
+		// including any explanation that comes with tool calls
+		if text := contentText(assistantMsg.Content); text != "" {
+			if !streamsReplies(cfg) {
+				fmt.Println(wrapForDisplay(cfg, text))
+			}
+			events.Emit("message", map[string]interface{}{"role": "assistant", "content": assistantMsg.Content})
+		}
+
+		// 追加 assistant 消息到历史
+		messages = append(messages, assistantMsg)
+		fullMessages = append(fullMessages, assistantMsg)
+
+		// 检查是否有 tool calls: some models return them with finish_reason
+		// "stop" (or another reason), so the calls themselves decide
+		if len(assistantMsg.ToolCalls) > 0 {
+			// 执行所有工具
+			for _, tc := range assistantMsg.ToolCalls {
+				result := Message{Role: "tool", ToolCallID: tc.ID, Name: tc.Function.Name, Content: "(interrupted)"}
+				// Every call still needs a result to keep the history valid
+				if ctx.Err() == nil {
+					result = dispatchToolCall(ctx, cfg, tc)
+				}
+				messages = append(messages, result)
+				fullMessages = append(fullMessages, result)
+			}
+			if err := ctx.Err(); err != nil {
+				return messages, err
+			}
+			if turnRetries.Exhausted() {
+				return messages, fmt.Errorf("turn retry budget of %d exhausted", cfg.RetryBudget)
+			}
+			continue
+		}
+
+		// Track rounds without todo usage
+		agentState.mu.Lock()
+		agentState.roundsWithoutTodo++
+		if cfg.TodoNagRounds > 0 && agentState.roundsWithoutTodo > cfg.TodoNagRounds {
+			pendingContext.Ensure(fmt.Sprintf(nagReminder, cfg.TodoNagRounds))
+		}
+		agentState.mu.Unlock()
+
+		if text := contentText(assistantMsg.Content); text != "" {
+			capturePlan(cfg, text)
+		}
+
+		return messages, nil
+	}
+
+	return messages, fmt.Errorf("agent max iterations (%d) reached; raise AGENT_MAX_ITERATIONS for longer tasks", cfg.MaxIterations)
+}
+
+// compactHistory asks the model to summarize everything before the last
+// cfg.CompactKeepTurns user turns and replaces those messages with a single
+// clearly marked summary message. Cutting at a user turn keeps tool
+// call/result pairs together.
+func compactHistory(ctx context.Context, cfg Config, messages []Message) ([]Message, error) {
+	var turnStarts []int
+	for i, msg := range messages {
+		if msg.Role == "user" {
+			turnStarts = append(turnStarts, i)
+		}
+	}
+	if len(turnStarts) <= cfg.CompactKeepTurns {
+		return messages, nil
+	}
+	cut := turnStarts[len(turnStarts)-cfg.CompactKeepTurns]
+	if cut == 0 {
+		return messages, nil
+	}
+
+	var transcript strings.Builder
+	for _, msg := range messages[:cut] {
+		text := contentText(msg.Content)
+		switch msg.Role {
+		case "tool":
+			fmt.Fprintf(&transcript, "[tool result %s]\n%s\n\n", msg.Name, clampText(text, 2000))
+		default:
+			if text != "" {
+				fmt.Fprintf(&transcript, "[%s]\n%s\n\n", msg.Role, text)
+			}
+			for _, tc := range msg.ToolCalls {
+				fmt.Fprintf(&transcript, "[%s called %s] %s\n\n", msg.Role, tc.Function.Name, clampText(tc.Function.Arguments, 2000))
+			}
+		}
+	}
+
+	summaryCfg := cfg
+	summaryCfg.Stream = false
+	summaryCfg.ResponseFormat = nil
+	spin := newSpinner("Compacting history")
+	spin.Start()
+	resp, err := chatCompletion(ctx, summaryCfg, []Message{
+		{Role: "system", Content: compactionPrompt},
+		{Role: "user", Content: transcript.String()},
+	}, nil, spin)
+	spin.Stop()
+	if err != nil {
+		return messages, err
+	}
+	if len(resp.Choices) == 0 {
+		return messages, errors.New("no choices in compaction response")
+	}
+	summary := strings.TrimSpace(contentText(resp.Choices[0].Message.Content))
+	if summary == "" {
+		return messages, errors.New("empty compaction summary")
+	}
+
+	todos := "(none)"
+	if items := todoBoard.Items(); len(items) > 0 {
+		lines := make([]string, 0, len(items))
+		for _, item := range items {
+			lines = append(lines, fmt.Sprintf("- [%s] %s", item.Status, item.Content))
+		}
+		todos = strings.Join(lines, "\n")
+	}
+
+	compacted := make([]Message, 0, len(messages)-cut+1)
+	compacted = append(compacted, Message{Role: "user", Content: fmt.Sprintf(compactSummaryTemplate, summary, todos)})
+	compacted = append(compacted, messages[cut:]...)
+	return compacted, nil
+}
+
+// collapseDuplicateReads replaces older read_file results with a short
+// placeholder when a later full read of the same path exists, so repeated
+// re-checks of a file don't keep several copies in context. Only content is
+// replaced, so every tool result still answers its tool call.
+func collapseDuplicateReads(cfg Config, messages []Message) []Message {
+	if !cfg.DedupeReads {
+		return messages
+	}
+
+	type readCall struct {
+		path string
+		full bool
+	}
+	reads := make(map[string]readCall)
+	for _, msg := range messages {
+		for _, tc := range msg.ToolCalls {
+			if tc.Function.Name != "read_file" {
+				continue
+			}
+			var args map[string]interface{}
+			if err := json.Unmarshal([]byte(tc.Function.Arguments), &args); err != nil {
+				continue
+			}
+			path := filepath.Clean(strings.TrimSpace(getString(args, "path")))
+			_, hasStart := args["start_line"]
+			_, hasEnd := args["end_line"]
+			_, hasMax := args["max_chars"]
+			reads[tc.ID] = readCall{path: path, full: !hasStart && !hasEnd && !hasMax}
+		}
+	}
+	if len(reads) < 2 {
+		return messages
+	}
+
+	lastFull := make(map[string]int)
+	for i, msg := range messages {
+		if call, ok := reads[msg.ToolCallID]; ok && msg.Role == "tool" && call.full {
+			lastFull[call.path] = i
+		}
+	}
+
+	var out []Message
+	for i, msg := range messages {
+		call, ok := reads[msg.ToolCallID]
+		if !ok || msg.Role != "tool" {
+			continue
+		}
+		if last, ok := lastFull[call.path]; ok && i < last {
+			if out == nil {
+				out = append([]Message(nil), messages...)
+			}
+			out[i].Content = fmt.Sprintf("[superseded: %s was read again later in this conversation; see the most recent read_file result]", call.path)
+		}
+	}
+	if out == nil {
+		return messages
+	}
+	return out
+}
+
+// estimateTokens approximates the prompt size of messages using the rough
+// four-characters-per-token heuristic plus a small per-message overhead.
+func estimateTokens(messages []Message) int {
+	chars := 0
+	for _, msg := range messages {
+		chars += len(contentText(msg.Content))
+		for _, tc := range msg.ToolCalls {
+			chars += len(tc.Function.Name) + len(tc.Function.Arguments)
+		}
+	}
+	return chars/4 + len(messages)*4
+}
+
+// trimContext drops the oldest non-system messages until the estimate fits
+// cfg.ContextTokens. An assistant message and the tool results answering its
+// calls are dropped together, and the newest exchange is always kept.
+func trimContext(cfg Config, messages []Message) []Message {
+	if cfg.ContextTokens <= 0 || estimateTokens(messages) <= cfg.ContextTokens {
+		return messages
+	}
+
+	head := 0
+	for head < len(messages) && messages[head].Role == "system" {
+		head++
+	}
+
+	// Group the rest into units: each non-tool message plus the tool
+	// results that follow it.
+	var starts []int
+	for i := head; i < len(messages); i++ {
+		if messages[i].Role != "tool" || len(starts) == 0 {
+			starts = append(starts, i)
+		}
+	}
+	if len(starts) <= 1 {
+		return messages
+	}
+
+	total := estimateTokens(messages)
+	cut := 0
+	for cut < len(starts)-1 && total > cfg.ContextTokens {
+		end := starts[cut+1]
+		total -= estimateTokens(messages[starts[cut]:end])
+		cut++
+	}
+
+	trimmed := make([]Message, 0, head+1+len(messages)-starts[cut])
+	trimmed = append(trimmed, messages[:head]...)
+	trimmed = append(trimmed, Message{Role: "user", Content: contextTrimmedReminder})
+	trimmed = append(trimmed, messages[starts[cut]:]...)
+
+	if cfg.Debug {
+		fmt.Fprintf(os.Stderr, "[DEBUG] Context trimmed: dropped %d messages (~%d tokens now, budget %d)\n",
+			starts[cut]-head, estimateTokens(trimmed), cfg.ContextTokens)
+	}
+	return trimmed
+}
+
+func callOpenAI(ctx context.Context, cfg Config, messages []Message, spin *spinner) (*APIResponse, error) {
+	return chatCompletion(ctx, cfg, messages, toolDefinitions(cfg), spin)
+}
+
+// streamsReplies reports whether replies arrive as a stream and are printed
+// while they do. The Anthropic adapter never streams.
+func streamsReplies(cfg Config) bool {
+	return cfg.Stream && cfg.APIType != "anthropic"
+}
+
+// chatCompletion sends one request offering the given tools; a nil tools
+// slice sends a plain text-only completion. spin, if not nil, is the
+// spinner shown while waiting; streaming pauses it for text and relabels it
+// with tool-call progress.
+func chatCompletion(ctx context.Context, cfg Config, messages []Message, tools []map[string]interface{}, spin *spinner) (*APIResponse, error) {
+	if cfg.APIType == "anthropic" {
+		return callAnthropic(ctx, cfg, messages, tools)
+	}
+
+	body := map[string]interface{}{
+		"model":      cfg.Model,
+		"messages":   messages,
+		"max_tokens": cfg.MaxResult,
+		"stream":     cfg.Stream,
+	}
+	if len(tools) > 0 {
+		body["tools"] = tools
+		if choice := toolChoiceParam(cfg.ToolChoice); choice != nil {
+			body["tool_choice"] = choice
+		}
+		if !cfg.ParallelTools {
+			body["parallel_tool_calls"] = false
+		}
+	}
+	if isReasoningModel(cfg) {
+		// Reasoning models reject max_tokens and any non-default sampling
+		delete(body, "max_tokens")
+		body["max_completion_tokens"] = cfg.MaxResult
+	} else {
+		applySamplingParams(cfg, body)
+	}
+	if cfg.Seed != nil {
+		body["seed"] = *cfg.Seed
+	}
+	if cfg.ResponseFormat != nil {
+		body["response_format"] = cfg.ResponseFormat
+	}
+	if cfg.ReasoningEffort != "" {
+		body["reasoning_effort"] = cfg.ReasoningEffort
+	}
+	if cfg.Verbosity != "" {
+		body["verbosity"] = cfg.Verbosity
+	}
+	if len(cfg.Stop) > 0 {
+		body["stop"] = cfg.Stop
+	}
+
+	resp, err := postJSON(ctx, cfg, chatEndpoint(cfg), body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Handle streaming response
+	if cfg.Stream {
+		return handleStreamingResponse(cfg, resp, spin)
+	}
+
+	// Handle non-streaming response
+	return handleNonStreamingResponse(cfg, resp)
+}
+
+// defaultReasoningPrefixes are the model name prefixes OPENAI_REASONING=auto
+// treats as reasoning models.
+var defaultReasoningPrefixes = []string{"o1", "o3", "o4"}
+
+// isReasoningModel reports whether requests for cfg.Model need the
+// reasoning-model request shape. It is checked per request, so /model
+// switches take effect.
+func isReasoningModel(cfg Config) bool {
+	switch cfg.Reasoning {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	model := strings.ToLower(cfg.Model)
+	for _, prefix := range cfg.ReasoningPrefixes {
+		if strings.HasPrefix(model, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// applySamplingParams adds the optional sampling fields to a request body.
+func applySamplingParams(cfg Config, body map[string]interface{}) {
+	if cfg.Temperature != nil {
+		body["temperature"] = *cfg.Temperature
+	}
+	if cfg.TopP != nil {
+		body["top_p"] = *cfg.TopP
+	}
+}
+
+// postJSON sends body to endpoint with the provider's auth headers applied.
+// The caller must close the response body; cancelling ctx aborts the request.
+func postJSON(ctx context.Context, cfg Config, endpoint string, body interface{}) (*http.Response, error) {
+	// Log request URL (only if DEBUG=true)
+	if cfg.Debug {
+		fmt.Fprintf(os.Stderr, "\n[DEBUG] Request URL: %s\n", endpoint)
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Log request payload (only if DEBUG=true)
+	if cfg.Debug {
+		var prettyPayload bytes.Buffer
+		if err := json.Indent(&prettyPayload, payload, "", "  "); err == nil {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Request Payload:\n%s\n", prettyPayload.String())
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.APIType {
+	case "azure":
+		// Azure uses an api-key header instead of a Bearer token
+		req.Header.Set("api-key", cfg.APIKey)
+	case "anthropic":
+		req.Header.Set("x-api-key", cfg.APIKey)
+		req.Header.Set("anthropic-version", cfg.AnthropicVersion)
+	default:
+		// OpenAI uses Bearer token
+		req.Header.Set("Authorization", "Bearer "+cfg.APIKey)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range cfg.ExtraHeaders {
+		req.Header.Set(key, value)
+	}
+
+	// Log request headers (only if DEBUG=true)
+	if cfg.Debug {
+		fmt.Fprintf(os.Stderr, "[DEBUG] Request Headers:\n")
+		for key, values := range req.Header {
+			for _, value := range values {
+				fmt.Fprintf(os.Stderr, "  %s: %s\n", key, redactHeader(key, value))
+			}
+		}
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+
+	client := cfg.HTTPClient
+	if client == nil {
+		client = defaultHTTPClient
+	}
+	for attempt := 1; ; attempt++ {
+		resp, err := client.Do(req)
+		reason := retryReason(ctx, resp, err)
+		if reason == "" || attempt > cfg.MaxRetries {
+			return resp, err
+		}
+		ok, left := turnRetries.Take()
+		if !ok {
+			fmt.Fprintf(os.Stderr, "[retry] %s; turn retry budget exhausted\n", reason)
+			return resp, err
+		}
+		wait := retryDelay(resp, attempt)
+		if cfg.Debug {
+			fmt.Fprintf(os.Stderr, "[DEBUG] %s; retry %d/%d in %s (turn retry budget left: %d)\n",
+				reason, attempt, cfg.MaxRetries, wait, left)
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		req = req.Clone(ctx)
+		req.Body = io.NopCloser(bytes.NewReader(payload))
+	}
+}
+
+// retryReason describes why a request should be retried, or returns "" when
+// it succeeded or failed in a way retrying won't fix.
+func retryReason(ctx context.Context, resp *http.Response, err error) string {
+	if err != nil {
+		if ctx.Err() != nil {
+			return ""
+		}
+		return fmt.Sprintf("request failed: %v", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout, 529:
+		return fmt.Sprintf("api status %d", resp.StatusCode)
+	}
+	return ""
+}
+
+// retryDelay honors a Retry-After header in seconds, else backs off
+// exponentially from 500ms, capped at 30s.
+func retryDelay(resp *http.Response, attempt int) time.Duration {
+	if resp != nil {
+		if secs, err := strconv.Atoi(strings.TrimSpace(resp.Header.Get("Retry-After"))); err == nil && secs >= 0 {
+			return min(time.Duration(secs)*time.Second, 30*time.Second)
+		}
+	}
+	return min(500*time.Millisecond<<(attempt-1), 30*time.Second)
+}
+
+// chatEndpoint builds the chat completions URL for the configured provider.
+func chatEndpoint(cfg Config) string {
+	baseURL := cfg.BaseURL
+
+	if cfg.APIType == "azure" {
+		// {base}/openai/deployments/{deployment}/chat/completions?api-version=...
+		return fmt.Sprintf("%s/openai/deployments/%s/chat/completions?api-version=%s",
+			strings.TrimRight(baseURL, "/"), url.PathEscape(cfg.Deployment), url.QueryEscape(cfg.APIVersion))
+	}
+
+	// Handle different URL formats
+	if strings.HasSuffix(baseURL, "#") {
+		// # suffix: use the URL as-is (remove #)
+		return strings.TrimSuffix(baseURL, "#")
+	} else if strings.HasSuffix(baseURL, "/v1") {
+		// Base URL already ends with /v1: append /chat/completions
+		return baseURL + "/chat/completions"
+	} else if strings.HasSuffix(baseURL, "/") {
+		// / suffix: append chat/completions directly (ignore v1)
+		return baseURL + "chat/completions"
+	}
+	// Default: append /v1/chat/completions
+	return baseURL + "/v1/chat/completions"
+}
+
+func dispatchToolCall(ctx context.Context, cfg Config, tc ToolCall) Message {
+	// 解析 arguments
+	var input map[string]interface{}
+	if err := json.Unmarshal([]byte(tc.Function.Arguments), &input); err != nil {
+		// The model will try again, which counts against the turn's retries
+		if _, left := turnRetries.Take(); cfg.Debug {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Malformed %s arguments; turn retry budget left: %d\n", tc.Function.Name, left)
+		}
+		redacted, _ := redactSecrets(cfg, tc.Function.Arguments)
+		audit.Record(map[string]interface{}{
+			"time":      time.Now().UTC().Format(time.RFC3339Nano),
+			"id":        tc.ID,
+			"tool":      tc.Function.Name,
+			"arguments": clampText(redacted, maxAuditFieldChars),
+			"result":    fmt.Sprintf("Error parsing arguments: %v", err),
+			"error":     true,
+		})
+		return Message{
+			Role:       "tool",
+			ToolCallID: tc.ID,
+			Name:       tc.Function.Name,
+			Content:    fmt.Sprintf("Error parsing arguments: %v", err),
+		}
+	}
+
+	if !toolEnabled(cfg, tc.Function.Name) {
+		// The model never saw this tool, but it may still try to call it
+		content := fmt.Sprintf("Error: the %s tool is disabled in this session; use the tools you were given", tc.Function.Name)
+		audit.Record(map[string]interface{}{
+			"time":   time.Now().UTC().Format(time.RFC3339Nano),
+			"id":     tc.ID,
+			"tool":   tc.Function.Name,
+			"input":  auditInput(cfg, input),
+			"result": content,
+			"error":  true,
+		})
+		return Message{Role: "tool", ToolCallID: tc.ID, Name: tc.Function.Name, Content: content}
+	}
+
+	macroRecorder.Capture(tc)
+
+	// Display tool call with appropriate formatting
+	var displayText string
+	switch tc.Function.Name {
+	case "TodoWrite":
+		displayText = "updating todos"
+	default:
+		displayText = fmt.Sprintf("%v", input)
+	}
+	prettyToolLine(tc.Function.Name, displayText)
+	events.Emit("tool_call", map[string]interface{}{"id": tc.ID, "name": tc.Function.Name, "arguments": input})
+
+	var result string
+	var err error
+	started := time.Now()
+
+	switch tc.Function.Name {
+	case "bash":
+		result, err = runBash(ctx, cfg, input)
+	case "read_file":
+		result, err = runRead(ctx, cfg, input)
+	case "read_files":
+		result, err = runReadFiles(ctx, cfg, input)
+	case "write_file":
+		result, err = runWrite(ctx, cfg, input)
+	case "edit_text":
+		result, err = runEdit(ctx, cfg, input)
+	case "move_file":
+		result, err = runMove(ctx, cfg, input)
+	case "preview_edit":
+		result, err = runPreviewEdit(ctx, cfg, input)
+	case "git_files":
+		result, err = runGitFiles(ctx, cfg, input)
+	case "grep":
+		result, err = runGrep(ctx, cfg, input)
+	case "glob":
+		result, err = runGlob(ctx, cfg, input)
+	case "log_search":
+		result, err = runLogSearch(ctx, cfg, input)
+	case "list_dir":
+		result, err = runListDir(ctx, cfg, input)
+	case "query_data":
+		result, err = runQueryData(ctx, cfg, input)
+	case "apply_patch":
+		result, err = runApplyPatch(ctx, cfg, input)
+	case "parse_trace":
+		result, err = runParseTrace(ctx, cfg, input)
+	case "scaffold":
+		result, err = runScaffold(ctx, cfg, input)
+	case "build":
+		result, err = runBuild(ctx, cfg, input)
+	case "lint":
+		result, err = runLint(ctx, cfg, input)
+	case "undo":
+		result, err = runUndo(ctx, cfg, input)
+	case "diff_since_write":
+		result, err = runDiffSinceWrite(ctx, cfg, input)
+	case "compute":
+		result, err = runCompute(ctx, cfg, input)
+	case "memory_set":
+		result, err = runMemorySet(ctx, cfg, input)
+	case "memory_get":
+		result, err = runMemoryGet(ctx, cfg, input)
+	case "memory_list":
+		result, err = runMemoryList(ctx, cfg, input)
+	case "list_tools":
+		result, err = runListTools(ctx, cfg, input)
+	case "TodoWrite":
+		result, err = runTodoUpdate(ctx, cfg, input)
+	default:
+		err = fmt.Errorf("unknown tool: %s", tc.Function.Name)
+	}
+
+	switch tc.Function.Name {
+	case "write_file", "edit_text", "move_file", "apply_patch", "undo", "scaffold":
+		builds.Invalidate()
+	}
+
+	if err != nil {
+		result = err.Error()
+	}
+	if redacted, n := redactSecrets(cfg, result); n > 0 {
+		result = fmt.Sprintf("%s\n[redacted %d secret(s)]", redacted, n)
+	}
+	audit.Record(map[string]interface{}{
+		"time":        started.UTC().Format(time.RFC3339Nano),
+		"id":          tc.ID,
+		"tool":        tc.Function.Name,
+		"input":       auditInput(cfg, input),
+		"result":      clampText(result, maxAuditFieldChars),
+		"error":       err != nil,
+		"duration_ms": time.Since(started).Milliseconds(),
+	})
+
+	showToolResult(cfg, result)
+
+	content := clampToolResult(tc.Function.Name, input, result, cfg.MaxToolResultChars)
+	events.Emit("tool_result", map[string]interface{}{"id": tc.ID, "name": tc.Function.Name, "content": content, "error": err != nil})
+	return Message{
+		Role:       "tool",
+		ToolCallID: tc.ID,
+		Name:       tc.Function.Name,
+		Content:    content,
+	}
+}
+
+// readOnlyPrograms may run under --dry-run. git and go are limited to the
+// subcommands listed, and options that write files or run other programs
+// are refused.
+var (
+	readOnlyPrograms = map[string]bool{
+		"ls": true, "cat": true, "head": true, "tail": true, "wc": true, "grep": true, "egrep": true,
+		"fgrep": true, "rg": true, "find": true, "pwd": true, "echo": true, "printf": true, "which": true,
+		"file": true, "stat": true, "du": true, "df": true, "tree": true, "diff": true, "cmp": true,
+		"sort": true, "uniq": true, "cut": true, "tr": true, "basename": true, "dirname": true,
+		"realpath": true, "uname": true, "whoami": true, "jq": true, "true": true,
+	}
+	readOnlySubcommands = map[string]map[string]bool{
+		"git": {"status": true, "log": true, "diff": true, "show": true, "blame": true, "ls-files": true, "rev-parse": true, "grep": true},
+		"go":  {"vet": true, "list": true, "env": true, "version": true, "doc": true},
+	}
+	readOnlyRefused = map[string][]string{
+		"find": {"-delete", "-exec", "-ok", "-fprint", "-fls"},
+		"sort": {"-o", "--output", "--compress-program"},
+		"tree": {"-o"},
+		"rg":   {"--pre"},
+		"file": {"-C", "--compile"},
+		"git":  {"--output", "-O", "--open-files-in-pager", "--ext-diff", "--textconv"},
+		"go":   {"-w", "-u", "-vettool", "-toolexec", "-exec"},
+	}
+	readOnlyExamples = []string{"ls", "cat", "grep", "find", "git status/log/diff/show", "go vet/list"}
+	// Redirections that only discard or merge output are harmless
+	harmlessRedirect = regexp.MustCompile(`\d?>\s*/dev/null|\d?>&\d`)
+	commandSeparator = regexp.MustCompile(`&&|\|\||[;|\n]`)
+)
+
+// readOnlyCommand reports whether every command in a pipeline or list is
+// known not to modify anything. Anything it can't vouch for is refused.
+func readOnlyCommand(command string) bool {
+	command = harmlessRedirect.ReplaceAllString(command, "")
+	if strings.ContainsAny(strings.ReplaceAll(command, "&&", ""), "><`&") || strings.Contains(command, "$(") {
+		return false
+	}
+	for _, segment := range commandSeparator.Split(command, -1) {
+		fields := strings.Fields(segment)
+		if len(fields) == 0 {
+			continue
+		}
+		program := fields[0]
+		if subs, ok := readOnlySubcommands[program]; ok {
+			if len(fields) < 2 || !subs[fields[1]] {
+				return false
+			}
+		} else if !readOnlyPrograms[program] {
+			return false
+		}
+		if refusesArgs(program, fields[1:]) {
+			return false
+		}
+	}
+	return true
+}
+
+// refusesArgs reports whether args give program an option that writes a
+// file or runs another program, or, for uniq, an output file.
+func refusesArgs(program string, args []string) bool {
+	positional := 0
+	for i := 0; i < len(args); i++ {
+		field := args[i]
+		if program == "go" && strings.HasPrefix(field, "--") {
+			// The go command takes --flag the same as -flag
+			field = field[1:]
+		}
+		for _, refused := range readOnlyRefused[program] {
+			// A prefix match also catches -ofile, --output=x and -execdir
+			if strings.HasPrefix(field, refused) {
+				return true
+			}
+		}
+		switch {
+		case program == "sort" && strings.HasPrefix(field, "-") && !strings.HasPrefix(field, "--"):
+			// Short options bundle, as in -uo out.txt; k, t, S and T take
+			// the rest of the field as their value
+			for _, c := range field[1:] {
+				if c == 'o' {
+					return true
+				}
+				if strings.ContainsRune("ktST", c) {
+					break
+				}
+			}
+		case program == "uniq":
+			switch {
+			case field == "-f" || field == "-s" || field == "-w":
+				i++ // the count that follows
+			case field == "-" || !strings.HasPrefix(field, "-"):
+				positional++
+			}
+		}
+	}
+	// uniq IN OUT writes OUT
+	return positional > 1
+}
+
+// checkCommandPolicy applies the deny list, the allow list and approval to a
+// command about to run. A non-empty declined message means the user said no.
+func checkCommandPolicy(cfg Config, command string) (string, error) {
+	if rule, ok := isDangerousCommand(cfg, command); ok {
+		return "", fmt.Errorf("blocked dangerous command (matches %s)", rule)
+	}
+	if err := checkAllowedCommand(cfg, command); err != nil {
+		return "", err
+	}
+	if cfg.ApproveBash && !approveCommand(command) {
+		return "user declined to run this command; do not retry it unchanged, ask the user or take another approach", nil
+	}
+	return "", nil
+}
+
+func runBash(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	command := strings.TrimSpace(getString(input, "command"))
+	if command == "" {
+		return "", errors.New("missing bash.command")
+	}
+	if cfg.DryRun && !readOnlyCommand(command) {
+		return dryRunTag + " command not run: in dry-run mode bash only runs read-only commands (" +
+			strings.Join(readOnlyExamples, ", ") + ") without redirection or command substitution", nil
+	}
+	if declined, err := checkCommandPolicy(cfg, command); declined != "" || err != nil {
+		return declined, err
+	}
+	timeout := getIntOrDefault(input, "timeout_ms", 30000)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "bash", "-lc", command)
+	setProcessGroup(cmd)
+	// Don't wait forever on pipes held open by killed grandchildren
+	cmd.WaitDelay = time.Second
+	cmd.Dir = cfg.WorkDir
+	cmd.Env = sessionEnv.Environ()
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return "(timeout)", nil
+	}
+	output := strings.TrimSpace(strings.Join([]string{stdout.String(), stderr.String()}, "\n"))
+	if errors.Is(ctx.Err(), context.Canceled) {
+		if output == "" {
+			return "(interrupted)", nil
+		}
+		return clampToolResult("bash", input, output+"\n(interrupted)", cfg.MaxToolResultChars), nil
+	}
+	if output == "" {
+		output = "(no output)"
+	}
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			output = fmt.Sprintf("%s\n(exit error: %v)", output, err)
+			err = nil
+		}
+	}
+	return clampToolResult("bash", input, output, cfg.MaxToolResultChars), err
+}
+
+func runRead(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	path := getString(input, "path")
+	abs, err := safePath(cfg.WorkDir, path)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(abs)
+	if err != nil {
+		return "", notFoundError(cfg, path, err)
+	}
+	if isBinary(data) {
+		return "", fmt.Errorf("%s looks like a binary file (%d bytes); not shown", path, len(data))
+	}
+	text := string(data)
+	lines := strings.Split(text, "\n")
+
+	start := 0
+	if val, ok := getOptionalInt(input, "start_line"); ok {
+		if val < 1 {
+			val = 1
+		}
+		start = val - 1
+		if start > len(lines) {
+			start = len(lines)
+		}
+	}
+	end := len(lines)
+	if val, ok := getOptionalInt(input, "end_line"); ok {
+		if val >= 0 {
+			if val < start {
+				end = start
+			} else if val > len(lines) {
+				end = len(lines)
+			} else {
+				end = val
+			}
+		}
+	}
+	if start > end {
+		start = end
+	}
+	sliced := strings.Join(lines[start:end], "\n")
+	maxChars := getIntOrDefault(input, "max_chars", cfg.MaxToolResultChars)
+	return clampToolResult("read_file", input, sliced, maxChars), nil
+}
+
+// runReadFiles reads several files in one call. Each entry is a path string or
+// an object with the same fields as read_file; failures are reported inline.
+func runReadFiles(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	rawPaths, ok := input["paths"].([]interface{})
+	if !ok || len(rawPaths) == 0 {
+		return "", errors.New("read_files.paths must be a non-empty array")
+	}
+	if len(rawPaths) > maxReadFilesPaths {
+		return "", fmt.Errorf("read_files is limited to %d paths", maxReadFilesPaths)
+	}
+
+	// Split the combined budget evenly so one large file can't crowd out the rest
+	perFile := cfg.MaxToolResultChars / len(rawPaths)
+	if perFile < minReadFilesChars {
+		perFile = minReadFilesChars
+	}
+
+	var sections []string
+	failed := 0
+	for i, raw := range rawPaths {
+		var entry map[string]interface{}
+		switch v := raw.(type) {
+		case string:
+			entry = map[string]interface{}{"path": v}
+		case map[string]interface{}:
+			entry = v
+		default:
+			return "", fmt.Errorf("read_files.paths[%d] must be a string or object", i)
+		}
+		limit := getIntOrDefault(entry, "max_chars", perFile)
+		if limit > perFile {
+			limit = perFile
+		}
+		sliced := make(map[string]interface{}, len(entry)+1)
+		for k, v := range entry {
+			sliced[k] = v
+		}
+		sliced["max_chars"] = limit
+
+		path := getString(entry, "path")
+		text, err := runRead(ctx, cfg, sliced)
+		if err != nil {
+			failed++
+			text = fmt.Sprintf("(error: %v)", err)
+		}
+		sections = append(sections, fmt.Sprintf("=== %s ===\n%s", path, text))
+	}
+
+	result := strings.Join(sections, "\n\n")
+	if failed > 0 {
+		result += fmt.Sprintf("\n\n(%d of %d paths failed)", failed, len(rawPaths))
+	}
+	return clampToolResult("read_files", input, result, cfg.MaxToolResultChars), nil
+}
+
+func runWrite(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	if cfg.DryRun {
+		return dryRunPreview(ctx, cfg, "write_file", input)
+	}
+	path := getString(input, "path")
+	abs, err := safePath(cfg.WorkDir, path)
+	if err != nil {
+		return "", err
+	}
+	content := getString(input, "content")
+	mode := strings.ToLower(getString(input, "mode"))
+	if err := os.MkdirAll(filepath.Dir(abs), 0o755); err != nil {
+		return "", err
+	}
+	known, backup := "", ""
+	existing, readErr := os.ReadFile(abs)
+	if readErr != nil && !errors.Is(readErr, os.ErrNotExist) {
+		// Undo could not restore a file it can't read, and would delete it
+		return "", fmt.Errorf("cannot read %s before writing: %v", path, readErr)
+	}
+	existed := readErr == nil
+	if mode == "append" && existed && isBinary(existing) {
+		return "", fmt.Errorf("refusing to append text to binary file %s", path)
+	}
+	if existed && wantsBackup(cfg, input) {
+		if backup, err = backupFile(cfg, abs, existing); err != nil {
+			return "", err
+		}
+	}
+	if mode == "append" {
+		f, err := os.OpenFile(abs, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		if _, err := f.WriteString(content); err != nil {
+			return "", err
+		}
+		edits.Push(abs, existing, existed)
+		if full, err := os.ReadFile(abs); err == nil {
+			lastWrites.Record(abs, string(full))
+			known = string(full)
+		}
+	} else {
+		if err := writeFileAtomic(abs, []byte(content)); err != nil {
+			return "", err
+		}
+		edits.Push(abs, existing, existed)
+		lastWrites.Record(abs, content)
+	}
+	bytesLen := len([]byte(content))
+	rel, err := filepath.Rel(cfg.WorkDir, abs)
+	if err != nil {
+		rel = abs
+	}
+	return withKnownContent(cfg, fmt.Sprintf("wrote %d bytes to %s%s", bytesLen, rel, backup), rel, known), nil
+}
+
+// runMove moves or renames a file or directory inside the workspace. An
+// existing destination is only replaced with overwrite, and only when it is
+// a regular file, whose contents are kept so undo can restore them.
+func runMove(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	from, to := getString(input, "from"), getString(input, "to")
+	if from == "" || to == "" {
+		return "", errors.New("move_file needs both from and to")
+	}
+	// A rename acts on the link itself, so a final symlink is not followed
+	src, err := safeLinkPath(cfg.WorkDir, from)
+	if err != nil {
+		return "", err
+	}
+	dst, err := safeLinkPath(cfg.WorkDir, to)
+	if err != nil {
+		return "", err
+	}
+	root, _ := filepath.Abs(cfg.WorkDir)
+	if src == root || dst == root {
+		return "", errors.New("refusing to move the workspace root")
+	}
+	if src == dst {
+		return "", fmt.Errorf("%s and %s are the same path", from, to)
+	}
+	info, err := os.Lstat(src)
+	if err != nil {
+		return "", notFoundError(cfg, from, err)
+	}
+	if info.IsDir() && strings.HasPrefix(dst, src+string(filepath.Separator)) {
+		return "", fmt.Errorf("cannot move %s into itself", from)
+	}
+	var replaced []byte
+	existing, err := os.Lstat(dst)
+	if err == nil {
+		if !getBool(input, "overwrite") {
+			return "", fmt.Errorf("%s already exists; pass overwrite: true to replace it", to)
+		}
+		if !existing.Mode().IsRegular() {
+			return "", fmt.Errorf("%s is not a regular file; overwrite only replaces files", to)
+		}
+		// Keep what is replaced so undo can put it back
+		if replaced, err = os.ReadFile(dst); err != nil {
+			return "", fmt.Errorf("cannot read %s before replacing it: %v", to, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	relFrom, relTo := from, to
+	if rel, err := filepath.Rel(cfg.WorkDir, src); err == nil {
+		relFrom = rel
+	}
+	if rel, err := filepath.Rel(cfg.WorkDir, dst); err == nil {
+		relTo = rel
+	}
+	if cfg.DryRun {
+		return fmt.Sprintf("%s %s not moved; it would be renamed to %s", dryRunTag, relFrom, relTo), nil
+	}
+	if err := moveTree(ctx, src, dst); err != nil {
+		return "", err
+	}
+	edits.PushMove(src, dst, replaced, replaced != nil)
+	lastWrites.Forget(dst)
+	lastWrites.Move(src, dst)
+	return fmt.Sprintf("moved %s to %s", relFrom, relTo), nil
+}
+
+// moveTree renames src to dst, creating dst's parent directories. Across
+// filesystems it copies src and then removes it.
+func moveTree(ctx context.Context, src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyTree(ctx, src, dst); err != nil {
+		return fmt.Errorf("copy across filesystems failed, %s left in place: %v", src, err)
+	}
+	if err := os.RemoveAll(src); err != nil {
+		return fmt.Errorf("copied %s to %s but could not remove the original: %v", src, dst, err)
+	}
+	return nil
+}
+
+// copyTree copies a file, symlink or directory from src to dst, keeping
+// permission bits. A failed copy removes what it wrote to a new dst.
+func copyTree(ctx context.Context, src, dst string) error {
+	_, statErr := os.Lstat(dst)
+	err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		target := dst + p[len(src):]
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			_ = os.Remove(target)
+			return os.Symlink(link, target)
+		default:
+			return copyFile(p, target, info.Mode().Perm())
+		}
+	})
+	if err != nil && errors.Is(statErr, os.ErrNotExist) {
+		_ = os.RemoveAll(dst)
+	}
+	return err
+}
+
+// copyFile copies one regular file's content to dst with the given mode
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// wantsBackup reports whether a write should first save the old contents:
+// the call's backup parameter when given, WRITE_BACKUP otherwise.
+func wantsBackup(cfg Config, input map[string]interface{}) bool {
+	if _, ok := input["backup"]; ok {
+		return getBool(input, "backup")
+	}
+	return cfg.WriteBackup
+}
+
+// backupFile saves data to abs+".bak", replacing an earlier backup, and
+// returns a note naming it for the tool result.
+func backupFile(cfg Config, abs string, data []byte) (string, error) {
+	bak, err := safePath(cfg.WorkDir, abs+".bak")
+	if err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(bak, data); err != nil {
+		return "", fmt.Errorf("backup failed, nothing written: %v", err)
+	}
+	if info, err := os.Stat(abs); err == nil {
+		// Don't expose a private file through a more permissive copy
+		_ = os.Chmod(bak, info.Mode().Perm())
+	}
+	rel, err := filepath.Rel(cfg.WorkDir, bak)
+	if err != nil {
+		rel = bak
+	}
+	return fmt.Sprintf(" (previous version saved to %s)", rel), nil
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it
+// over path, so a crash never leaves a half-written file. An existing file
+// keeps its mode bits, and a symlink keeps pointing at the rewritten target.
+func writeFileAtomic(path string, data []byte) error {
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func runEdit(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	if cfg.DryRun {
+		return dryRunPreview(ctx, cfg, "edit_text", input)
+	}
+	path := getString(input, "path")
+	abs, err := safePath(cfg.WorkDir, path)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(abs)
+	if err != nil {
+		return "", notFoundError(cfg, path, err)
+	}
+	if isBinary(data) {
+		return "", fmt.Errorf("refusing to text-edit binary file %s", path)
+	}
+	text := string(data)
+	updated, summary, err := editText(path, text, input)
+	if err != nil {
+		return "", err
+	}
+	backup := ""
+	if action := strings.ToLower(getString(input, "action")); action != "insert" && wantsBackup(cfg, input) {
+		if backup, err = backupFile(cfg, abs, data); err != nil {
+			return "", err
+		}
+	}
+	if err := os.WriteFile(abs, []byte(updated), 0o644); err != nil {
+		return "", err
+	}
+	edits.Push(abs, data, true)
+	lastWrites.Record(abs, updated)
+	return withKnownContent(cfg, summary+backup+editPreview(path, text, updated, maxEditPreview), path, updated), nil
+}
+
+// editText applies an edit_text action to text in memory, returning the new
+// text and a summary of the change. runEdit and preview_edit share it.
+func editText(path, text string, input map[string]interface{}) (string, string, error) {
+	action := strings.ToLower(getString(input, "action"))
+	switch action {
+	case "replace":
+		findStr := getString(input, "find")
+		if findStr == "" {
+			return "", "", errors.New("edit_text.replace missing find")
+		}
+		replaceStr := getString(input, "replace")
+		var re *regexp.Regexp
+		if getBool(input, "regex") {
+			var err error
+			if re, err = regexp.Compile(findStr); err != nil {
+				return "", "", fmt.Errorf("edit_text.replace invalid regex: %v", err)
+			}
+		}
+		matches := findMatches(text, findStr, re)
+		total := len(matches)
+		if total == 0 {
+			if re != nil {
+				return "", "", fmt.Errorf("edit_text.replace: regex matches nothing in %s; no change made", path)
+			}
+			return "", "", fmt.Errorf("edit_text.replace: find text not found in %s; no change made (re-read the file and copy the exact text, including whitespace)", path)
+		}
+		limit, hasLimit := getOptionalInt(input, "count")
+		occurrence, hasOccurrence := getOptionalInt(input, "occurrence")
+		if hasLimit && limit < 1 {
+			return "", "", errors.New("edit_text.replace count must be positive")
+		}
+		if hasOccurrence && occurrence < 1 {
+			return "", "", errors.New("edit_text.replace occurrence must be positive")
+		}
+		if hasLimit && hasOccurrence {
+			return "", "", errors.New("edit_text.replace takes count or occurrence, not both")
+		}
+		switch {
+		case hasOccurrence:
+			if occurrence > total {
+				return "", "", fmt.Errorf("edit_text.replace: occurrence %d requested but find text occurs %d time(s) in %s", occurrence, total, path)
+			}
+			matches = matches[occurrence-1 : occurrence]
+		case hasLimit && limit < total:
+			matches = matches[:limit]
+		}
+		count := len(matches)
+		updated := replaceMatches(text, matches, replaceStr, re)
+		msg := fmt.Sprintf("replaced %d occurrence(s) (%d bytes)", count, len([]byte(updated)))
+		if count < total {
+			msg = fmt.Sprintf("replaced %d of %d occurrences (%d bytes)", count, total, len([]byte(updated)))
+		}
+		return updated, msg, nil
+	case "insert":
+		insertAfter := getIntOrDefault(input, "insert_after", -1)
+		newLines := splitDiffLines(getString(input, "new_text"))
+		lines := splitDiffLines(text)
+		idx := insertAfter
+		if idx < -1 {
+			idx = -1
+		}
+		if idx >= len(lines) {
+			idx = len(lines) - 1
+		}
+		result := make([]string, 0, len(lines)+len(newLines))
+		result = append(result, lines[:idx+1]...)
+		result = append(result, newLines...)
+		result = append(result, lines[idx+1:]...)
+		return joinLines(result, text), fmt.Sprintf("inserted after line %d", insertAfter), nil
+	case "delete_range":
+		rngRaw, ok := input["range"].([]interface{})
+		if !ok || len(rngRaw) != 2 {
+			return "", "", errors.New("edit_text.delete_range invalid range")
+		}
+		start := toInt(rngRaw[0])
+		end := toInt(rngRaw[1])
+		if start < 0 || end < start {
+			return "", "", errors.New("edit_text.delete_range invalid range")
+		}
+		lines := splitDiffLines(text)
+		if start > len(lines) {
+			start = len(lines)
+		}
+		if end > len(lines) {
+			end = len(lines)
+		}
+		updated := joinLines(append(append([]string{}, lines[:start]...), lines[end:]...), text)
+		return updated, fmt.Sprintf("deleted lines [%d, %d)", start, end), nil
+	default:
+		return "", "", fmt.Errorf("unsupported edit_text.action: %s", action)
+	}
+}
+
+// runPreviewEdit shows the diff an edit_text or write_file call would make
+// without writing anything.
+func runPreviewEdit(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	tool := strings.TrimSpace(getString(input, "tool"))
+	if tool == "" {
+		tool = "edit_text"
+	}
+	path := getString(input, "path")
+	abs, err := safePath(cfg.WorkDir, path)
+	if err != nil {
+		return "", err
+	}
+	var before, after, summary string
+	switch tool {
+	case "edit_text":
+		data, err := os.ReadFile(abs)
+		if err != nil {
+			return "", notFoundError(cfg, path, err)
+		}
+		if isBinary(data) {
+			return "", fmt.Errorf("refusing to text-edit binary file %s", path)
+		}
+		before = string(data)
+		if after, summary, err = editText(path, before, input); err != nil {
+			return "", err
+		}
+	case "write_file":
+		existing, err := os.ReadFile(abs)
+		exists := err == nil
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		content := getString(input, "content")
+		before = string(existing)
+		if strings.ToLower(getString(input, "mode")) == "append" {
+			if isBinary(existing) {
+				return "", fmt.Errorf("refusing to append text to binary file %s", path)
+			}
+			after, summary = before+content, fmt.Sprintf("append %d bytes", len(content))
+		} else {
+			after = content
+			summary = fmt.Sprintf("overwrite with %d bytes", len(after))
+			if !exists {
+				summary = fmt.Sprintf("create with %d bytes", len(after))
+			}
+		}
+	default:
+		return "", fmt.Errorf("preview_edit.tool must be edit_text or write_file, got %q", tool)
+	}
+	header := fmt.Sprintf("preview of %s on %s (nothing written): %s", tool, path, summary)
+	return clampText(header+editPreview(path, before, after, cfg.MaxToolResultChars), cfg.MaxToolResultChars), nil
+}
+
+// dryRunTag starts every tool result that describes a change which was
+// not made because of --dry-run.
+const dryRunTag = "[dry-run]"
+
+// dryRunPreview stands in for write_file and edit_text under --dry-run,
+// reporting the change through preview_edit instead of making it.
+func dryRunPreview(ctx context.Context, cfg Config, tool string, input map[string]interface{}) (string, error) {
+	args := map[string]interface{}{"tool": tool}
+	for k, v := range input {
+		args[k] = v
+	}
+	preview, err := runPreviewEdit(ctx, cfg, args)
+	if err != nil {
+		return "", err
+	}
+	return dryRunTag + " not saved; later reads still show the original file.\n" + preview, nil
+}
+
+// joinLines is the inverse of splitDiffLines: the result ends in a newline
+// when original did (or was empty), so line edits don't add or drop one.
+func joinLines(lines []string, original string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	joined := strings.Join(lines, "\n")
+	if original == "" || strings.HasSuffix(original, "\n") {
+		joined += "\n"
+	}
+	return joined
+}
+
+// findMatches returns the [start, end) of every non-overlapping match of
+// find, or of re when it is set (with submatch offsets for expansion).
+func findMatches(text, find string, re *regexp.Regexp) [][]int {
+	if re != nil {
+		return re.FindAllStringSubmatchIndex(text, -1)
+	}
+	var matches [][]int
+	for at := 0; ; {
+		i := strings.Index(text[at:], find)
+		if i < 0 {
+			return matches
+		}
+		matches = append(matches, []int{at + i, at + i + len(find)})
+		at += i + len(find)
+	}
+}
+
+// replaceMatches substitutes the given matches; with a regex, $1 and ${name}
+// in repl refer to the match's groups.
+func replaceMatches(text string, matches [][]int, repl string, re *regexp.Regexp) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		b.WriteString(text[last:m[0]])
+		if re != nil {
+			b.Write(re.ExpandString(nil, repl, text, m))
+		} else {
+			b.WriteString(repl)
+		}
+		last = m[1]
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+// editPreview summarizes an edit as a count of changed lines and a unified
+// diff, clamped to limit characters.
+func editPreview(path, before, after string, limit int) string {
+	diff := unifiedDiff(path, path, before, after)
+	if diff == "" {
+		return "\n(no lines changed)"
+	}
+	added, removed := 0, 0
+	// The first two lines are the ---/+++ headers
+	for _, line := range strings.Split(diff, "\n")[2:] {
+		if strings.HasPrefix(line, "+") {
+			added++
+		} else if strings.HasPrefix(line, "-") {
+			removed++
+		}
+	}
+	return fmt.Sprintf("\n%d line(s) changed (+%d -%d):\n%s", added+removed, added, removed,
+		clampText(strings.TrimSuffix(diff, "\n"), limit))
+}
+
+// withKnownContent appends a file's content after a write when it fits in
+// cfg.KnownContentChars, sparing the model a read_file right after editing.
+// Overwrites pass "" since the model just sent the content itself.
+func withKnownContent(cfg Config, result, path, content string) string {
+	if content == "" || len(content) > cfg.KnownContentChars {
+		return result
+	}
+	return fmt.Sprintf("%s\ncurrent known content of %s:\n%s", result, path, content)
+}
+
+// filePatch is one file's section of a unified diff; an empty oldPath or
+// newPath stands for /dev/null (file creation or deletion).
+type filePatch struct {
+	oldPath, newPath string
+	hunks            []patchHunk
+}
+
+type patchHunk struct {
+	oldStart int
+	lines    []diffOp
+	// noNewlineAtEnd is set when "\ No newline at end of file" follows a
+	// line that ends up in the new file
+	noNewlineAtEnd bool
+}
+
+var hunkHeaderPattern = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+\d+(?:,(\d+))? @@`)
+
+// parsePatch splits a unified diff into per-file hunks. Lines outside file
+// sections (diff --git, index, commit text) are ignored.
+func parsePatch(patch string) ([]filePatch, error) {
+	var files []filePatch
+	lines := strings.Split(strings.ReplaceAll(patch, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if from, ok := strings.CutPrefix(line, "rename from "); ok && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "rename to ") {
+			// A git rename without content changes has no ---/+++ section
+			if !renameHasHunks(lines[i+2:]) {
+				files = append(files, filePatch{oldPath: strings.TrimSpace(from), newPath: strings.TrimSpace(strings.TrimPrefix(lines[i+1], "rename to "))})
+			}
+			i++
+			continue
+		}
+		if !strings.HasPrefix(line, "--- ") || i+1 >= len(lines) || !strings.HasPrefix(lines[i+1], "+++ ") {
+			continue
+		}
+		fp := filePatch{oldPath: patchPath(line[4:]), newPath: patchPath(lines[i+1][4:])}
+		i += 2
+		for i < len(lines) && strings.HasPrefix(lines[i], "@@") {
+			m := hunkHeaderPattern.FindStringSubmatch(lines[i])
+			if m == nil {
+				return nil, fmt.Errorf("line %d: malformed hunk header %q", i+1, lines[i])
+			}
+			hunk := patchHunk{}
+			hunk.oldStart, _ = strconv.Atoi(m[1])
+			oldLeft, newLeft := 1, 1
+			if m[2] != "" {
+				oldLeft, _ = strconv.Atoi(m[2])
+			}
+			if m[3] != "" {
+				newLeft, _ = strconv.Atoi(m[3])
+			}
+			header := i + 1
+			i++
+			for ; i < len(lines) && (oldLeft > 0 || newLeft > 0 || strings.HasPrefix(lines[i], "\\")); i++ {
+				l := lines[i]
+				if strings.HasPrefix(l, "\\") {
+					if n := len(hunk.lines); n > 0 && hunk.lines[n-1].kind != '-' {
+						hunk.noNewlineAtEnd = true
+					}
+					continue
+				}
+				kind := byte(' ')
+				if l != "" {
+					// An empty line is context whose leading space was stripped
+					kind, l = l[0], l[1:]
+				}
+				switch kind {
+				case ' ':
+					oldLeft--
+					newLeft--
+				case '-':
+					oldLeft--
+				case '+':
+					newLeft--
+				default:
+					return nil, fmt.Errorf("line %d: unexpected %q inside hunk", i+1, lines[i])
+				}
+				hunk.lines = append(hunk.lines, diffOp{kind, l})
+			}
+			if oldLeft != 0 || newLeft != 0 {
+				return nil, fmt.Errorf("line %d: hunk is shorter or longer than its header says", header)
+			}
+			fp.hunks = append(fp.hunks, hunk)
+		}
+		i--
+		if len(fp.hunks) == 0 {
+			return nil, fmt.Errorf("no hunks for %s", fp.displayPath())
+		}
+		files = append(files, fp)
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no file sections found; expected ---/+++ headers followed by @@ hunks")
+	}
+	return files, nil
+}
+
+// renameHasHunks reports whether the lines after a git rename header reach
+// a ---/+++ section before the next file's "diff --git" header.
+func renameHasHunks(lines []string) bool {
+	for _, line := range lines {
+		if strings.HasPrefix(line, "diff --git ") {
+			return false
+		}
+		if strings.HasPrefix(line, "--- ") {
+			return true
+		}
+	}
+	return false
+}
+
+// patchPath strips the a/ or b/ prefix and any tab-separated timestamp.
+func patchPath(header string) string {
+	name, _, _ := strings.Cut(header, "\t")
+	name = strings.TrimSpace(name)
+	if name == "/dev/null" {
+		return ""
+	}
+	if strings.HasPrefix(name, "a/") || strings.HasPrefix(name, "b/") {
+		name = name[2:]
+	}
+	return name
+}
+
+func (fp filePatch) displayPath() string {
+	if fp.newPath != "" {
+		return fp.newPath
+	}
+	return fp.oldPath
+}
+
+// applyHunks applies hunks to text, requiring every hunk's context and
+// removed lines to match exactly. A hunk may sit at a different line than
+// its header says; the closest match after the previous hunk wins.
+func applyHunks(text string, hunks []patchHunk) (string, []string, error) {
+	lines := splitDiffLines(text)
+	endsWithNewline := text == "" || strings.HasSuffix(text, "\n")
+	var out []string
+	var notes []string
+	pos := 0
+	for h, hunk := range hunks {
+		var old, repl []string
+		for _, op := range hunk.lines {
+			if op.kind != '+' {
+				old = append(old, op.text)
+			}
+			if op.kind != '-' {
+				repl = append(repl, op.text)
+			}
+		}
+		want := hunk.oldStart - 1
+		if len(old) == 0 {
+			// Pure insertion: the header names the line to insert after
+			want = hunk.oldStart
+		}
+		at := findHunk(lines, old, pos, want)
+		if at < 0 {
+			return "", nil, fmt.Errorf("hunk %d (@@ -%d) does not match the file", h+1, hunk.oldStart)
+		}
+		if want >= 0 && at != want {
+			notes = append(notes, fmt.Sprintf("hunk %d applied at offset %+d", h+1, at-want))
+		}
+		out = append(out, lines[pos:at]...)
+		out = append(out, repl...)
+		pos = at + len(old)
+		if pos == len(lines) {
+			endsWithNewline = !hunk.noNewlineAtEnd
+		}
+	}
+	out = append(out, lines[pos:]...)
+	updated := strings.Join(out, "\n")
+	if len(out) > 0 && endsWithNewline {
+		updated += "\n"
+	}
+	return updated, notes, nil
+}
+
+// findHunk returns where old occurs in lines at or after from, preferring
+// the occurrence closest to want, or -1.
+func findHunk(lines, old []string, from, want int) int {
+	best := -1
+	for at := from; at+len(old) <= len(lines); at++ {
+		match := true
+		for k, l := range old {
+			if lines[at+k] != l {
+				match = false
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+		if best < 0 || absInt(at-want) < absInt(best-want) {
+			best = at
+		}
+	}
+	return best
+}
+
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// runApplyPatch applies a unified diff to one or more files. Every hunk is
+// verified before anything is written, so a patch applies completely or
+// not at all; dry_run only reports what would change.
+func runApplyPatch(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	patch := getString(input, "patch")
+	if strings.TrimSpace(patch) == "" {
+		return "", errors.New("apply_patch.patch required")
+	}
+	files, err := parsePatch(patch)
+	if err != nil {
+		return "", err
+	}
+
+	// Sections are applied in order to each file's text so far, so several
+	// sections for one path build on each other and a rename carries the
+	// old file's text to the new path.
+	type change struct {
+		abs, rel string
+		before   string
+		existed  bool
+		after    string
+		exists   bool // whether the file exists once the patch is applied
+	}
+	byPath := map[string]*change{}
+	var changes []*change
+	load := func(rel string) (*change, error) {
+		abs, err := safePath(cfg.WorkDir, rel)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", rel, err)
+		}
+		if c, ok := byPath[abs]; ok {
+			return c, nil
+		}
+		c := &change{abs: abs, rel: rel}
+		data, err := os.ReadFile(abs)
+		switch {
+		case err == nil:
+			if isBinary(data) {
+				return nil, fmt.Errorf("patch rejected: %s is a binary file", rel)
+			}
+			c.before, c.existed = string(data), true
+		case !errors.Is(err, os.ErrNotExist):
+			return nil, fmt.Errorf("patch rejected: %v", err)
+		}
+		c.after, c.exists = c.before, c.existed
+		byPath[abs] = c
+		changes = append(changes, c)
+		return c, nil
+	}
+	var summary []string
+	for _, fp := range files {
+		rel := fp.displayPath()
+		var src, dst *change
+		text := ""
+		if fp.oldPath != "" {
+			var err error
+			if src, err = load(fp.oldPath); err != nil {
+				return "", err
+			}
+			if !src.exists {
+				return "", fmt.Errorf("patch rejected: %v", notFoundError(cfg, fp.oldPath, os.ErrNotExist))
+			}
+			text = src.after
+		}
+		if fp.newPath != "" {
+			var err error
+			if dst, err = load(fp.newPath); err != nil {
+				return "", err
+			}
+			if dst != src && dst.exists {
+				return "", fmt.Errorf("patch rejected: %s already exists but the patch creates it", fp.newPath)
+			}
+		}
+		after, notes, err := applyHunks(text, fp.hunks)
+		if err != nil {
+			return "", fmt.Errorf("patch rejected, nothing written: %s: %v", rel, err)
+		}
+		if src != nil && src != dst {
+			src.after, src.exists = "", false
+		}
+		if dst != nil {
+			dst.after, dst.exists = after, true
+		}
+
+		added, removed := 0, 0
+		for _, hunk := range fp.hunks {
+			for _, op := range hunk.lines {
+				switch op.kind {
+				case '+':
+					added++
+				case '-':
+					removed++
+				}
+			}
+		}
+		line := fmt.Sprintf("modify %s (+%d -%d)", rel, added, removed)
+		switch {
+		case dst == nil:
+			line = fmt.Sprintf("delete %s (+%d -%d)", rel, added, removed)
+		case src == nil:
+			line = fmt.Sprintf("create %s (+%d -%d)", rel, added, removed)
+		case src != dst:
+			line = fmt.Sprintf("rename %s to %s (+%d -%d)", fp.oldPath, fp.newPath, added, removed)
+		}
+		if len(notes) > 0 {
+			line += "; " + strings.Join(notes, ", ")
+		}
+		summary = append(summary, line)
+	}
+
+	if cfg.DryRun {
+		return dryRunTag + " patch not applied; it would apply cleanly:\n" + strings.Join(summary, "\n"), nil
+	}
+	if getBool(input, "dry_run") {
+		return "dry run, nothing written; the patch applies cleanly:\n" + strings.Join(summary, "\n"), nil
+	}
+
+	// Write everything, restoring earlier files if a later write fails
+	var written []*change
+	for _, c := range changes {
+		if c.exists == c.existed && c.after == c.before {
+			continue
+		}
+		var err error
+		switch {
+		case c.exists:
+			if err = os.MkdirAll(filepath.Dir(c.abs), 0o755); err == nil {
+				err = writeFileAtomic(c.abs, []byte(c.after))
+			}
+		case c.existed:
+			err = os.Remove(c.abs)
+		default:
+			continue // created and deleted again within the patch
+		}
+		if err == nil {
+			written = append(written, c)
+			continue
+		}
+		var failed []string
+		for _, done := range written {
+			var restoreErr error
+			if done.existed {
+				restoreErr = writeFileAtomic(done.abs, []byte(done.before))
+			} else {
+				restoreErr = os.Remove(done.abs)
+			}
+			if restoreErr != nil {
+				failed = append(failed, fmt.Sprintf("%s: %v", done.rel, restoreErr))
+			}
+		}
+		if len(failed) > 0 {
+			return "", fmt.Errorf("writing %s failed: %v; restoring earlier files also failed, so the patch is partly applied: %s", c.rel, err, strings.Join(failed, "; "))
+		}
+		return "", fmt.Errorf("writing %s failed, earlier files restored: %v", c.rel, err)
+	}
+	// Each file gets its own undo entry, so undo steps back one file at a time
+	for _, c := range written {
+		edits.Push(c.abs, []byte(c.before), c.existed)
+		if c.exists {
+			lastWrites.Record(c.abs, c.after)
+		} else {
+			lastWrites.Forget(c.abs)
+		}
+	}
+	return "applied patch:\n" + strings.Join(summary, "\n"), nil
+}
+
+// traceFrame is one file:line location pulled out of a stack trace.
+type traceFrame struct {
+	function string
+	file     string
+	line     int
+}
+
+var (
+	pythonFramePattern = regexp.MustCompile(`^\s*File "([^"]+)", line (\d+)(?:, in (.+))?`)
+	nodeFramePattern   = regexp.MustCompile(`^\s*at (?:(.+?) \()?((?:[A-Za-z]:)?[^():]+):(\d+)(?::\d+)?\)?\s*$`)
+	goFramePattern     = regexp.MustCompile(`^\s+(\S+\.go):(\d+)(?: \+0x[0-9a-f]+)?\s*$`)
+)
+
+// parseTrace detects a Go, Python or Node stack trace and returns its frames
+// in the order they appear, the language and the error message line.
+func parseTrace(trace string) (string, string, []traceFrame) {
+	lines := strings.Split(strings.ReplaceAll(trace, "\r\n", "\n"), "\n")
+	var frames []traceFrame
+	lang, message := "", ""
+	for i, line := range lines {
+		if m := goFramePattern.FindStringSubmatch(line); m != nil {
+			n, _ := strconv.Atoi(m[2])
+			fn := ""
+			if i > 0 {
+				fn = strings.TrimSpace(lines[i-1])
+				if idx := strings.LastIndex(fn, "("); idx > 0 {
+					fn = fn[:idx]
+				}
+			}
+			frames = append(frames, traceFrame{function: fn, file: m[1], line: n})
+			lang = "go"
+			continue
+		}
+		if m := pythonFramePattern.FindStringSubmatch(line); m != nil {
+			n, _ := strconv.Atoi(m[2])
+			frames = append(frames, traceFrame{function: m[3], file: m[1], line: n})
+			lang = "python"
+			continue
+		}
+		if m := nodeFramePattern.FindStringSubmatch(line); m != nil && !strings.HasPrefix(m[2], "node:") {
+			n, _ := strconv.Atoi(m[3])
+			frames = append(frames, traceFrame{function: m[1], file: strings.TrimPrefix(m[2], "file://"), line: n})
+			lang = "node"
+		}
+	}
+
+	// The message is the panic line for Go, the last line for Python and the
+	// first line for Node
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+		switch lang {
+		case "go":
+			if strings.HasPrefix(trimmed, "panic:") || strings.HasPrefix(trimmed, "fatal error:") {
+				return lang, trimmed, frames
+			}
+		case "node":
+			return lang, trimmed, frames
+		case "python":
+			for j := len(lines) - 1; j > i; j-- {
+				if last := strings.TrimSpace(lines[j]); last != "" {
+					return lang, last, frames
+				}
+			}
+		}
+	}
+	return lang, message, frames
+}
+
+// traceSource reads the lines around a frame through read_file, marking the
+// frame's own line. Files outside the workspace are skipped.
+func traceSource(ctx context.Context, cfg Config, f traceFrame, around int) (string, bool) {
+	path := f.file
+	if filepath.IsAbs(path) {
+		rel, err := filepath.Rel(cfg.WorkDir, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return "", false
+		}
+		path = rel
+	}
+	start := f.line - around
+	if start < 1 {
+		start = 1
+	}
+	text, err := runRead(ctx, cfg, map[string]interface{}{
+		"path":       path,
+		"start_line": float64(start),
+		"end_line":   float64(f.line + around),
+	})
+	if err != nil {
+		return "", false
+	}
+	var b strings.Builder
+	for i, l := range strings.Split(text, "\n") {
+		marker := " "
+		if start+i == f.line {
+			marker = ">"
+		}
+		fmt.Fprintf(&b, "    %s %4d | %s\n", marker, start+i, l)
+	}
+	return b.String(), true
+}
+
+// scaffolds are the minimal projects the scaffold tool can create. In paths
+// and contents, {{name}} is the project name and {{ident}} its identifier
+// form (lowercase letters, digits and underscores).
+var scaffolds = map[string][]struct{ path, content string }{
+	"go": {
+		{"go.mod", "module {{name}}\n\ngo 1.21\n"},
+		{"main.go", "package main\n\nimport \"fmt\"\n\n// Repro reproduces the issue; keep it as small as possible.\nfunc Repro() string {\n\treturn \"\"\n}\n\nfunc main() {\n\tfmt.Println(Repro())\n}\n"},
+		{"main_test.go", "package main\n\nimport \"testing\"\n\nfunc TestRepro(t *testing.T) {\n\tif got, want := Repro(), \"\"; got != want {\n\t\tt.Fatalf(\"Repro() = %q, want %q\", got, want)\n\t}\n}\n"},
+	},
+	"node": {
+		{"package.json", "{\n  \"name\": \"{{name}}\",\n  \"version\": \"0.0.0\",\n  \"private\": true,\n  \"main\": \"index.js\",\n  \"scripts\": {\n    \"start\": \"node index.js\",\n    \"test\": \"node --test\"\n  }\n}\n"},
+		{"index.js", "// repro reproduces the issue; keep it as small as possible.\nfunction repro() {\n  return '';\n}\n\nmodule.exports = { repro };\n\nif (require.main === module) {\n  console.log(repro());\n}\n"},
+		{"index.test.js", "const test = require('node:test');\nconst assert = require('node:assert');\nconst { repro } = require('./index');\n\ntest('repro', () => {\n  assert.strictEqual(repro(), '');\n});\n"},
+	},
+	"python": {
+		{"pyproject.toml", "[project]\nname = \"{{name}}\"\nversion = \"0.0.0\"\nrequires-python = \">=3.8\"\n"},
+		{"{{ident}}/__init__.py", "def repro():\n    \"\"\"Reproduce the issue; keep it as small as possible.\"\"\"\n    return \"\"\n\n\nif __name__ == \"__main__\":\n    print(repro())\n"},
+		{"tests/test_repro.py", "import unittest\n\nfrom {{ident}} import repro\n\n\nclass ReproTest(unittest.TestCase):\n    def test_repro(self):\n        self.assertEqual(repro(), \"\")\n\n\nif __name__ == \"__main__\":\n    unittest.main()\n"},
+	},
+}
+
+// scaffoldTests is how to run each scaffold's test, from its directory.
+var scaffoldTests = map[string]string{
+	"go":     "go test ./...",
+	"node":   "npm test",
+	"python": "python -m unittest discover -s tests",
+}
+
+var nonIdentChars = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// runScaffold creates a minimal project in a new directory so an issue can
+// be reproduced in isolation. Nothing is written if any file already exists.
+func runScaffold(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	lang := strings.ToLower(strings.TrimSpace(getString(input, "language")))
+	switch lang {
+	case "golang":
+		lang = "go"
+	case "javascript", "js", "nodejs":
+		lang = "node"
+	case "py":
+		lang = "python"
+	}
+	files, ok := scaffolds[lang]
+	if !ok {
+		return "", fmt.Errorf("unknown scaffold language %q (supported: go, node, python)", lang)
+	}
+	dir := strings.TrimSpace(getString(input, "dir"))
+	if dir == "" {
+		return "", errors.New("scaffold missing dir")
+	}
+	absDir, err := safePath(cfg.WorkDir, dir)
+	if err != nil {
+		return "", err
+	}
+	if absDir == cfg.WorkDir {
+		return "", errors.New("scaffold dir must be a subdirectory of the workspace")
+	}
+	name := strings.TrimSpace(getString(input, "name"))
+	if name == "" {
+		name = strings.ToLower(filepath.Base(absDir))
+	}
+	ident := strings.Trim(nonIdentChars.ReplaceAllString(strings.ToLower(name), "_"), "_")
+	if ident == "" || (ident[0] >= '0' && ident[0] <= '9') {
+		ident = "repro_" + ident
+	}
+	expand := strings.NewReplacer("{{name}}", name, "{{ident}}", ident)
+
+	// Check every target first so a refusal leaves nothing half-created
+	paths := make([]string, len(files))
+	for i, f := range files {
+		abs, err := safePath(cfg.WorkDir, filepath.Join(absDir, expand.Replace(f.path)))
+		if err != nil {
+			return "", err
+		}
+		if _, err := os.Lstat(abs); err == nil {
+			return "", fmt.Errorf("refusing to overwrite existing %s; pick another dir", abs)
+		}
+		paths[i] = abs
+	}
+	if cfg.DryRun {
+		var planned []string
+		for _, abs := range paths {
+			rel, err := filepath.Rel(cfg.WorkDir, abs)
+			if err != nil {
+				rel = abs
+			}
+			planned = append(planned, rel)
+		}
+		return fmt.Sprintf("%s %s scaffold not created; it would add:\n  %s", dryRunTag, lang, strings.Join(planned, "\n  ")), nil
+	}
+	var created []string
+	for i, f := range files {
+		if _, err := runWrite(ctx, cfg, map[string]interface{}{"path": paths[i], "content": expand.Replace(f.content)}); err != nil {
+			return "", err
+		}
+		rel, err := filepath.Rel(cfg.WorkDir, paths[i])
+		if err != nil {
+			rel = paths[i]
+		}
+		created = append(created, rel)
+	}
+	relDir, err := filepath.Rel(cfg.WorkDir, absDir)
+	if err != nil {
+		relDir = absDir
+	}
+	return fmt.Sprintf("created %s scaffold in %s:\n  %s\nrun its test with: cd %s && %s",
+		lang, relDir, strings.Join(created, "\n  "), shellQuote(relDir), scaffoldTests[lang]), nil
+}
+
+// runParseTrace extracts the frames of a pasted stack trace and, unless
+// context_lines is 0, shows the source around frames inside the workspace.
+func runParseTrace(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	trace := getString(input, "trace")
+	if strings.TrimSpace(trace) == "" {
+		return "", errors.New("parse_trace.trace required")
+	}
+	lang, message, frames := parseTrace(trace)
+	if len(frames) == 0 {
+		return "", errors.New("no Go, Python or Node stack frames found")
+	}
+	around := getIntOrDefault(input, "context_lines", defaultTraceLines)
+	if around < 0 {
+		around = 0
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s trace, %d frame(s)\n", lang, len(frames))
+	if message != "" {
+		fmt.Fprintf(&b, "error: %s\n", message)
+	}
+	if len(frames) > maxTraceFrames {
+		fmt.Fprintf(&b, "(showing the first %d frames)\n", maxTraceFrames)
+		frames = frames[:maxTraceFrames]
+	}
+	shown := 0
+	for i, f := range frames {
+		fmt.Fprintf(&b, "\n#%d %s:%d", i+1, f.file, f.line)
+		if f.function != "" {
+			fmt.Fprintf(&b, " in %s", f.function)
+		}
+		b.WriteString("\n")
+		if around == 0 || shown >= maxTraceSources {
+			continue
+		}
+		if src, ok := traceSource(ctx, cfg, f, around); ok {
+			b.WriteString(src)
+			shown++
+		}
+	}
+	return b.String(), nil
+}
+
+// detectBuildCommand picks a build command from the project files in dir.
+func detectBuildCommand(dir string) string {
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+	switch {
+	case exists("go.mod"):
+		return "go build -o " + os.DevNull + " ./..."
+	case exists("Cargo.toml"):
+		return "cargo build --quiet"
+	case exists("package.json"):
+		var pkg struct {
+			Scripts map[string]string `json:"scripts"`
+		}
+		if data, err := os.ReadFile(filepath.Join(dir, "package.json")); err == nil && json.Unmarshal(data, &pkg) == nil && pkg.Scripts["build"] != "" {
+			return "npm run build --silent"
+		}
+		if exists("tsconfig.json") {
+			return "npx tsc --noEmit"
+		}
+	case exists("tsconfig.json"):
+		return "npx tsc --noEmit"
+	case exists("Makefile"):
+		return "make"
+	}
+	return ""
+}
+
+// workspaceFingerprint hashes every file's path, size and modification time,
+// skipping VCS metadata and common build output directories.
+func workspaceFingerprint(workDir string) string {
+	h := sha256.New()
+	filepath.WalkDir(workDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			switch d.Name() {
+			case ".git", ".mcc", "node_modules", "target", "dist":
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, _ := filepath.Rel(workDir, path)
+		if rel == todosFile {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00%d\n", rel, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// diagnostic is one compiler message tied to a source location.
+type diagnostic struct {
+	file      string
+	line, col int
+	rule      string // linter rule, when known
+	message   string
+}
+
+func (d diagnostic) String() string {
+	loc := fmt.Sprintf("%s:%d", d.file, d.line)
+	if d.col > 0 {
+		loc += fmt.Sprintf(":%d", d.col)
+	}
+	if d.rule != "" {
+		return fmt.Sprintf("%s: %s: %s", loc, d.rule, d.message)
+	}
+	return fmt.Sprintf("%s: %s", loc, d.message)
+}
+
+var (
+	// go, gcc, clang: path:line[:col]: message
+	colonDiagPattern = regexp.MustCompile(`^(?:\./)?([^\s:()]+\.[A-Za-z0-9]+):(\d+)(?::(\d+))?:\s*(.+)$`)
+	// tsc: path(line,col): error TS1234: message
+	parenDiagPattern = regexp.MustCompile(`^(?:\./)?([^\s:()]+\.[A-Za-z0-9]+)\((\d+),(\d+)\):\s*(.+)$`)
+	// rustc puts the message first and the location on a --> line
+	rustDiagPattern = regexp.MustCompile(`^\s*--> ([^\s:]+):(\d+):(\d+)`)
+)
+
+// parseDiagnostics pulls file:line:col messages out of build output.
+func parseDiagnostics(output string) []diagnostic {
+	var diags []diagnostic
+	lastMessage := ""
+	for _, raw := range strings.Split(output, "\n") {
+		line := strings.TrimRight(raw, "\r")
+		var m []string
+		if m = colonDiagPattern.FindStringSubmatch(line); m == nil {
+			m = parenDiagPattern.FindStringSubmatch(line)
+		}
+		if m != nil {
+			n, _ := strconv.Atoi(m[2])
+			col, _ := strconv.Atoi(m[3])
+			diags = append(diags, diagnostic{file: m[1], line: n, col: col, message: strings.TrimSpace(m[4])})
+		} else if m := rustDiagPattern.FindStringSubmatch(line); m != nil && lastMessage != "" {
+			n, _ := strconv.Atoi(m[2])
+			col, _ := strconv.Atoi(m[3])
+			diags = append(diags, diagnostic{file: m[1], line: n, col: col, message: lastMessage})
+			lastMessage = ""
+		} else if strings.HasPrefix(line, "error") || strings.HasPrefix(line, "warning") {
+			lastMessage = line
+		}
+		if len(diags) >= maxDiagnostics {
+			break
+		}
+	}
+	return diags
+}
+
+// runBuild runs the project's build command, or returns the previous result
+// when neither the agent nor anyone else changed the workspace since.
+func runBuild(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	command := strings.TrimSpace(getString(input, "command"))
+	if command == "" {
+		command = detectBuildCommand(cfg.WorkDir)
+	}
+	if command == "" {
+		return "", errors.New("no build command detected (looked for go.mod, Cargo.toml, package.json, tsconfig.json, Makefile); pass one in build.command")
+	}
+	if cfg.DryRun {
+		// Builds write artifacts into the workspace
+		return fmt.Sprintf("%s build not run: %s would write build output", dryRunTag, command), nil
+	}
+
+	key := workspaceFingerprint(cfg.WorkDir)
+	passed, output, cached := builds.Lookup(command, key)
+	if !cached || getBool(input, "force") {
+		var note string
+		var err error
+		output, passed, note, err = runChecked(ctx, cfg, command, getIntOrDefault(input, "timeout_ms", defaultBuildMillis))
+		if note != "" || err != nil {
+			return note, err
+		}
+		cached = false
+		builds.Store(command, key, passed, output)
+	}
+
+	note := ""
+	if cached {
+		note = " (cached: no changes since the last build)"
+	}
+	if passed {
+		return fmt.Sprintf("build passed: %s%s", command, note), nil
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "build failed: %s%s\n", command, note)
+	if diags := parseDiagnostics(output); len(diags) > 0 {
+		fmt.Fprintf(&b, "%d diagnostic(s):\n", len(diags))
+		for _, d := range diags {
+			b.WriteString("  " + d.String() + "\n")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("output:\n" + output)
+	return clampToolResult("build", input, b.String(), cfg.MaxToolResultChars), nil
+}
+
+// runChecked runs a build or lint command in the workspace under the same
+// policies as bash and returns its combined output and whether it exited 0.
+// A non-empty note (declined, timed out, interrupted) means it didn't finish.
+func runChecked(ctx context.Context, cfg Config, command string, timeout int) (string, bool, string, error) {
+	if declined, err := checkCommandPolicy(cfg, command); declined != "" || err != nil {
+		return "", false, declined, err
+	}
+	runCtx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+	defer cancel()
+
+	cmd := exec.CommandContext(runCtx, "bash", "-lc", command)
+	setProcessGroup(cmd)
+	cmd.WaitDelay = time.Second
+	cmd.Dir = cfg.WorkDir
+	cmd.Env = sessionEnv.Environ()
+	out, err := cmd.CombinedOutput()
+	if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+		return "", false, fmt.Sprintf("timed out after %dms: %s", timeout, command), nil
+	}
+	if ctx.Err() != nil {
+		return "", false, "(interrupted)", nil
+	}
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return "", false, "", err
+		}
+	}
+	return strings.TrimSpace(string(out)), err == nil, "", nil
+}
+
+// linters are tried in order; markers are files that suggest the project
+// uses the linter. Every command is check-only and never edits files.
+var linters = []struct {
+	name    string
+	command string // %s is the shell-quoted target
+	markers []string
+}{
+	{"golangci-lint", "golangci-lint run %s", []string{".golangci.yml", ".golangci.yaml", ".golangci.toml", ".golangci.json", "go.mod"}},
+	{"eslint", "eslint --format json %s", []string{"eslint.config.js", "eslint.config.mjs", "eslint.config.cjs", ".eslintrc", ".eslintrc.js", ".eslintrc.cjs", ".eslintrc.json", ".eslintrc.yml", ".eslintrc.yaml"}},
+	{"ruff", "ruff check --no-fix --output-format=concise %s", []string{"ruff.toml", ".ruff.toml", "pyproject.toml"}},
+}
+
+var (
+	// golangci-lint: "message (rule)"; ruff: "E501 message"
+	trailingRulePattern = regexp.MustCompile(`\s+\(([\w-]+)\)$`)
+	leadingRulePattern  = regexp.MustCompile(`^([A-Z]+[0-9]+)\s+`)
+)
+
+// splitRule separates a linter's rule name from its message.
+func splitRule(message string) (string, string) {
+	if m := trailingRulePattern.FindStringSubmatch(message); m != nil {
+		return m[1], message[:len(message)-len(m[0])]
+	}
+	if m := leadingRulePattern.FindStringSubmatch(message); m != nil {
+		return m[1], message[len(m[0]):]
+	}
+	return "", message
+}
+
+// parseESLintJSON reads eslint --format json output, an array of files with
+// their messages, into diagnostics with paths relative to workDir. Anything
+// eslint printed before the array, such as deprecation notices, is skipped.
+func parseESLintJSON(output, workDir string) []diagnostic {
+	var files []struct {
+		FilePath string `json:"filePath"`
+		Messages []struct {
+			RuleID  string `json:"ruleId"`
+			Message string `json:"message"`
+			Line    int    `json:"line"`
+			Column  int    `json:"column"`
+		} `json:"messages"`
+	}
+	for rest := output; ; {
+		start := strings.IndexByte(rest, '[')
+		if start < 0 {
+			return nil
+		}
+		if json.NewDecoder(strings.NewReader(rest[start:])).Decode(&files) == nil {
+			break
+		}
+		rest = rest[start+1:]
+	}
+	var diags []diagnostic
+	for _, f := range files {
+		file := f.FilePath
+		if rel, err := filepath.Rel(workDir, file); err == nil && filepath.IsAbs(file) {
+			file = filepath.ToSlash(rel)
+		}
+		for _, m := range f.Messages {
+			if len(diags) >= maxDiagnostics {
+				return diags
+			}
+			diags = append(diags, diagnostic{file: file, line: m.Line, col: m.Column, rule: m.RuleID, message: m.Message})
+		}
+	}
+	return diags
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// runLint runs the project's linter in check-only mode and lists its
+// violations as file:line:col: rule: message.
+func runLint(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	want := strings.TrimSpace(getString(input, "linter"))
+	name, command := "", ""
+	for _, l := range linters {
+		if want != "" && l.name != want {
+			continue
+		}
+		found := want != ""
+		for _, marker := range l.markers {
+			if _, err := os.Stat(filepath.Join(cfg.WorkDir, marker)); err == nil {
+				found = true
+				break
+			}
+		}
+		if found {
+			name, command = l.name, l.command
+			break
+		}
+	}
+	if name == "" {
+		if want != "" {
+			return "", fmt.Errorf("unknown linter %q (supported: golangci-lint, eslint, ruff)", want)
+		}
+		return "", errors.New("no linter detected (looked for golangci-lint, eslint and ruff config files)")
+	}
+
+	bin := name
+	if name == "eslint" {
+		// Prefer the project's own eslint
+		local := filepath.Join(cfg.WorkDir, "node_modules", ".bin", "eslint")
+		if _, err := os.Stat(local); err == nil {
+			bin = local
+			command = shellQuote(local) + strings.TrimPrefix(command, "eslint")
+		}
+	}
+	if bin == name {
+		// Look it up the way the command will run, through a login shell
+		lookup := exec.CommandContext(ctx, "bash", "-lc", "command -v "+name)
+		lookup.Env = sessionEnv.Environ()
+		if err := lookup.Run(); err != nil {
+			return fmt.Sprintf("%s is not installed, so nothing was checked; install it or use the build tool instead", name), nil
+		}
+	}
+
+	target := "."
+	if p := strings.TrimSpace(getString(input, "path")); p != "" {
+		abs, err := safePath(cfg.WorkDir, p)
+		if err != nil {
+			return "", err
+		}
+		if _, err := os.Stat(abs); err != nil {
+			return "", notFoundError(cfg, p, err)
+		}
+		if target, err = filepath.Rel(cfg.WorkDir, abs); err != nil {
+			return "", err
+		}
+	}
+	if name == "golangci-lint" {
+		// golangci-lint takes packages, not files
+		if info, err := os.Stat(filepath.Join(cfg.WorkDir, target)); err == nil && !info.IsDir() {
+			target = filepath.Dir(target)
+		}
+		if dir := filepath.ToSlash(filepath.Clean(target)); dir == "." {
+			target = "./..."
+		} else {
+			target = "./" + dir + "/..."
+		}
+	}
+	command = fmt.Sprintf(command, shellQuote(target))
+
+	output, passed, note, err := runChecked(ctx, cfg, command, getIntOrDefault(input, "timeout_ms", defaultLintMillis))
+	if note != "" || err != nil {
+		return note, err
+	}
+	var diags []diagnostic
+	if name == "eslint" {
+		diags = parseESLintJSON(output, cfg.WorkDir)
+	} else {
+		diags = parseDiagnostics(output)
+		for i := range diags {
+			diags[i].rule, diags[i].message = splitRule(diags[i].message)
+		}
+	}
+	if len(diags) == 0 {
+		if passed {
+			return fmt.Sprintf("%s: no violations", name), nil
+		}
+		return clampToolResult("lint", input, fmt.Sprintf("%s failed without reporting violations:\n%s", name, output), cfg.MaxToolResultChars), nil
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d violation(s)", name, len(diags))
+	if len(diags) >= maxDiagnostics {
+		fmt.Fprintf(&b, " (showing the first %d)", maxDiagnostics)
+	}
+	b.WriteString("\n")
+	for _, d := range diags {
+		b.WriteString(d.String() + "\n")
+	}
+	return clampToolResult("lint", input, b.String(), cfg.MaxToolResultChars), nil
+}
+
+// undoLastEdit restores the file changed by the most recent write_file,
+// edit_text or apply_patch call, deleting it if that call created it, or
+// moves the file from the last move_file back.
+func undoLastEdit(cfg Config) (editEntry, string, error) {
+	entry, ok := edits.Pop()
+	if !ok {
+		return entry, "", errors.New("nothing to undo")
+	}
+	rel, err := filepath.Rel(cfg.WorkDir, entry.path)
+	if err != nil {
+		rel = entry.path
+	}
+	left := fmt.Sprintf("%d more edit(s) can be undone", edits.Len())
+	if entry.from != "" {
+		result, err := undoMove(cfg, entry, rel, left)
+		return entry, result, err
+	}
+	if !entry.existed {
+		if err := os.Remove(entry.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return entry, "", err
+		}
+		return entry, fmt.Sprintf("removed %s, which the undone write created (%s)", rel, left), nil
+	}
+	if err := writeFileAtomic(entry.path, entry.data); err != nil {
+		return entry, "", err
+	}
+	return entry, fmt.Sprintf("restored %s to its previous %d bytes (%s)", rel, len(entry.data), left), nil
+}
+
+// undoMove moves entry.path back to where move_file found it, then restores
+// the file the move replaced, if any.
+func undoMove(cfg Config, entry editEntry, rel, left string) (string, error) {
+	relFrom, err := filepath.Rel(cfg.WorkDir, entry.from)
+	if err != nil {
+		relFrom = entry.from
+	}
+	if _, err := os.Lstat(entry.from); err == nil {
+		return "", fmt.Errorf("cannot move %s back: %s exists again", rel, relFrom)
+	}
+	if err := moveTree(context.Background(), entry.path, entry.from); err != nil {
+		return "", err
+	}
+	if !entry.existed {
+		return fmt.Sprintf("moved %s back to %s (%s)", rel, relFrom, left), nil
+	}
+	if err := writeFileAtomic(entry.path, entry.data); err != nil {
+		return "", fmt.Errorf("moved %s back to %s but could not restore the file it replaced: %v", rel, relFrom, err)
+	}
+	return fmt.Sprintf("moved %s back to %s and restored the %d-byte file it replaced (%s)", rel, relFrom, len(entry.data), left), nil
+}
+
+// runUndo reverts the agent's last file edit. The restored content counts as
+// the agent's own write, so it isn't reported as an external change.
+func runUndo(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	entry, result, err := undoLastEdit(cfg)
+	if err != nil {
+		return "", err
+	}
+	if entry.from != "" {
+		lastWrites.Move(entry.path, entry.from)
+	}
+	if entry.existed {
+		lastWrites.Record(entry.path, string(entry.data))
+	} else {
+		lastWrites.Forget(entry.path)
+	}
+	return result, nil
+}
+
+// runMemorySet saves, replaces or (with an empty value) deletes a memory.
+func runMemorySet(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	key := strings.TrimSpace(getString(input, "key"))
+	value := strings.TrimSpace(getString(input, "value"))
+	if key == "" {
+		return "", errors.New("key is required")
+	}
+	if utf8.RuneCountInString(key) > maxMemoryKeyLen || strings.ContainsAny(key, "\r\n") {
+		return "", fmt.Errorf("key must be a single line of at most %d characters", maxMemoryKeyLen)
+	}
+	if n := utf8.RuneCountInString(value); n > maxMemoryValueChars {
+		return "", fmt.Errorf("value is %d characters; the limit is %d, so save the gist", n, maxMemoryValueChars)
+	}
+	if cfg.DryRun {
+		return fmt.Sprintf("%s %q not saved to %s", dryRunTag, key, memoryFile), nil
+	}
+	existed, err := memory.Set(cfg, key, value)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case value == "" && existed:
+		return fmt.Sprintf("Forgot %q", key), nil
+	case value == "":
+		return fmt.Sprintf("No memory named %q; nothing to delete", key), nil
+	case existed:
+		return fmt.Sprintf("Updated %q in %s", key, memoryFile), nil
+	}
+	return fmt.Sprintf("Remembered %q in %s", key, memoryFile), nil
+}
+
+// runMemoryGet returns one saved memory.
+func runMemoryGet(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	key := strings.TrimSpace(getString(input, "key"))
+	if key == "" {
+		return "", errors.New("key is required")
+	}
+	entry, ok, err := memory.Get(cfg, key)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("no memory named %q; memory_list shows the saved keys", key)
+	}
+	return fmt.Sprintf("%s (saved %s)", entry.Value, entry.UpdatedAt.Local().Format("2006-01-02 15:04")), nil
+}
+
+// runMemoryList lists saved memories, optionally those whose key starts
+// with prefix, with the first line of each value.
+func runMemoryList(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	prefix := strings.TrimSpace(getString(input, "prefix"))
+	items, err := memory.Items(cfg)
+	if err != nil {
+		return "", err
+	}
+	var lines []string
+	for _, item := range items {
+		if !strings.HasPrefix(item.key, prefix) {
+			continue
+		}
+		preview, _, _ := strings.Cut(item.Value, "\n")
+		lines = append(lines, fmt.Sprintf("%s: %s", item.key, clampText(preview, 200)))
+	}
+	if len(lines) == 0 {
+		if prefix != "" {
+			return fmt.Sprintf("no memories with keys starting %q", prefix), nil
+		}
+		return "no memories saved yet", nil
+	}
+	header := fmt.Sprintf("%d of %d memories (most recent first):", len(lines), len(items))
+	return header + "\n" + strings.Join(lines, "\n"), nil
+}
+
+// runDiffSinceWrite diffs the agent's last write to a file against what is
+// on disk now, exposing edits made outside the agent.
+func runDiffSinceWrite(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	path := getString(input, "path")
+	abs, err := safePath(cfg.WorkDir, path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(cfg.WorkDir, abs)
+	if err != nil {
+		rel = abs
+	}
+	written, ok := lastWrites.Last(abs)
+	if !ok {
+		return "", fmt.Errorf("no write to %s recorded in this session", rel)
+	}
+	data, err := os.ReadFile(abs)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Sprintf("%s was deleted since the last write", rel), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	diff := unifiedDiff(rel+" (last write)", rel+" (on disk)", written, string(data))
+	if diff == "" {
+		return "no external changes", nil
+	}
+	return diff, nil
+}
 
-	// Handle different URL formats
-	if strings.HasSuffix(baseURL, "#") {
-		// # suffix: use the URL as-is (remove #)
-		endpoint = strings.TrimSuffix(baseURL, "#")
-	} else if strings.HasSuffix(baseURL, "/v1") {
-		// Base URL already ends with /v1: append /chat/completions
-		endpoint = baseURL + "/chat/completions"
-	} else if strings.HasSuffix(baseURL, "/") {
-		// / suffix: append chat/completions directly (ignore v1)
-		endpoint = baseURL + "chat/completions"
+// diffOp is one line of a line diff: ' ' kept, '-' removed, '+' added.
+type diffOp struct {
+	kind byte
+	text string
+}
+
+// unifiedDiff renders a unified diff between two texts, or "" if they are equal.
+func unifiedDiff(oldName, newName, oldText, newText string) string {
+	if oldText == newText {
+		return ""
+	}
+	ops := diffLines(splitDiffLines(oldText), splitDiffLines(newText))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", oldName, newName)
+
+	// oldAt[i]/newAt[i] count the lines consumed before ops[i]
+	oldAt := make([]int, len(ops)+1)
+	newAt := make([]int, len(ops)+1)
+	changed := false
+	for i, op := range ops {
+		oldAt[i+1], newAt[i+1] = oldAt[i], newAt[i]
+		if op.kind != '+' {
+			oldAt[i+1]++
+		}
+		if op.kind != '-' {
+			newAt[i+1]++
+		}
+		changed = changed || op.kind != ' '
+	}
+	if !changed {
+		b.WriteString("(only the trailing newline differs)\n")
+		return b.String()
+	}
+
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		// Merge changes separated by at most two context spans
+		last := i
+		for j := i + 1; j < len(ops) && j <= last+2*diffContextLines; j++ {
+			if ops[j].kind != ' ' {
+				last = j
+			}
+		}
+		start := i - diffContextLines
+		if start < 0 {
+			start = 0
+		}
+		end := last + diffContextLines + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+		oldCount, newCount := oldAt[end]-oldAt[start], newAt[end]-newAt[start]
+		fmt.Fprintf(&b, "@@ -%d,%d +%d,%d @@\n",
+			hunkStart(oldAt[start], oldCount), oldCount, hunkStart(newAt[start], newCount), newCount)
+		for _, op := range ops[start:end] {
+			b.WriteByte(op.kind)
+			b.WriteString(op.text)
+			b.WriteByte('\n')
+		}
+		i = end
+	}
+	return b.String()
+}
+
+// hunkStart is the 1-based first line of a hunk; empty ranges name the line before.
+func hunkStart(consumed, count int) int {
+	if count == 0 {
+		return consumed
+	}
+	return consumed + 1
+}
+
+func splitDiffLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// diffLines computes a line diff via longest common subsequence after
+// stripping the common prefix and suffix.
+func diffLines(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(ma)*len(mb) > maxDiffCells {
+		for _, line := range ma {
+			ops = append(ops, diffOp{'-', line})
+		}
+		for _, line := range mb {
+			ops = append(ops, diffOp{'+', line})
+		}
 	} else {
-		// Default: append /v1/chat/completions
-		endpoint = baseURL + "/v1/chat/completions"
+		// lcs[i][j] is the LCS length of ma[i:] and mb[j:]
+		lcs := make([][]int, len(ma)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(mb)+1)
+		}
+		for i := len(ma) - 1; i >= 0; i-- {
+			for j := len(mb) - 1; j >= 0; j-- {
+				switch {
+				case ma[i] == mb[j]:
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				case lcs[i+1][j] >= lcs[i][j+1]:
+					lcs[i][j] = lcs[i+1][j]
+				default:
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(ma) && j < len(mb) {
+			switch {
+			case ma[i] == mb[j]:
+				ops = append(ops, diffOp{' ', ma[i]})
+				i++
+				j++
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				ops = append(ops, diffOp{'-', ma[i]})
+				i++
+			default:
+				ops = append(ops, diffOp{'+', mb[j]})
+				j++
+			}
+		}
+		for ; i < len(ma); i++ {
+			ops = append(ops, diffOp{'-', ma[i]})
+		}
+		for ; j < len(mb); j++ {
+			ops = append(ops, diffOp{'+', mb[j]})
+		}
+	}
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
 	}
+	return ops
+}
 
-	// Log request URL (only if DEBUG=true)
-	if cfg.Debug {
-		fmt.Fprintf(os.Stderr, "\n[DEBUG] Request URL: %s\n", endpoint)
+// runGrep searches file contents under the workspace for a regex and lists
+// matches as "file:line: text". path may name a file or directory, or be a
+// glob matched against workspace-relative paths (and base names).
+func runGrep(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	pattern := getString(input, "pattern")
+	if pattern == "" {
+		return "", errors.New("grep.pattern required")
+	}
+	if getBool(input, "ignore_case") {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", fmt.Errorf("invalid pattern: %v", err)
+	}
+	limit := getIntOrDefault(input, "max_results", defaultGrepResults)
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > maxGrepResults {
+		limit = maxGrepResults
 	}
 
-	body := map[string]interface{}{
-		"model":      cfg.Model,
-		"messages":   messages,
-		"tools":      toolDefinitions(),
-		"max_tokens": cfg.MaxResult,
-		"stream":     cfg.Stream,
+	root, glob := cfg.WorkDir, ""
+	if p := strings.TrimSpace(getString(input, "path")); p != "" {
+		if strings.ContainsAny(p, "*?[") {
+			glob = filepath.ToSlash(p)
+		} else if root, err = safePath(cfg.WorkDir, p); err != nil {
+			return "", err
+		}
 	}
-	payload, err := json.Marshal(body)
+
+	// A single walker hands files out in walk order and workers scan them
+	// concurrently. Walking stops once max_results matches are in, and every
+	// file handed out is scanned in full, so collecting the results in walk
+	// order gives the same output as a serial scan.
+	type grepJob struct {
+		seq       int
+		path, rel string
+	}
+	jobs := make(chan grepJob)
+	var found int64
+	var mu sync.Mutex
+	perFile := make(map[int][]string)
+	skippedAt := []int{}
+	var wg sync.WaitGroup
+	for w := 0; w < max(cfg.SearchWorkers, 1); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				data, err := os.ReadFile(job.path)
+				if err != nil || isBinary(data) {
+					continue
+				}
+				var hits []string
+				for i, line := range strings.Split(string(data), "\n") {
+					if !re.MatchString(line) {
+						continue
+					}
+					hits = append(hits, fmt.Sprintf("%s:%d: %s", job.rel, i+1, clampText(strings.TrimRight(line, "\r"), maxGrepLineChars)))
+					if len(hits) >= limit {
+						break
+					}
+				}
+				if len(hits) > 0 {
+					mu.Lock()
+					perFile[job.seq] = hits
+					mu.Unlock()
+					atomic.AddInt64(&found, int64(len(hits)))
+				}
+			}
+		}()
+	}
+
+	seq := 0
+	errStop := errors.New("stop")
+	err = filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" || d.Name() == "node_modules" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if atomic.LoadInt64(&found) >= int64(limit) {
+			return errStop
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(cfg.WorkDir, path)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if glob != "" && !matchGlob(glob, rel) {
+			return nil
+		}
+		seq++
+		if info, err := d.Info(); err != nil || !info.Mode().IsRegular() || info.Size() > maxGrepFileBytes {
+			skippedAt = append(skippedAt, seq)
+			return nil
+		}
+		jobs <- grepJob{seq: seq, path: path, rel: rel}
+		return nil
+	})
+	close(jobs)
+	wg.Wait()
+	if err != nil && !errors.Is(err, errStop) {
+		return "", err
+	}
+
+	var matches []string
+	last := seq
+	for i := 1; i <= seq && len(matches) < limit; i++ {
+		matches = append(matches, perFile[i]...)
+		last = i
+	}
+	if len(matches) >= limit {
+		matches = matches[:limit]
+		err = errStop
+	} else {
+		err = nil
+	}
+	skipped := 0
+	for _, at := range skippedAt {
+		if at <= last {
+			skipped++
+		}
+	}
+
+	if len(matches) == 0 {
+		return "no matches", nil
+	}
+	out := strings.Join(matches, "\n")
+	if errors.Is(err, errStop) {
+		out += fmt.Sprintf("\n(stopped at max_results=%d; narrow the pattern or path to see more)", limit)
+	}
+	if skipped > 0 {
+		out += fmt.Sprintf("\n(%d files over %d bytes or not regular were skipped)", skipped, maxGrepFileBytes)
+	}
+	return clampToolResult("grep", input, out, cfg.MaxToolResultChars), nil
+}
+
+// runLogSearch reads only the end of a log file, at most lines lines within
+// the last max_bytes bytes, and returns the lines matching pattern. When
+// more lines match than max_results, the most recent ones are kept.
+func runLogSearch(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	path := getString(input, "path")
+	abs, err := safePath(cfg.WorkDir, path)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	pattern := getString(input, "pattern")
+	if pattern == "" {
+		pattern = "."
+	}
+	if len(pattern) > maxLogPatternLen {
+		return "", fmt.Errorf("log_search.pattern is longer than %d characters", maxLogPatternLen)
+	}
+	if getBool(input, "ignore_case") {
+		pattern = "(?i)" + pattern
 	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", fmt.Errorf("invalid pattern: %v", err)
+	}
+	lines := clampInt(getIntOrDefault(input, "lines", defaultLogLines), 1, maxLogLines)
+	window := int64(clampInt(getIntOrDefault(input, "max_bytes", defaultLogBytes), 1, maxLogBytes))
+	limit := clampInt(getIntOrDefault(input, "max_results", defaultGrepResults), 1, maxGrepResults)
 
-	// Log request payload (only if DEBUG=true)
-	if cfg.Debug {
-		var prettyPayload bytes.Buffer
-		if err := json.Indent(&prettyPayload, payload, "", "  "); err == nil {
-			fmt.Fprintf(os.Stderr, "[DEBUG] Request Payload:\n%s\n", prettyPayload.String())
+	f, err := os.Open(abs)
+	if err != nil {
+		return "", notFoundError(cfg, path, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", path)
+	}
+	start := info.Size() - window
+	if start < 0 {
+		start = 0
+	}
+	data, err := io.ReadAll(io.NewSectionReader(f, start, info.Size()-start))
+	if err != nil {
+		return "", err
+	}
+	// A window that starts mid-rune would otherwise look like invalid UTF-8
+	for i := 1; i < utf8.UTFMax && start > 0 && len(data) > 0 && !utf8.RuneStart(data[0]); i++ {
+		data = data[1:]
+		start++
+	}
+	if isBinary(data) {
+		return "", fmt.Errorf("refusing to search binary file %s", path)
+	}
+	text := strings.TrimSuffix(string(data), "\n")
+	if start > 0 {
+		// The window likely starts mid-line
+		if i := strings.IndexByte(text, '\n'); i >= 0 {
+			text = text[i+1:]
+		}
+	}
+	all := strings.Split(text, "\n")
+	if len(all) > lines {
+		all = all[len(all)-lines:]
+	}
+
+	// RE2 matches in linear time, but a huge window can still take a while
+	deadline := time.Now().Add(logSearchTimeout)
+	var matches []string
+	total, timedOut := 0, false
+	for i, line := range all {
+		if i%1000 == 0 && time.Now().After(deadline) {
+			timedOut = true
+			break
+		}
+		if i%1000 == 0 && ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if !re.MatchString(line) {
+			continue
+		}
+		total++
+		matches = append(matches, fmt.Sprintf("-%d: %s", len(all)-i, clampText(strings.TrimRight(line, "\r"), maxGrepLineChars)))
+		if len(matches) > limit {
+			matches = matches[1:]
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d matching line(s) in the last %d lines of %s (bytes %d-%d of %d; -N is N lines from the end)", total, len(all), path, start, info.Size(), info.Size())
+	if total > len(matches) {
+		fmt.Fprintf(&b, ", showing the last %d", len(matches))
+	}
+	b.WriteString("\n")
+	for _, m := range matches {
+		b.WriteString(m + "\n")
+	}
+	if timedOut {
+		fmt.Fprintf(&b, "(stopped after %s; search fewer lines or a simpler pattern)\n", logSearchTimeout)
+	}
+	return clampToolResult("log_search", input, strings.TrimSuffix(b.String(), "\n"), cfg.MaxToolResultChars), nil
+}
+
+// clampInt limits n to [lo, hi].
+func clampInt(n, lo, hi int) int {
+	if n < lo {
+		return lo
+	}
+	if n > hi {
+		return hi
+	}
+	return n
+}
+
+// matchGlob matches a slash-separated relative path against a glob, trying
+// the base name too so "*.go" finds Go files in every directory.
+func matchGlob(glob, rel string) bool {
+	if globMatch(glob, rel) {
+		return true
+	}
+	if !strings.Contains(glob, "/") {
+		return globMatch(glob, path.Base(rel))
+	}
+	return false
+}
+
+// globMatch reports whether a slash-separated path matches a doublestar
+// pattern: "**" spans any number of directories, {a,b} lists alternatives,
+// and other segments use path.Match syntax.
+func globMatch(pattern, name string) bool {
+	parts := strings.Split(name, "/")
+	for _, alt := range expandBraces(pattern) {
+		if matchGlobSegments(strings.Split(alt, "/"), parts) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchGlobSegments(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			for len(rest) > 0 && rest[0] == "**" {
+				rest = rest[1:]
+			}
+			for i := 0; i <= len(parts); i++ {
+				if matchGlobSegments(rest, parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], parts[0]); !ok {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
+
+// expandBraces expands the {a,b} alternatives in a glob, including nested ones.
+func expandBraces(pattern string) []string {
+	open := strings.IndexByte(pattern, '{')
+	if open < 0 {
+		return []string{pattern}
+	}
+	depth, start := 0, open+1
+	var alts []string
+	for i := open; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '{':
+			depth++
+		case ',':
+			if depth == 1 {
+				alts = append(alts, pattern[start:i])
+				start = i + 1
+			}
+		case '}':
+			depth--
+			if depth == 0 {
+				alts = append(alts, pattern[start:i])
+				var out []string
+				for _, alt := range alts {
+					out = append(out, expandBraces(pattern[:open]+alt+pattern[i+1:])...)
+				}
+				return out
+			}
 		}
 	}
+	// Unbalanced braces are matched literally
+	return []string{pattern}
+}
 
-	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(payload))
+// runListDir prints the tree under a directory down to max_depth, with
+// directories marked by a trailing slash and file sizes in parentheses.
+func runListDir(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	root := cfg.WorkDir
+	if p := strings.TrimSpace(getString(input, "path")); p != "" {
+		var err error
+		if root, err = safePath(cfg.WorkDir, p); err != nil {
+			return "", err
+		}
+	}
+	info, err := os.Stat(root)
 	if err != nil {
-		return nil, err
+		return "", notFoundError(cfg, getString(input, "path"), err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is a file, not a directory", getString(input, "path"))
+	}
+	depth := getIntOrDefault(input, "max_depth", defaultListDepth)
+	if depth < 1 {
+		depth = 1
+	}
+	if depth > maxListDepth {
+		depth = maxListDepth
+	}
+	limit := getIntOrDefault(input, "max_entries", defaultListEntries)
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > maxListEntries {
+		limit = maxListEntries
 	}
+	includeIgnored := getBool(input, "include_ignored")
 
-	// OpenAI uses Bearer token
-	req.Header.Set("Authorization", "Bearer "+cfg.APIKey)
-	req.Header.Set("Content-Type", "application/json")
+	var lines []string
+	truncated := false
+	var walk func(dir string, level int)
+	walk = func(dir string, level int) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			lines = append(lines, fmt.Sprintf("%s(unreadable: %v)", strings.Repeat("  ", level), err))
+			return
+		}
+		for _, entry := range entries {
+			if len(lines) >= limit {
+				truncated = true
+				return
+			}
+			indent := strings.Repeat("  ", level)
+			name := entry.Name()
+			if entry.IsDir() {
+				if !includeIgnored && (name == ".git" || name == "node_modules") {
+					lines = append(lines, fmt.Sprintf("%s%s/ (skipped)", indent, name))
+					continue
+				}
+				lines = append(lines, indent+name+"/")
+				if level+1 < depth {
+					walk(filepath.Join(dir, name), level+1)
+				}
+				continue
+			}
+			if info, err := entry.Info(); err == nil && info.Mode().IsRegular() {
+				lines = append(lines, fmt.Sprintf("%s%s (%s)", indent, name, formatSize(info.Size())))
+			} else {
+				lines = append(lines, indent+name)
+			}
+		}
+	}
+	walk(root, 0)
 
-	// Log request headers (only if DEBUG=true)
-	if cfg.Debug {
-		fmt.Fprintf(os.Stderr, "[DEBUG] Request Headers:\n")
-		for key, values := range req.Header {
-			for _, value := range values {
-				fmt.Fprintf(os.Stderr, "  %s: %s\n", key, value)
+	if len(lines) == 0 {
+		return "(empty directory)", nil
+	}
+	out := strings.Join(lines, "\n")
+	if truncated {
+		out += fmt.Sprintf("\n(stopped at max_entries=%d; list a subdirectory or lower max_depth)", limit)
+	}
+	return out, nil
+}
+
+// formatSize renders a byte count as B, KB or MB.
+func formatSize(n int64) string {
+	switch {
+	case n < 1024:
+		return fmt.Sprintf("%d B", n)
+	case n < 1024*1024:
+		return fmt.Sprintf("%.1f KB", float64(n)/1024)
+	default:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1024*1024))
+	}
+}
+
+// runGlob lists files under the workspace (or path) whose relative path
+// matches a doublestar pattern, sorted and capped at max_results.
+func runGlob(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	pattern := strings.TrimPrefix(filepath.ToSlash(strings.TrimSpace(getString(input, "pattern"))), "./")
+	if pattern == "" {
+		return "", errors.New("glob.pattern required")
+	}
+	if _, err := path.Match(strings.ReplaceAll(pattern, "**", "*"), ""); err != nil {
+		return "", fmt.Errorf("invalid pattern: %v", err)
+	}
+	limit := getIntOrDefault(input, "max_results", defaultGlobResults)
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > maxGlobResults {
+		limit = maxGlobResults
+	}
+	root := cfg.WorkDir
+	if p := strings.TrimSpace(getString(input, "path")); p != "" {
+		var err error
+		if root, err = safePath(cfg.WorkDir, p); err != nil {
+			return "", err
+		}
+	}
+
+	// Directories are read in parallel, so the walk can't stop at the first
+	// max_results matches without depending on timing; instead the
+	// lexically smallest ones are kept, which is also what a serial walk
+	// followed by sorting shows.
+	var mu sync.Mutex
+	var files []string
+	total := 0
+	walkParallel(root, cfg.SearchWorkers, map[string]bool{".git": true}, func(p string, d os.DirEntry) {
+		rel, err := filepath.Rel(root, p)
+		if err != nil || !globMatch(pattern, filepath.ToSlash(rel)) {
+			return
+		}
+		if rel, err = filepath.Rel(cfg.WorkDir, p); err != nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		total++
+		files = append(files, filepath.ToSlash(rel))
+		if len(files) >= 2*limit {
+			sort.Strings(files)
+			files = files[:limit]
+		}
+	})
+
+	if len(files) == 0 {
+		return "no files match " + pattern, nil
+	}
+	sort.Strings(files)
+	if total > limit {
+		files = files[:limit]
+		return strings.Join(files, "\n") + fmt.Sprintf("\n(%d files match; showing the first %d by max_results; use a narrower pattern or path)", total, limit), nil
+	}
+	return strings.Join(files, "\n"), nil
+}
+
+// walkParallel calls visit for every non-directory entry under root, with
+// up to workers directories read at once; visit may run concurrently.
+// Directories whose names are in skip are not entered, and symlinks to
+// directories are visited rather than followed, as with filepath.WalkDir.
+func walkParallel(root string, workers int, skip map[string]bool, visit func(path string, d os.DirEntry)) {
+	info, err := os.Lstat(root)
+	if err != nil {
+		return
+	}
+	if !info.IsDir() {
+		visit(root, fs.FileInfoToDirEntry(info))
+		return
+	}
+
+	var mu sync.Mutex
+	cond := sync.NewCond(&mu)
+	pending := []string{root}
+	active := 0
+	var wg sync.WaitGroup
+	for w := 0; w < max(workers, 1); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				for len(pending) == 0 && active > 0 {
+					cond.Wait()
+				}
+				if len(pending) == 0 {
+					// Nothing queued and nobody left to queue more
+					mu.Unlock()
+					cond.Broadcast()
+					return
+				}
+				dir := pending[len(pending)-1]
+				pending = pending[:len(pending)-1]
+				active++
+				mu.Unlock()
+
+				entries, _ := os.ReadDir(dir)
+				var subdirs []string
+				for _, e := range entries {
+					p := filepath.Join(dir, e.Name())
+					if e.IsDir() {
+						if !skip[e.Name()] {
+							subdirs = append(subdirs, p)
+						}
+						continue
+					}
+					visit(p, e)
+				}
+
+				mu.Lock()
+				pending = append(pending, subdirs...)
+				active--
+				mu.Unlock()
+				cond.Broadcast()
 			}
+		}()
+	}
+	wg.Wait()
+}
+
+// runListTools describes the tools offered to the model, straight from
+// toolDefinitions so it can't drift from what is actually sent.
+func runListTools(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	only := strings.TrimSpace(getString(input, "name"))
+	var sections []string
+	var names []string
+	for _, def := range toolDefinitions(cfg) {
+		fn, _ := def["function"].(map[string]interface{})
+		name, _ := fn["name"].(string)
+		names = append(names, name)
+		if only != "" && name != only {
+			continue
+		}
+		schema, err := json.Marshal(fn["parameters"])
+		if err != nil {
+			return "", err
+		}
+		sections = append(sections, fmt.Sprintf("%s: %s\n  parameters: %s", name, fn["description"], schema))
+	}
+	if len(sections) == 0 {
+		return "", fmt.Errorf("unknown tool %q; available: %s", only, strings.Join(names, ", "))
+	}
+	return strings.Join(sections, "\n\n"), nil
+}
+
+// runQueryData evaluates a dotted path (with [n] indices and * wildcards)
+// against a JSON or YAML file and returns only the matched values.
+func runQueryData(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	path := getString(input, "path")
+	abs, err := safePath(cfg.WorkDir, path)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", notFoundError(cfg, path, err)
+	}
+	if info.Size() > maxDataFileBytes {
+		return "", fmt.Errorf("%s is %d bytes; query_data parses files up to %d bytes", path, info.Size(), maxDataFileBytes)
+	}
+	data, err := os.ReadFile(abs)
+	if err != nil {
+		return "", err
+	}
+
+	format := strings.ToLower(getString(input, "format"))
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(abs)) {
+		case ".yaml", ".yml":
+			format = "yaml"
+		default:
+			format = "json"
+		}
+	}
+
+	var root interface{}
+	switch format {
+	case "json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&root); err != nil {
+			return "", fmt.Errorf("parse %s as JSON: %v", path, err)
 		}
-		fmt.Fprintf(os.Stderr, "\n")
+	case "yaml":
+		if err := yaml.Unmarshal(data, &root); err != nil {
+			return "", fmt.Errorf("parse %s as YAML: %v", path, err)
+		}
+		root = normalizeYAML(root)
+	default:
+		return "", fmt.Errorf("unsupported query_data.format: %s", format)
 	}
 
-	client := &http.Client{Timeout: 60 * time.Second}
-	resp, err := client.Do(req)
+	expr := getString(input, "query")
+	segments, err := parseDataPath(expr)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	matches := evalDataPath(root, segments)
+	if len(matches) == 0 {
+		return "", fmt.Errorf("query %q matched nothing in %s", expr, path)
 	}
-	defer resp.Body.Close()
 
-	// Handle streaming response
-	if cfg.Stream {
-		return handleStreamingResponse(cfg, resp)
+	if len(matches) == 1 && !hasWildcard(segments) {
+		return clampText(formatDataValue(matches[0].value), cfg.MaxToolResultChars), nil
 	}
+	lines := make([]string, 0, len(matches)+1)
+	lines = append(lines, fmt.Sprintf("%d matches:", len(matches)))
+	for _, m := range matches {
+		lines = append(lines, fmt.Sprintf("%s = %s", m.path, formatDataValue(m.value)))
+	}
+	return clampText(strings.Join(lines, "\n"), cfg.MaxToolResultChars), nil
+}
 
-	// Handle non-streaming response
-	return handleNonStreamingResponse(cfg, resp)
+// dataSegment is one step of a query_data path: a key, an index or a wildcard.
+type dataSegment struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
 }
 
-func dispatchToolCall(cfg Config, tc ToolCall) Message {
-	// 解析 arguments
-	var input map[string]interface{}
-	if err := json.Unmarshal([]byte(tc.Function.Arguments), &input); err != nil {
-		return Message{
-			Role:       "tool",
-			ToolCallID: tc.ID,
-			Name:       tc.Function.Name,
-			Content:    fmt.Sprintf("Error parsing arguments: %v", err),
+type dataMatch struct {
+	path  string
+	value interface{}
+}
+
+// parseDataPath parses expressions like "$.items[0].name", "spec.ports[*]"
+// or `data["dotted.key"]`. An empty path or "$" selects the whole document.
+func parseDataPath(expr string) ([]dataSegment, error) {
+	expr = strings.TrimSpace(expr)
+	expr = strings.TrimPrefix(expr, "$")
+	var segments []dataSegment
+	for i := 0; i < len(expr); {
+		switch expr[i] {
+		case '.':
+			i++
+		case '[':
+			end := strings.IndexByte(expr[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid query %q: unclosed [", expr)
+			}
+			inner := strings.TrimSpace(expr[i+1 : i+end])
+			i += end + 1
+			switch {
+			case inner == "*":
+				segments = append(segments, dataSegment{wildcard: true})
+			case len(inner) >= 2 && (inner[0] == '"' || inner[0] == '\'') && inner[len(inner)-1] == inner[0]:
+				segments = append(segments, dataSegment{key: inner[1 : len(inner)-1]})
+			default:
+				n, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("invalid query %q: index %q is not an integer", expr, inner)
+				}
+				segments = append(segments, dataSegment{index: n, isIndex: true})
+			}
+		default:
+			end := strings.IndexAny(expr[i:], ".[")
+			if end < 0 {
+				end = len(expr) - i
+			}
+			key := expr[i : i+end]
+			i += end
+			if key == "*" {
+				segments = append(segments, dataSegment{wildcard: true})
+			} else {
+				segments = append(segments, dataSegment{key: key})
+			}
 		}
 	}
+	return segments, nil
+}
 
-	// Display tool call with appropriate formatting
-	var displayText string
-	switch tc.Function.Name {
-	case "TodoWrite":
-		displayText = "updating todos"
-	default:
-		displayText = fmt.Sprintf("%v", input)
+func evalDataPath(root interface{}, segments []dataSegment) []dataMatch {
+	current := []dataMatch{{path: "$", value: root}}
+	for _, seg := range segments {
+		var next []dataMatch
+		for _, m := range current {
+			switch v := m.value.(type) {
+			case map[string]interface{}:
+				if seg.wildcard {
+					keys := make([]string, 0, len(v))
+					for k := range v {
+						keys = append(keys, k)
+					}
+					sort.Strings(keys)
+					for _, k := range keys {
+						next = append(next, dataMatch{path: m.path + "." + k, value: v[k]})
+					}
+				} else if !seg.isIndex {
+					if child, ok := v[seg.key]; ok {
+						next = append(next, dataMatch{path: m.path + "." + seg.key, value: child})
+					}
+				}
+			case []interface{}:
+				if seg.wildcard {
+					for i, child := range v {
+						next = append(next, dataMatch{path: fmt.Sprintf("%s[%d]", m.path, i), value: child})
+					}
+				} else if seg.isIndex {
+					idx := seg.index
+					if idx < 0 {
+						idx += len(v)
+					}
+					if idx >= 0 && idx < len(v) {
+						next = append(next, dataMatch{path: fmt.Sprintf("%s[%d]", m.path, idx), value: v[idx]})
+					}
+				}
+			}
+		}
+		current = next
 	}
-	prettyToolLine(tc.Function.Name, displayText)
+	return current
+}
 
-	var result string
-	var err error
+func hasWildcard(segments []dataSegment) bool {
+	for _, seg := range segments {
+		if seg.wildcard {
+			return true
+		}
+	}
+	return false
+}
 
-	switch tc.Function.Name {
-	case "bash":
-		result, err = runBash(cfg, input)
-	case "read_file":
-		result, err = runRead(cfg, input)
-	case "write_file":
-		result, err = runWrite(cfg, input)
-	case "edit_text":
-		result, err = runEdit(cfg, input)
-	case "TodoWrite":
-		result, err = runTodoUpdate(cfg, input)
-	default:
-		err = fmt.Errorf("unknown tool: %s", tc.Function.Name)
+// normalizeYAML converts map[interface{}]interface{} nodes (YAML maps with
+// non-string keys) into JSON-compatible map[string]interface{}.
+func normalizeYAML(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			val[k] = normalizeYAML(child)
+		}
+		return val
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, child := range val {
+			out[fmt.Sprintf("%v", k)] = normalizeYAML(child)
+		}
+		return out
+	case []interface{}:
+		for i, child := range val {
+			val[i] = normalizeYAML(child)
+		}
+		return val
+	}
+	return v
+}
+
+func formatDataValue(v interface{}) string {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Sprintf("%v", v)
 	}
+	return string(data)
+}
 
+// runCompute evaluates a small arithmetic/string/path expression without a
+// shell. The grammar has no variables, assignments or I/O.
+func runCompute(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	expr := strings.TrimSpace(getString(input, "expression"))
+	if expr == "" {
+		return "", errors.New("missing compute.expression")
+	}
+	if len(expr) > maxComputeExprLen {
+		return "", fmt.Errorf("expression is limited to %d characters", maxComputeExprLen)
+	}
+	tokens, err := tokenizeExpr(expr)
 	if err != nil {
-		result = err.Error()
+		return "", err
 	}
+	p := &exprParser{tokens: tokens}
+	val, err := p.parseExpr(0)
+	if err != nil {
+		return "", err
+	}
+	if p.pos < len(p.tokens) {
+		return "", fmt.Errorf("unexpected %q at position %d", p.tokens[p.pos].text, p.tokens[p.pos].at)
+	}
+	return val.String(), nil
+}
 
-	prettySubLine(clampText(result, 2000))
+// exprValue is a compute result: a number or a string.
+type exprValue struct {
+	num   float64
+	str   string
+	isStr bool
+}
 
-	return Message{
-		Role:       "tool",
-		ToolCallID: tc.ID,
-		Name:       tc.Function.Name,
-		Content:    clampText(result, cfg.MaxResult),
+func (v exprValue) String() string {
+	if v.isStr {
+		return v.str
 	}
+	return strconv.FormatFloat(v.num, 'f', -1, 64)
 }
 
-func runBash(cfg Config, input map[string]interface{}) (string, error) {
-	command := strings.TrimSpace(getString(input, "command"))
-	if command == "" {
-		return "", errors.New("missing bash.command")
-	}
-	if isDangerousCommand(command) {
-		return "", errors.New("blocked dangerous command")
+type exprToken struct {
+	kind string // num | str | ident | op
+	text string
+	num  float64
+	at   int
+}
+
+func tokenizeExpr(src string) ([]exprToken, error) {
+	var tokens []exprToken
+	runes := []rune(src)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case r == ' ' || r == '\t' || r == '\n':
+			i++
+		case (r >= '0' && r <= '9') || (r == '.' && i+1 < len(runes) && runes[i+1] >= '0' && runes[i+1] <= '9'):
+			start := i
+			for i < len(runes) && ((runes[i] >= '0' && runes[i] <= '9') || runes[i] == '.') {
+				i++
+			}
+			if i < len(runes) && (runes[i] == 'e' || runes[i] == 'E') {
+				j := i + 1
+				if j < len(runes) && (runes[j] == '+' || runes[j] == '-') {
+					j++
+				}
+				if j < len(runes) && runes[j] >= '0' && runes[j] <= '9' {
+					i = j
+					for i < len(runes) && runes[i] >= '0' && runes[i] <= '9' {
+						i++
+					}
+				}
+			}
+			text := string(runes[start:i])
+			num, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at position %d", text, start)
+			}
+			tokens = append(tokens, exprToken{kind: "num", text: text, num: num, at: start})
+		case r == '"' || r == '\'':
+			start := i
+			var sb strings.Builder
+			i++
+			for i < len(runes) && runes[i] != r {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+					switch runes[i] {
+					case 'n':
+						sb.WriteRune('\n')
+					case 't':
+						sb.WriteRune('\t')
+					default:
+						sb.WriteRune(runes[i])
+					}
+				} else {
+					sb.WriteRune(runes[i])
+				}
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			i++
+			tokens = append(tokens, exprToken{kind: "str", text: sb.String(), at: start})
+		case r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z'):
+			start := i
+			for i < len(runes) && (runes[i] == '_' || (runes[i] >= 'a' && runes[i] <= 'z') || (runes[i] >= 'A' && runes[i] <= 'Z') || (runes[i] >= '0' && runes[i] <= '9')) {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: "ident", text: string(runes[start:i]), at: start})
+		case strings.ContainsRune("+-*/%(),", r):
+			tokens = append(tokens, exprToken{kind: "op", text: string(r), at: i})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", r, i)
+		}
 	}
-	timeout := getIntOrDefault(input, "timeout_ms", 30000)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Millisecond)
-	defer cancel()
+	return tokens, nil
+}
 
-	cmd := exec.CommandContext(ctx, "bash", "-lc", command)
-	cmd.Dir = cfg.WorkDir
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+// exprParser is a recursive-descent parser that evaluates as it parses:
+//
+//	expr    := term (("+" | "-") term)*
+//	term    := unary (("*" | "/" | "%") unary)*
+//	unary   := "-" unary | primary
+//	primary := number | string | pi | e | name "(" [expr ("," expr)*] ")" | "(" expr ")"
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
 
-	err := cmd.Run()
-	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
-		return "(timeout)", nil
+func (p *exprParser) peekOp(ops string) (string, bool) {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == "op" && strings.Contains(ops, p.tokens[p.pos].text) {
+		return p.tokens[p.pos].text, true
 	}
-	output := strings.TrimSpace(strings.Join([]string{stdout.String(), stderr.String()}, "\n"))
-	if output == "" {
-		output = "(no output)"
+	return "", false
+}
+
+func (p *exprParser) expectOp(op string) error {
+	if _, ok := p.peekOp(op); !ok {
+		if p.pos >= len(p.tokens) {
+			return fmt.Errorf("expected %q at end of expression", op)
+		}
+		return fmt.Errorf("expected %q at position %d", op, p.tokens[p.pos].at)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *exprParser) parseExpr(depth int) (exprValue, error) {
+	if depth > maxComputeDepth {
+		return exprValue{}, errors.New("expression is nested too deeply")
 	}
+	left, err := p.parseTerm(depth)
 	if err != nil {
-		if _, ok := err.(*exec.ExitError); ok {
-			output = fmt.Sprintf("%s\n(exit error: %v)", output, err)
-			err = nil
+		return left, err
+	}
+	for {
+		op, ok := p.peekOp("+-")
+		if !ok {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseTerm(depth)
+		if err != nil {
+			return right, err
+		}
+		if op == "+" && (left.isStr || right.isStr) {
+			left = exprValue{str: left.String() + right.String(), isStr: true}
+			if len(left.str) > maxComputeString {
+				return exprValue{}, fmt.Errorf("string result exceeds %d characters", maxComputeString)
+			}
+			continue
+		}
+		if left.isStr || right.isStr {
+			return exprValue{}, fmt.Errorf("operator %s needs numbers", op)
+		}
+		if op == "+" {
+			left.num += right.num
+		} else {
+			left.num -= right.num
 		}
 	}
-	return clampText(output, maxToolResultChars), err
 }
 
-func runRead(cfg Config, input map[string]interface{}) (string, error) {
-	path := getString(input, "path")
-	abs, err := safePath(cfg.WorkDir, path)
+func (p *exprParser) parseTerm(depth int) (exprValue, error) {
+	left, err := p.parseUnary(depth)
 	if err != nil {
-		return "", err
+		return left, err
 	}
-	data, err := os.ReadFile(abs)
-	if err != nil {
-		return "", err
+	for {
+		op, ok := p.peekOp("*/%")
+		if !ok {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseUnary(depth)
+		if err != nil {
+			return right, err
+		}
+		if left.isStr || right.isStr {
+			return exprValue{}, fmt.Errorf("operator %s needs numbers", op)
+		}
+		switch op {
+		case "*":
+			left.num *= right.num
+		case "/":
+			if right.num == 0 {
+				return exprValue{}, errors.New("division by zero")
+			}
+			left.num /= right.num
+		case "%":
+			if right.num == 0 {
+				return exprValue{}, errors.New("division by zero")
+			}
+			left.num = math.Mod(left.num, right.num)
+		}
 	}
-	text := string(data)
-	lines := strings.Split(text, "\n")
+}
 
-	start := 0
-	if val, ok := getOptionalInt(input, "start_line"); ok {
-		if val < 1 {
-			val = 1
+func (p *exprParser) parseUnary(depth int) (exprValue, error) {
+	if _, ok := p.peekOp("-"); ok {
+		p.pos++
+		val, err := p.parseUnary(depth + 1)
+		if err != nil {
+			return val, err
 		}
-		start = val - 1
-		if start > len(lines) {
-			start = len(lines)
+		if val.isStr {
+			return exprValue{}, errors.New("unary - needs a number")
 		}
+		val.num = -val.num
+		return val, nil
 	}
-	end := len(lines)
-	if val, ok := getOptionalInt(input, "end_line"); ok {
-		if val >= 0 {
-			if val < start {
-				end = start
-			} else if val > len(lines) {
-				end = len(lines)
-			} else {
-				end = val
+	return p.parsePrimary(depth)
+}
+
+func (p *exprParser) parsePrimary(depth int) (exprValue, error) {
+	if p.pos >= len(p.tokens) {
+		return exprValue{}, errors.New("unexpected end of expression")
+	}
+	tok := p.tokens[p.pos]
+	p.pos++
+	switch tok.kind {
+	case "num":
+		return exprValue{num: tok.num}, nil
+	case "str":
+		return exprValue{str: tok.text, isStr: true}, nil
+	case "op":
+		if tok.text == "(" {
+			val, err := p.parseExpr(depth + 1)
+			if err != nil {
+				return val, err
 			}
+			return val, p.expectOp(")")
 		}
+		return exprValue{}, fmt.Errorf("unexpected %q at position %d", tok.text, tok.at)
 	}
-	if start > end {
-		start = end
+
+	// Identifiers: constants or function calls
+	switch tok.text {
+	case "pi":
+		return exprValue{num: math.Pi}, nil
+	case "e":
+		return exprValue{num: math.E}, nil
 	}
-	sliced := strings.Join(lines[start:end], "\n")
-	maxChars := getIntOrDefault(input, "max_chars", maxToolResultChars)
-	return clampText(sliced, maxChars), nil
+	if err := p.expectOp("("); err != nil {
+		return exprValue{}, fmt.Errorf("unknown name %q", tok.text)
+	}
+	var args []exprValue
+	if _, ok := p.peekOp(")"); !ok {
+		for {
+			arg, err := p.parseExpr(depth + 1)
+			if err != nil {
+				return arg, err
+			}
+			args = append(args, arg)
+			if _, ok := p.peekOp(","); !ok {
+				break
+			}
+			p.pos++
+		}
+	}
+	if err := p.expectOp(")"); err != nil {
+		return exprValue{}, err
+	}
+	return callExprFunc(tok.text, args)
 }
 
-func runWrite(cfg Config, input map[string]interface{}) (string, error) {
-	path := getString(input, "path")
-	abs, err := safePath(cfg.WorkDir, path)
-	if err != nil {
-		return "", err
+// callExprFunc implements the compute builtins.
+func callExprFunc(name string, args []exprValue) (exprValue, error) {
+	nums := func(n int) ([]float64, error) {
+		if n >= 0 && len(args) != n {
+			return nil, fmt.Errorf("%s takes %d argument(s)", name, n)
+		}
+		out := make([]float64, len(args))
+		for i, a := range args {
+			if a.isStr {
+				return nil, fmt.Errorf("%s needs numeric arguments", name)
+			}
+			out[i] = a.num
+		}
+		return out, nil
 	}
-	content := getString(input, "content")
-	mode := strings.ToLower(getString(input, "mode"))
-	if err := os.MkdirAll(filepath.Dir(abs), 0o755); err != nil {
-		return "", err
+	strs := func(n int) ([]string, error) {
+		if n >= 0 && len(args) != n {
+			return nil, fmt.Errorf("%s takes %d argument(s)", name, n)
+		}
+		out := make([]string, len(args))
+		for i, a := range args {
+			out[i] = a.String()
+		}
+		return out, nil
 	}
-	if mode == "append" {
-		f, err := os.OpenFile(abs, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	num := func(v float64) (exprValue, error) {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return exprValue{}, fmt.Errorf("%s result is not a finite number", name)
+		}
+		return exprValue{num: v}, nil
+	}
+	str := func(s string) (exprValue, error) {
+		if len(s) > maxComputeString {
+			return exprValue{}, fmt.Errorf("string result exceeds %d characters", maxComputeString)
+		}
+		return exprValue{str: s, isStr: true}, nil
+	}
+
+	switch name {
+	case "abs", "sqrt", "floor", "ceil", "round", "log", "exp":
+		n, err := nums(1)
 		if err != nil {
-			return "", err
+			return exprValue{}, err
 		}
-		defer f.Close()
-		if _, err := f.WriteString(content); err != nil {
-			return "", err
+		fn := map[string]func(float64) float64{
+			"abs": math.Abs, "sqrt": math.Sqrt, "floor": math.Floor, "ceil": math.Ceil,
+			"round": math.Round, "log": math.Log, "exp": math.Exp,
+		}[name]
+		return num(fn(n[0]))
+	case "pow":
+		n, err := nums(2)
+		if err != nil {
+			return exprValue{}, err
 		}
-	} else {
-		if err := os.WriteFile(abs, []byte(content), 0o644); err != nil {
-			return "", err
+		return num(math.Pow(n[0], n[1]))
+	case "min", "max":
+		n, err := nums(-1)
+		if err != nil {
+			return exprValue{}, err
 		}
+		if len(n) == 0 {
+			return exprValue{}, fmt.Errorf("%s needs at least one argument", name)
+		}
+		best := n[0]
+		for _, v := range n[1:] {
+			if (name == "min" && v < best) || (name == "max" && v > best) {
+				best = v
+			}
+		}
+		return num(best)
+	case "len":
+		s, err := strs(1)
+		if err != nil {
+			return exprValue{}, err
+		}
+		return num(float64(len([]rune(s[0]))))
+	case "upper", "lower", "trim":
+		s, err := strs(1)
+		if err != nil {
+			return exprValue{}, err
+		}
+		fn := map[string]func(string) string{"upper": strings.ToUpper, "lower": strings.ToLower, "trim": strings.TrimSpace}[name]
+		return str(fn(s[0]))
+	case "replace":
+		s, err := strs(3)
+		if err != nil {
+			return exprValue{}, err
+		}
+		return str(strings.ReplaceAll(s[0], s[1], s[2]))
+	case "repeat":
+		if len(args) != 2 || args[1].isStr || args[1].num < 0 || args[1].num != math.Trunc(args[1].num) {
+			return exprValue{}, errors.New("repeat takes a string and a non-negative whole count")
+		}
+		n := args[1].num
+		// Checked before converting, since a huge count overflows int
+		if n > maxComputeString || float64(len(args[0].String()))*n > maxComputeString {
+			return exprValue{}, fmt.Errorf("string result exceeds %d characters", maxComputeString)
+		}
+		return str(strings.Repeat(args[0].String(), int(args[1].num)))
+	case "join":
+		s, err := strs(-1)
+		if err != nil {
+			return exprValue{}, err
+		}
+		return str(filepath.Join(s...))
+	case "base", "dir", "ext", "clean":
+		s, err := strs(1)
+		if err != nil {
+			return exprValue{}, err
+		}
+		fn := map[string]func(string) string{"base": filepath.Base, "dir": filepath.Dir, "ext": filepath.Ext, "clean": filepath.Clean}[name]
+		return str(fn(s[0]))
+	case "rel":
+		s, err := strs(2)
+		if err != nil {
+			return exprValue{}, err
+		}
+		rel, err := filepath.Rel(s[0], s[1])
+		if err != nil {
+			return exprValue{}, err
+		}
+		return str(rel)
 	}
-	bytesLen := len([]byte(content))
-	rel, err := filepath.Rel(cfg.WorkDir, abs)
-	if err != nil {
-		rel = abs
-	}
-	return fmt.Sprintf("wrote %d bytes to %s", bytesLen, rel), nil
+	return exprValue{}, fmt.Errorf("unknown function %q", name)
 }
 
-func runEdit(cfg Config, input map[string]interface{}) (string, error) {
-	path := getString(input, "path")
-	abs, err := safePath(cfg.WorkDir, path)
-	if err != nil {
-		return "", err
+// runGitFiles lists tracked, untracked and ignored files separately. Outside a
+// git work tree it falls back to a plain file listing.
+func runGitFiles(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
+	limit := getIntOrDefault(input, "max_entries", maxGitFilesEntries)
+	if limit <= 0 {
+		limit = maxGitFilesEntries
 	}
-	data, err := os.ReadFile(abs)
+
+	if _, err := gitOutput(ctx, cfg, "rev-parse", "--is-inside-work-tree"); err != nil {
+		files, err := listWorkspaceFiles(cfg.WorkDir, limit)
+		if err != nil {
+			return "", err
+		}
+		return clampToolResult("git_files", input, formatFileSection("files", files, limit)+
+			"\n\n(note: not a git repository; tracked/untracked/ignored status is unavailable)", cfg.MaxToolResultChars), nil
+	}
+
+	// Both listings use repo-root paths, NUL-separated so names aren't quoted
+	topOut, err := gitOutput(ctx, cfg, "rev-parse", "--show-toplevel")
 	if err != nil {
 		return "", err
 	}
-	text := string(data)
-	action := strings.ToLower(getString(input, "action"))
-	switch action {
-	case "replace":
-		findStr := getString(input, "find")
-		if findStr == "" {
-			return "", errors.New("edit_text.replace missing find")
+	top := filepath.FromSlash(strings.TrimSpace(topOut))
+	workDir := cfg.WorkDir
+	if real, err := filepath.EvalSymlinks(workDir); err == nil {
+		workDir = real
+	}
+	relToWork := func(p string) (string, bool) {
+		rel, err := filepath.Rel(workDir, filepath.Join(top, filepath.FromSlash(p)))
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", false
 		}
-		replaceStr := getString(input, "replace")
-		updated := strings.ReplaceAll(text, findStr, replaceStr)
-		if err := os.WriteFile(abs, []byte(updated), 0o644); err != nil {
-			return "", err
+		rel = filepath.ToSlash(rel)
+		if strings.HasSuffix(p, "/") {
+			rel += "/"
+		}
+		return rel, true
+	}
+
+	trackedOut, err := gitOutput(ctx, cfg, "ls-files", "-z", "--full-name")
+	if err != nil {
+		return "", err
+	}
+	statusOut, err := gitOutput(ctx, cfg, "status", "--porcelain", "-z", "--ignored", "--untracked-files=normal", "--", ".")
+	if err != nil {
+		return "", err
+	}
+
+	var tracked, untracked, ignored []string
+	for _, p := range strings.Split(trackedOut, "\x00") {
+		if rel, ok := relToWork(p); ok && p != "" {
+			tracked = append(tracked, rel)
 		}
-		return fmt.Sprintf("replace done (%d bytes)", len([]byte(updated))), nil
-	case "insert":
-		insertAfter := getIntOrDefault(input, "insert_after", -1)
-		newText := getString(input, "new_text")
-		lines := strings.Split(text, "\n")
-		idx := insertAfter
-		if idx < -1 {
-			idx = -1
+	}
+	entries := strings.Split(statusOut, "\x00")
+	for i := 0; i < len(entries); i++ {
+		entry := entries[i]
+		if len(entry) < 4 {
+			continue
 		}
-		if idx >= len(lines) {
-			idx = len(lines) - 1
+		if entry[0] == 'R' || entry[0] == 'C' {
+			i++ // the original path of a rename or copy follows
 		}
-		result := make([]string, 0, len(lines)+1)
-		if idx >= 0 {
-			result = append(result, lines[:idx+1]...)
-			result = append(result, newText)
-			result = append(result, lines[idx+1:]...)
-		} else {
-			result = append(result, newText)
-			result = append(result, lines...)
+		rel, ok := relToWork(entry[3:])
+		if !ok {
+			continue
 		}
-		updated := strings.Join(result, "\n")
-		if err := os.WriteFile(abs, []byte(updated), 0o644); err != nil {
-			return "", err
+		switch entry[:2] {
+		case "??":
+			untracked = append(untracked, rel)
+		case "!!":
+			ignored = append(ignored, rel)
 		}
-		return fmt.Sprintf("inserted after line %d", insertAfter), nil
-	case "delete_range":
-		rngRaw, ok := input["range"].([]interface{})
-		if !ok || len(rngRaw) != 2 {
-			return "", errors.New("edit_text.delete_range invalid range")
+	}
+
+	sections := []string{
+		formatFileSection("tracked", tracked, limit),
+		formatFileSection("untracked", untracked, limit),
+		formatFileSection("ignored", ignored, limit),
+	}
+	return clampToolResult("git_files", input, strings.Join(sections, "\n\n"), cfg.MaxToolResultChars), nil
+}
+
+func gitOutput(ctx context.Context, cfg Config, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = cfg.WorkDir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
 		}
-		start := toInt(rngRaw[0])
-		end := toInt(rngRaw[1])
-		if start < 0 || end < start {
-			return "", errors.New("edit_text.delete_range invalid range")
+		return "", err
+	}
+	return string(out), nil
+}
+
+// listWorkspaceFiles walks the workspace (skipping .git) and returns up to
+// limit+1 relative file paths, so callers can tell the list was cut short.
+func listWorkspaceFiles(workDir string, limit int) ([]string, error) {
+	var files []string
+	errStop := errors.New("stop")
+	err := filepath.WalkDir(workDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
 		}
-		lines := strings.Split(text, "\n")
-		if start > len(lines) {
-			start = len(lines)
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
 		}
-		if end > len(lines) {
-			end = len(lines)
+		rel, err := filepath.Rel(workDir, path)
+		if err != nil {
+			return nil
 		}
-		updated := strings.Join(append(append([]string{}, lines[:start]...), lines[end:]...), "\n")
-		if err := os.WriteFile(abs, []byte(updated), 0o644); err != nil {
-			return "", err
+		files = append(files, filepath.ToSlash(rel))
+		if len(files) > limit {
+			return errStop
 		}
-		return fmt.Sprintf("deleted lines [%d, %d)", start, end), nil
-	default:
-		return "", fmt.Errorf("unsupported edit_text.action: %s", action)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStop) {
+		return nil, err
+	}
+	return files, nil
+}
+
+func formatFileSection(title string, files []string, limit int) string {
+	header := fmt.Sprintf("%s (%d):", title, len(files))
+	if len(files) == 0 {
+		return header + "\n  (none)"
 	}
+	shown := files
+	if len(shown) > limit {
+		shown = shown[:limit]
+		header = fmt.Sprintf("%s (showing first %d):", title, limit)
+	}
+	return header + "\n  " + strings.Join(shown, "\n  ")
 }
 
-func runTodoUpdate(cfg Config, input map[string]interface{}) (string, error) {
+func runTodoUpdate(ctx context.Context, cfg Config, input map[string]interface{}) (string, error) {
 	itemsRaw, ok := input["items"]
 	if !ok {
 		return "", errors.New("missing items parameter")
@@ -789,13 +8127,18 @@ func runTodoUpdate(cfg Config, input map[string]interface{}) (string, error) {
 			Content:    content,
 			Status:     status,
 			ActiveForm: activeForm,
+			Priority:   getString(itemMap, "priority"),
 		})
 	}
 
-	boardView, err := todoBoard.Update(items)
+	boardView, err := todoBoard.Update(items, cfg.MaxTodoItems)
 	if err != nil {
 		return "", err
 	}
+	publishTodos()
+	if err := saveTodos(cfg); err != nil {
+		boardView += fmt.Sprintf("\n(warning: could not save %s: %v)", todosFile, err)
+	}
 
 	// Reset rounds counter
 	agentState.mu.Lock()
@@ -817,6 +8160,264 @@ func runTodoUpdate(cfg Config, input map[string]interface{}) (string, error) {
 	return boardView, nil
 }
 
+// capturePlan mirrors a numbered plan written in prose onto the todo board,
+// so models that narrate instead of calling TodoWrite are still tracked.
+func capturePlan(cfg Config, text string) {
+	if cfg.PlanCapture == "off" {
+		return
+	}
+	items := extractPlanItems(text, cfg.MaxTodoItems)
+	if len(items) < 2 {
+		return
+	}
+
+	// Never clobber a board the model is actively maintaining
+	stats := todoBoard.Stats()
+	if stats["total"] > stats["completed"] {
+		return
+	}
+
+	if cfg.PlanCapture == "ask" {
+		if !promptYesNo(fmt.Sprintf("Track this %d-step plan on the todo board? [y/N] ", len(items))) {
+			return
+		}
+	}
+
+	boardView, err := todoBoard.Update(items, cfg.MaxTodoItems)
+	if err != nil {
+		if cfg.Debug {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Plan capture skipped: %v\n", err)
+		}
+		return
+	}
+	publishTodos()
+	if err := saveTodos(cfg); err != nil {
+		fmt.Printf("Warning: could not save %s: %v\n", todosFile, err)
+	}
+	fmt.Println(boardView)
+
+	pendingContext.Ensure(fmt.Sprintf(planCapturedReminder, len(items)))
+}
+
+// extractPlanItems returns the first numbered (or checkbox) list found in
+// text as todo items. Plain bullet lists only count when introduced by a
+// line mentioning a plan or steps, since final summaries use bullets too.
+func extractPlanItems(text string, limit int) []TodoItem {
+	var items []TodoItem
+	introduced := false
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		content, status, ok := parsePlanLine(trimmed, introduced)
+		if ok {
+			if len(items) < limit {
+				items = append(items, TodoItem{
+					ID:         strconv.Itoa(len(items) + 1),
+					Content:    content,
+					Status:     status,
+					ActiveForm: activeFormOf(content),
+				})
+			}
+			continue
+		}
+		if len(items) >= 2 {
+			break
+		}
+		if trimmed != "" {
+			items = nil
+			lower := strings.ToLower(trimmed)
+			introduced = strings.Contains(lower, "plan") || strings.Contains(lower, "step")
+		}
+	}
+	if len(items) < 2 {
+		return nil
+	}
+	return items
+}
+
+// parsePlanLine recognizes "1. foo", "2) foo", "- [ ] foo" and, when
+// allowBullets is set, "- foo" / "* foo".
+func parsePlanLine(line string, allowBullets bool) (string, string, bool) {
+	status := "pending"
+	rest := ""
+
+	digits := 0
+	for digits < len(line) && line[digits] >= '0' && line[digits] <= '9' {
+		digits++
+	}
+	switch {
+	case digits > 0 && digits < len(line) && (line[digits] == '.' || line[digits] == ')'):
+		rest = line[digits+1:]
+	case strings.HasPrefix(line, "- ") || strings.HasPrefix(line, "* "):
+		rest = line[1:]
+		checkbox := strings.TrimSpace(rest)
+		switch {
+		case strings.HasPrefix(checkbox, "[ ]"):
+			rest = checkbox[3:]
+		case strings.HasPrefix(checkbox, "[x]") || strings.HasPrefix(checkbox, "[X]"):
+			rest = checkbox[3:]
+			status = "completed"
+		case !allowBullets:
+			return "", "", false
+		}
+	default:
+		return "", "", false
+	}
+
+	if rest == "" || (rest[0] != ' ' && rest[0] != '\t') {
+		return "", "", false
+	}
+	content := strings.TrimSpace(strings.ReplaceAll(rest, "**", ""))
+	if content == "" {
+		return "", "", false
+	}
+	return content, status, true
+}
+
+// activeFormOf turns an imperative step ("Add tests") into its present
+// continuous form ("Adding tests") for the todo board.
+func activeFormOf(content string) string {
+	fields := strings.Fields(content)
+	if len(fields) == 0 {
+		return content
+	}
+	verb := strings.TrimRight(fields[0], ":,.")
+	lower := strings.ToLower(verb)
+	isVowel := func(b byte) bool { return strings.IndexByte("aeiou", b) >= 0 }
+
+	var gerund string
+	switch {
+	case strings.HasSuffix(lower, "ing"):
+		return content
+	case len(lower) < 2 || strings.IndexFunc(lower, func(r rune) bool { return r < 'a' || r > 'z' }) >= 0:
+		return "Working on: " + content
+	case strings.HasSuffix(lower, "s") && !strings.HasSuffix(lower, "ss"):
+		return "Working on: " + content
+	case strings.HasSuffix(lower, "ie"):
+		gerund = verb[:len(verb)-2] + "ying"
+	case strings.HasSuffix(lower, "e") && !strings.HasSuffix(lower, "ee") && !strings.HasSuffix(lower, "ye") && !strings.HasSuffix(lower, "oe"):
+		gerund = verb[:len(verb)-1] + "ing"
+	case len(lower) == 3 && !isVowel(lower[0]) && isVowel(lower[1]) && !isVowel(lower[2]) && strings.IndexByte("wxy", lower[2]) < 0:
+		gerund = verb + verb[2:] + "ing"
+	default:
+		gerund = verb + "ing"
+	}
+
+	fields[0] = gerund
+	return strings.Join(fields, " ")
+}
+
+// promptYesNo asks a yes/no question on the terminal. Anything other than an
+// explicit yes, including a non-interactive stdin, counts as no.
+func promptYesNo(question string) bool {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return false
+	}
+	fmt.Print(question)
+	if !stdinScanner.Scan() {
+		return false
+	}
+	answer := strings.ToLower(strings.TrimSpace(stdinScanner.Text()))
+	return answer == "y" || answer == "yes"
+}
+
+// notFoundError turns a missing-file error into one that suggests similarly
+// named workspace files, so a misremembered path is one retry away.
+func notFoundError(cfg Config, path string, err error) error {
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	suggestions := suggestPaths(cfg.WorkDir, path, maxPathSuggestions)
+	if len(suggestions) == 0 {
+		return fmt.Errorf("file not found: %s", path)
+	}
+	return fmt.Errorf("file not found: %s; did you mean: %s?", path, strings.Join(suggestions, ", "))
+}
+
+// suggestPaths ranks workspace files by how close their base name is to
+// the missing path's, breaking ties by the distance between full paths.
+func suggestPaths(workDir, missing string, n int) []string {
+	files, err := listWorkspaceFiles(workDir, maxSuggestScan)
+	if err != nil {
+		return nil
+	}
+	want := strings.ToLower(filepath.ToSlash(strings.TrimPrefix(missing, "./")))
+	if filepath.IsAbs(missing) {
+		if rel, err := filepath.Rel(workDir, missing); err == nil {
+			want = strings.ToLower(filepath.ToSlash(rel))
+		}
+	}
+	wantBase := path.Base(want)
+	threshold := len(wantBase) / 3
+	if threshold < 2 {
+		threshold = 2
+	}
+
+	type candidate struct {
+		rel        string
+		base, full int
+	}
+	var ranked []candidate
+	for _, rel := range files {
+		lower := strings.ToLower(rel)
+		base := path.Base(lower)
+		d := editDistance(wantBase, base)
+		if d > 1 && (strings.Contains(base, wantBase) || strings.Contains(wantBase, base)) {
+			d = 1
+		}
+		if d > threshold {
+			continue
+		}
+		ranked = append(ranked, candidate{rel: rel, base: d, full: editDistance(want, lower)})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].base != ranked[j].base {
+			return ranked[i].base < ranked[j].base
+		}
+		return ranked[i].full < ranked[j].full
+	})
+	var out []string
+	for i := 0; i < len(ranked) && i < n; i++ {
+		out = append(out, ranked[i].rel)
+	}
+	return out
+}
+
+// editDistance is the Levenshtein distance between two strings, in bytes.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// isBinary reports whether data looks like non-text content: a NUL byte or
+// invalid UTF-8 within the first binarySniffBytes.
+func isBinary(data []byte) bool {
+	sample := data
+	if len(data) > binarySniffBytes {
+		// Back up so a multi-byte rune split by the cut isn't counted as invalid
+		cut := binarySniffBytes
+		for cut > binarySniffBytes-utf8.UTFMax && !utf8.RuneStart(data[cut]) {
+			cut--
+		}
+		sample = data[:cut]
+	}
+	return bytes.IndexByte(sample, 0) >= 0 || !utf8.Valid(sample)
+}
+
 func safePath(workDir, p string) (string, error) {
 	candidate := strings.TrimSpace(p)
 	if candidate == "" {
@@ -839,24 +8440,276 @@ func safePath(workDir, p string) (string, error) {
 	if !strings.HasPrefix(abs, workAbs+string(os.PathSeparator)) && abs != workAbs {
 		return "", errors.New("path escapes workspace")
 	}
+
+	// A symlink inside the workspace may still point outside it
+	realWork, err := resolvePath(workAbs)
+	if err != nil {
+		return "", err
+	}
+	realAbs, err := resolvePath(abs)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(realAbs, realWork+string(os.PathSeparator)) && realAbs != realWork {
+		return "", errors.New("path escapes workspace via symlink")
+	}
 	return abs, nil
 }
 
-func isDangerousCommand(cmd string) bool {
-	lowered := strings.ToLower(cmd)
-	danger := []string{
-		"rm -rf /",
-		"shutdown",
-		"reboot",
-		"sudo ",
-		"halt",
+// safeLinkPath is safePath for operations on a directory entry itself, such
+// as a rename: the parent must resolve inside the workspace, but a final
+// symlink is not followed, so a link pointing outside can still be moved.
+func safeLinkPath(workDir, p string) (string, error) {
+	candidate := strings.TrimSpace(p)
+	if candidate == "" {
+		return "", errors.New("path required")
 	}
-	for _, token := range danger {
-		if strings.Contains(lowered, token) {
-			return true
+	candidate = filepath.Clean(candidate)
+	parent, err := safePath(workDir, filepath.Dir(candidate))
+	if err != nil {
+		return "", err
+	}
+	workAbs, err := filepath.Abs(workDir)
+	if err != nil {
+		return "", err
+	}
+	joined := filepath.Join(parent, filepath.Base(candidate))
+	if !strings.HasPrefix(joined, workAbs+string(os.PathSeparator)) && joined != workAbs {
+		return "", errors.New("path escapes workspace")
+	}
+	return joined, nil
+}
+
+// resolvePath evaluates symlinks in path. For a path that doesn't exist yet
+// the nearest existing ancestor is resolved instead, and a dangling symlink
+// resolves to its target, since writing through it would create that file.
+func resolvePath(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return resolved, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	if target, err := os.Readlink(path); err == nil {
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
 		}
+		return resolvePath(target)
 	}
-	return false
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path, nil
+	}
+	resolvedParent, err := resolvePath(parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolvedParent, filepath.Base(path)), nil
+}
+
+// approveCommand consults the session approval rules and otherwise asks the
+// user. Without a terminal to ask on, unapproved commands are denied.
+func approveCommand(command string) bool {
+	if allowed, decided := approvals.Decide(command); decided {
+		if !allowed {
+			prettySubLine("denied by session rule")
+		}
+		return allowed
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		prettySubLine("approval required but stdin is not a terminal; denied")
+		return false
+	}
+
+	fmt.Printf("  $ %s\n", command)
+	fmt.Print("Run this command? [y]es / [N]o / [a]lways / [p]refix always / [d]eny always: ")
+	if !stdinScanner.Scan() {
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(stdinScanner.Text())) {
+	case "y", "yes":
+		return true
+	case "a", "always":
+		approvals.Add(ApprovalRule{Pattern: command}, true)
+		return true
+	case "p", "prefix":
+		prefix := defaultApprovalPrefix(command)
+		fmt.Printf("Always allow commands starting with [%s]: ", prefix)
+		if stdinScanner.Scan() {
+			if custom := strings.TrimSpace(stdinScanner.Text()); custom != "" {
+				prefix = custom
+			}
+		}
+		approvals.Add(ApprovalRule{Pattern: prefix, Prefix: true}, true)
+		return true
+	case "d", "deny":
+		approvals.Add(ApprovalRule{Pattern: command}, false)
+		return false
+	default:
+		return false
+	}
+}
+
+// defaultApprovalPrefix suggests the first two words of a command
+// ("go test ./..." -> "go test") as the prefix to remember.
+func defaultApprovalPrefix(command string) string {
+	fields := strings.Fields(command)
+	if len(fields) > 2 {
+		fields = fields[:2]
+	}
+	return strings.Join(fields, " ")
+}
+
+// defaultBashDeny is always blocked; BASH_DENY adds to it. Plain entries
+// are case-insensitive substrings, entries written as /regex/ are regexes.
+var defaultBashDeny = []string{
+	"rm -rf /",
+	"shutdown",
+	"reboot",
+	"sudo ",
+	"halt",
+	"mkfs",
+	"dd if=",
+	"> /dev/sd",
+	"git push --force",
+	"git push -f",
+	`/:\(\)\s*\{\s*:\s*\|\s*:\s*&\s*\}\s*;\s*:/`, // fork bomb
+}
+
+// commandRule matches bash commands by substring or regex.
+type commandRule struct {
+	source string
+	text   string
+	re     *regexp.Regexp
+}
+
+func (r commandRule) String() string {
+	if r.re != nil {
+		return r.source
+	}
+	return fmt.Sprintf("%q", r.source)
+}
+
+func (r commandRule) matches(cmd string) bool {
+	if r.re != nil {
+		return r.re.MatchString(cmd)
+	}
+	return strings.Contains(strings.ToLower(cmd), r.text)
+}
+
+// parseCommandRules compiles defaultBashDeny plus the BASH_DENY entries,
+// given comma-separated or as a JSON array.
+func parseCommandRules(raw string) ([]commandRule, error) {
+	extra, err := parseList(raw)
+	if err != nil {
+		return nil, err
+	}
+	var rules []commandRule
+	for _, src := range append(append([]string{}, defaultBashDeny...), extra...) {
+		if len(src) > 2 && strings.HasPrefix(src, "/") && strings.HasSuffix(src, "/") {
+			re, err := regexp.Compile(src[1 : len(src)-1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %s: %v", src, err)
+			}
+			rules = append(rules, commandRule{source: src, re: re})
+			continue
+		}
+		rules = append(rules, commandRule{source: src, text: strings.ToLower(src)})
+	}
+	return rules, nil
+}
+
+// isDangerousCommand returns the first deny rule matching cmd.
+func isDangerousCommand(cfg Config, cmd string) (commandRule, bool) {
+	for _, rule := range cfg.BashDeny {
+		if rule.matches(cmd) {
+			return rule, true
+		}
+	}
+	return commandRule{}, false
+}
+
+// shellSeparator splits a command line into the simple commands it chains;
+// shellRedirect matches fd redirections like 2>&1 whose & is not a separator.
+var (
+	shellSeparator = regexp.MustCompile(`&&|\|\||[;|&\n]`)
+	shellRedirect  = regexp.MustCompile(`[0-9]*[<>]&[0-9]*-?|&>>?`)
+)
+
+// chainsCommands reports whether s runs more than one command: it holds a
+// separator BASH_ALLOW splits on, or command substitution.
+func chainsCommands(s string) bool {
+	if strings.Contains(s, "$(") || strings.Contains(s, "`") {
+		return true
+	}
+	return shellSeparator.MatchString(shellRedirect.ReplaceAllString(s, " "))
+}
+
+// checkAllowedCommand enforces BASH_ALLOW: every chained part of the
+// command must start with an allowed prefix, and command substitution is
+// refused because it can't be checked.
+func checkAllowedCommand(cfg Config, cmd string) error {
+	if len(cfg.BashAllow) == 0 {
+		return nil
+	}
+	if strings.Contains(cmd, "$(") || strings.Contains(cmd, "`") {
+		return errors.New("command substitution is not allowed when BASH_ALLOW is set")
+	}
+	for _, part := range shellSeparator.Split(shellRedirect.ReplaceAllString(cmd, " "), -1) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		allowed := false
+		for _, prefix := range cfg.BashAllow {
+			if strings.HasPrefix(part, prefix) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("command not allowed by BASH_ALLOW: %s", part)
+		}
+	}
+	return nil
+}
+
+// redactSecrets replaces matches of cfg.RedactPatterns, and the configured
+// API key itself, with "***". A pattern with a capture group masks only the
+// first group, so surrounding context such as a variable name survives.
+func redactSecrets(cfg Config, s string) (string, int) {
+	if cfg.RedactPatterns == nil {
+		return s, 0
+	}
+	count := 0
+	if len(cfg.APIKey) >= 8 {
+		if n := strings.Count(s, cfg.APIKey); n > 0 {
+			s = strings.ReplaceAll(s, cfg.APIKey, "***")
+			count += n
+		}
+	}
+	for _, re := range cfg.RedactPatterns {
+		matches := re.FindAllStringSubmatchIndex(s, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		var b strings.Builder
+		last := 0
+		for _, m := range matches {
+			start, end := m[0], m[1]
+			if len(m) >= 4 && m[2] >= 0 {
+				start, end = m[2], m[3]
+			}
+			b.WriteString(s[last:start])
+			b.WriteString("***")
+			last = end
+		}
+		b.WriteString(s[last:])
+		s = b.String()
+		count += len(matches)
+	}
+	return s, count
 }
 
 func clampText(s string, limit int) string {
@@ -866,37 +8719,173 @@ func clampText(s string, limit int) string {
 	if len([]rune(s)) <= limit {
 		return s
 	}
-	runes := []rune(s)
-	truncated := string(runes[:limit])
-	extras := len(runes) - limit
-	return fmt.Sprintf("%s\n\n...<truncated %d chars>", truncated, extras)
+	runes := []rune(s)
+	truncated := string(runes[:limit])
+	extras := len(runes) - limit
+	return fmt.Sprintf("%s\n\n...<truncated %d chars>", truncated, extras)
+}
+
+// clampToolResult clamps a tool result like clampText, and when it truncates
+// appends a tool-specific hint telling the model how to get the rest.
+func clampToolResult(tool string, input map[string]interface{}, s string, limit int) string {
+	clamped := clampText(s, limit)
+	if clamped == s || limit <= 0 {
+		return clamped
+	}
+	if hint := truncationHint(tool, input, string([]rune(s)[:limit])); hint != "" {
+		clamped += "\n" + hint
+	}
+	return clamped
+}
+
+// truncationHint suggests the next call that continues a truncated result.
+// shown is the part of the result that survived truncation.
+func truncationHint(tool string, input map[string]interface{}, shown string) string {
+	switch tool {
+	case "read_file":
+		start := getIntOrDefault(input, "start_line", 1)
+		if start < 1 {
+			start = 1
+		}
+		// The last shown line may be partial, so continue from it
+		next := start + strings.Count(shown, "\n")
+		return fmt.Sprintf("(to continue, call read_file with path=%q start_line=%d; max_chars can be raised up to 200000)",
+			getString(input, "path"), next)
+	case "read_files":
+		return "(output budget exhausted; read the remaining files individually with read_file, or pass fewer paths or narrower line ranges)"
+	case "bash":
+		return "(to see the rest, re-run with narrower output: pipe through head/tail/grep, or redirect to a file and read it in ranges with read_file)"
+	case "git_files":
+		return "(pass a smaller max_entries, or run git ls-files on a subdirectory via bash)"
+	case "grep":
+		return "(narrow the search with a more specific pattern or path, or lower max_results)"
+	case "log_search":
+		return "(use a more specific pattern, or lower lines or max_results)"
+	}
+	return ""
+}
+
+// redactHeader masks credentials in a request header for debug output,
+// keeping the auth scheme and a short prefix so the key in use can still
+// be told apart: "Bearer sk-pro...REDACTED".
+func redactHeader(key, value string) string {
+	name := strings.ToLower(key)
+	sensitive := name == "authorization" || name == "cookie"
+	for _, word := range []string{"key", "token", "secret", "auth"} {
+		sensitive = sensitive || strings.Contains(name, word)
+	}
+	if !sensitive {
+		return value
+	}
+	scheme, secret, found := strings.Cut(value, " ")
+	if !found {
+		scheme, secret = "", value
+	} else {
+		scheme += " "
+	}
+	return scheme + maskSecret(secret)
+}
+
+// maskSecret keeps the first few characters of a credential. Short values
+// are hidden entirely since a prefix would give most of them away.
+func maskSecret(secret string) string {
+	const shown = 6
+	if len(secret) < 4*shown {
+		return "REDACTED"
+	}
+	return secret[:shown] + "...REDACTED"
 }
 
 func clampForLog(s string) string {
 	return clampText(s, 2000)
 }
 
-func injectReminders(userText string) interface{} {
-	if len(pendingContextBlocks) == 0 {
-		return userText // Simple string
+// contentText flattens message content (a plain string or a list of text
+// blocks) into a single string.
+func contentText(content interface{}) string {
+	return strings.Join(contentTexts(content), "\n")
+}
+
+// contentTexts returns the text of each block in message content. Content
+// restored from JSON arrives as []interface{} of maps, so that shape is
+// accepted alongside []ContentBlock.
+func contentTexts(content interface{}) []string {
+	switch v := content.(type) {
+	case nil:
+		return nil
+	case string:
+		if v == "" {
+			return nil
+		}
+		return []string{v}
+	case []ContentBlock:
+		texts := make([]string, 0, len(v))
+		for _, block := range v {
+			texts = append(texts, block.Text)
+		}
+		return texts
+	case []interface{}:
+		var texts []string
+		for _, raw := range v {
+			if block, ok := raw.(map[string]interface{}); ok {
+				if text, ok := block["text"].(string); ok {
+					texts = append(texts, text)
+				}
+			}
+		}
+		return texts
+	default:
+		return []string{fmt.Sprintf("%v", v)}
 	}
-	blocks := make([]ContentBlock, len(pendingContextBlocks))
-	copy(blocks, pendingContextBlocks)
-	blocks = append(blocks, ContentBlock{Type: "text", Text: userText})
-	pendingContextBlocks = nil
-	return blocks
 }
 
-func ensureContextBlock(text string) {
-	for _, block := range pendingContextBlocks {
-		if block.Text == text {
-			return
+// mentionPattern finds @path tokens at the start of the input or after
+// whitespace, so e-mail addresses are left alone.
+var mentionPattern = regexp.MustCompile(`(?:^|\s)@([\w./~+-]+)`)
+
+// attachMentions reads the workspace files mentioned as @path in the user's
+// input and queues their contents ahead of the message, saving the model a
+// read_file round trip. Mentions that aren't readable text files inside
+// the workspace are left as plain text.
+func attachMentions(cfg Config, input string) {
+	seen := map[string]bool{}
+	budget := cfg.MaxToolResultChars
+	for _, m := range mentionPattern.FindAllStringSubmatch(input, -1) {
+		// Sentence punctuation isn't part of the path
+		mention := strings.TrimRight(m[1], ".,:;!?")
+		abs, err := safePath(cfg.WorkDir, mention)
+		if err != nil || seen[abs] {
+			continue
+		}
+		info, err := os.Stat(abs)
+		if err != nil || !info.Mode().IsRegular() || info.Size() > maxMentionBytes {
+			continue
+		}
+		data, err := os.ReadFile(abs)
+		if err != nil || isBinary(data) {
+			continue
+		}
+		seen[abs] = true
+		rel, err := filepath.Rel(cfg.WorkDir, abs)
+		if err != nil {
+			rel = abs
+		}
+		text, masked := redactSecrets(cfg, strings.TrimSuffix(string(data), "\n"))
+		text = clampText(text, budget)
+		if masked > 0 {
+			text += fmt.Sprintf("\n[redacted %d secret(s)]", masked)
+		}
+		budget -= utf8.RuneCountInString(text)
+		pendingContext.Ensure(fmt.Sprintf(mentionedFileBlock, rel, text))
+		if masked > 0 {
+			fmt.Printf("[attached %s (%s), %d secret(s) redacted]\n", rel, formatSize(int64(len(data))), masked)
+		} else {
+			fmt.Printf("[attached %s (%s)]\n", rel, formatSize(int64(len(data))))
+		}
+		if budget <= 0 {
+			break
 		}
 	}
-	pendingContextBlocks = append(pendingContextBlocks, ContentBlock{
-		Type: "text",
-		Text: text,
-	})
 }
 
 func getString(input map[string]interface{}, key string) string {
@@ -918,6 +8907,16 @@ func getString(input map[string]interface{}, key string) string {
 	return ""
 }
 
+func getBool(input map[string]interface{}, key string) bool {
+	switch v := input[key].(type) {
+	case bool:
+		return v
+	case string:
+		return strings.EqualFold(strings.TrimSpace(v), "true")
+	}
+	return false
+}
+
 func getIntOrDefault(input map[string]interface{}, key string, def int) int {
 	if val, ok := getOptionalInt(input, key); ok {
 		return val
@@ -988,31 +8987,465 @@ func prettySubLine(text string) {
 	fmt.Printf("  -> %s\n", text)
 }
 
-const systemPrompt = "You are a coding agent operating INSIDE the user's repository at %s.\n" +
+// showToolResult prints a tool result under its [tool] line, wrapped to the
+// display width. With PAGE_RESULTS on a terminal, a result taller than the
+// screen is paged in full; otherwise it is cut to maxShownResultChars.
+func showToolResult(cfg Config, result string) {
+	width := displayWidth(cfg)
+	if cfg.PageResults && width > 0 && term.IsTerminal(int(os.Stdin.Fd())) {
+		_, height, err := term.GetSize(int(os.Stdout.Fd()))
+		lines := strings.Split("  -> "+wrapSubLine(width, result), "\n")
+		if err == nil && height > 2 && len(lines) >= height {
+			pageLines(lines, height-1)
+			return
+		}
+	}
+	prettySubLine(wrapSubLine(width, clampText(result, maxShownResultChars)))
+}
+
+// wrapSubLine wraps text to fit after the "  -> " marker, indenting the
+// continuation lines. A width of 0 leaves it as is.
+func wrapSubLine(width int, text string) string {
+	if width-len(subLineIndent) < minWrapWidth {
+		return text
+	}
+	sw := newSoftWrapper(width - len(subLineIndent))
+	wrapped := sw.Write(text) + sw.Flush()
+	return strings.ReplaceAll(wrapped, "\n", "\n"+subLineIndent)
+}
+
+// pageLines prints lines a page at a time, waiting for a key between pages;
+// q, Esc or Ctrl-C skips the rest.
+func pageLines(lines []string, pageSize int) {
+	for start := 0; start < len(lines); start += pageSize {
+		end := min(start+pageSize, len(lines))
+		fmt.Println(strings.Join(lines[start:end], "\n"))
+		if end == len(lines) {
+			return
+		}
+		fmt.Print(paint(dimText, fmt.Sprintf("-- %d/%d lines: any key for more, q to skip --", end, len(lines))))
+		key := readKey()
+		fmt.Print("\r\033[K")
+		if key == 'q' || key == 'Q' || key == 0x1b || key == 3 {
+			fmt.Printf("%s(%d more lines skipped)\n", subLineIndent, len(lines)-end)
+			return
+		}
+	}
+}
+
+// readKey reads a single keypress from the terminal; 0 if it can't.
+func readKey() byte {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return 0
+	}
+	defer term.Restore(fd, state)
+	buf := make([]byte, 8)
+	if n, err := os.Stdin.Read(buf); err != nil || n == 0 {
+		return 0
+	}
+	return buf[0]
+}
+
+const compactionPrompt = "You compress coding-agent transcripts. Summarize the conversation you are given so the agent can continue the task without it.\n" +
+	"Keep: the user's goals and constraints, decisions made, files read or changed (with paths), commands run and their outcomes, errors still open, and next steps.\n" +
+	"Drop: pleasantries, repeated file contents, and superseded attempts. Write terse bullet points."
+
+const compactSummaryTemplate = `<conversation-summary source="system">
+This is an automatic summary of earlier conversation, not a message from the user.
+
+%s
+
+Todo board at the time of summarizing:
+%s
+</conversation-summary>`
+
+const systemPrompt = "You are %s operating INSIDE the user's repository at %s.\n" +
 	"Follow this loop strictly: plan briefly → use TOOLS to act directly on files/shell → report concise results.\n" +
 	"Rules:\n" +
 	"- Prefer taking actions with tools (read/write/edit/bash) over long prose.\n" +
 	"- Keep outputs terse. Use bullet lists / checklists when summarizing.\n" +
-	"- Never invent file paths. Ask via reads or list directories first if unsure.\n" +
+	"- Never invent file paths. Use list_dir, glob or grep first if unsure.\n" +
 	"- For edits, apply the smallest change that satisfies the request.\n" +
 	"- For bash, avoid destructive or privileged commands; stay inside the workspace.\n" +
 	"- Use the TodoWrite tool to maintain multi-step plans when needed.\n" +
 	"- After finishing, summarize what changed and how to run or test."
 
-func toolDefinitions() []map[string]interface{} {
+// personaSection shapes tone and focus only; the rules above still apply.
+const personaSection = "\nPersona (shapes your tone and focus; the rules above take precedence): %s"
+
+// projectContextSection carries the workspace's MCC.md/AGENTS.md/CLAUDE.md.
+const projectContextSection = "\n\nProject instructions from %s (the project's own conventions; follow them unless the user says otherwise):\n%s"
+
+// responseFormatSection tells the model its final answer must be JSON when
+// OPENAI_RESPONSE_FORMAT is set.
+const responseFormatSection = "\nResponse format: your final reply must be a single valid JSON value matching the requested format, with no prose or code fences around it."
+
+// dryRunSection tells the model its changes are simulated under --dry-run.
+const dryRunSection = "\nDry-run mode: nothing you write is saved. write_file, edit_text, move_file, apply_patch and scaffold only report what they would change, and bash runs read-only commands only. Work through the task as planned and present the changes you would make."
+
+// shellTools run commands through the shell; DISABLE_BASH removes them all.
+var shellTools = []string{"bash", "build", "lint"}
+
+// toolDefinitions returns the schemas of the tools enabled in cfg.
+func toolDefinitions(cfg Config) []map[string]interface{} {
+	all := allToolDefinitions(cfg)
+	if cfg.EnabledTools == nil {
+		return all
+	}
+	enabled := make([]map[string]interface{}, 0, len(all))
+	for _, def := range all {
+		if toolEnabled(cfg, toolName(def)) {
+			enabled = append(enabled, def)
+		}
+	}
+	return enabled
+}
+
+// toolEnabled reports whether the model may call the named tool
+func toolEnabled(cfg Config, name string) bool {
+	return cfg.EnabledTools == nil || cfg.EnabledTools[name]
+}
+
+func toolName(def map[string]interface{}) string {
+	fn, _ := def["function"].(map[string]interface{})
+	name, _ := fn["name"].(string)
+	return name
+}
+
+// parseToolChoice validates a tool_choice setting: auto, none, required or
+// the name of a tool enabled in cfg. Empty means auto.
+func parseToolChoice(raw string, cfg Config) (string, error) {
+	choice := strings.TrimSpace(raw)
+	switch strings.ToLower(choice) {
+	case "", "auto":
+		return "auto", nil
+	case "none", "required":
+		return strings.ToLower(choice), nil
+	}
+	for _, def := range toolDefinitions(cfg) {
+		if toolName(def) == choice {
+			return choice, nil
+		}
+	}
+	return "", fmt.Errorf("tool choice must be auto, none, required or an enabled tool name, got %q", choice)
+}
+
+// toolChoiceParam is the OpenAI tool_choice value for choice; nil for auto,
+// which is the API default.
+func toolChoiceParam(choice string) interface{} {
+	switch choice {
+	case "", "auto":
+		return nil
+	case "none", "required":
+		return choice
+	}
+	return map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": choice}}
+}
+
+// anthropicToolChoice is the Anthropic tool_choice value for choice, which
+// also carries the switch for parallel tool use.
+func anthropicToolChoice(choice string, parallel bool) interface{} {
+	var param map[string]interface{}
+	switch choice {
+	case "", "auto":
+		if parallel {
+			return nil
+		}
+		param = map[string]interface{}{"type": "auto"}
+	case "none":
+		return map[string]interface{}{"type": "none"}
+	case "required":
+		param = map[string]interface{}{"type": "any"}
+	default:
+		param = map[string]interface{}{"type": "tool", "name": choice}
+	}
+	if !parallel {
+		param["disable_parallel_tool_use"] = true
+	}
+	return param
+}
+
+// parseEnabledTools builds the tool allowlist from MCC_TOOLS (names given
+// comma-separated or as a JSON array) minus the shell tools when
+// disableBash is set. nil means every tool is enabled.
+func parseEnabledTools(raw string, disableBash bool) (map[string]bool, error) {
+	names, err := parseList(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 && !disableBash {
+		return nil, nil
+	}
+	known := map[string]bool{}
+	for _, def := range allToolDefinitions(Config{}) {
+		known[toolName(def)] = true
+	}
+	enabled := map[string]bool{}
+	if len(names) == 0 {
+		enabled = known
+	}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if !known[name] {
+			all := make([]string, 0, len(known))
+			for k := range known {
+				all = append(all, k)
+			}
+			sort.Strings(all)
+			return nil, fmt.Errorf("unknown tool %q (tools: %s)", name, strings.Join(all, ", "))
+		}
+		enabled[name] = true
+	}
+	if disableBash {
+		for _, name := range shellTools {
+			delete(enabled, name)
+		}
+	}
+	return enabled, nil
+}
+
+func allToolDefinitions(cfg Config) []map[string]interface{} {
 	return []map[string]interface{}{
 		{
 			"type": "function",
 			"function": map[string]interface{}{
-				"name":        "bash",
-				"description": "Execute a shell command inside the project workspace. Use for scaffolding, formatting, running scripts, etc.",
+				"name":        "bash",
+				"description": "Execute a shell command inside the project workspace. Use for scaffolding, formatting, running scripts, etc.",
+				"parameters": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"command":    map[string]interface{}{"type": "string", "description": "Shell command to run"},
+						"timeout_ms": map[string]interface{}{"type": "integer", "minimum": 1000, "maximum": 120000},
+					},
+					"required":             []string{"command"},
+					"additionalProperties": false,
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        "read_file",
+				"description": "Read a UTF-8 text file. Optionally slice by line range or clamp length.",
+				"parameters": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"path":       map[string]interface{}{"type": "string"},
+						"start_line": map[string]interface{}{"type": "integer", "minimum": 1},
+						"end_line":   map[string]interface{}{"type": "integer", "minimum": -1},
+						"max_chars":  map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 200000},
+					},
+					"required":             []string{"path"},
+					"additionalProperties": false,
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        "read_files",
+				"description": "Read several UTF-8 text files in one call. Each entry is a path or {path, start_line, end_line, max_chars}. Output is delimited by === path === headers; failed paths are reported without aborting the rest.",
+				"parameters": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"paths": map[string]interface{}{
+							"type": "array",
+							"items": map[string]interface{}{
+								"anyOf": []interface{}{
+									map[string]interface{}{"type": "string"},
+									map[string]interface{}{
+										"type": "object",
+										"properties": map[string]interface{}{
+											"path":       map[string]interface{}{"type": "string"},
+											"start_line": map[string]interface{}{"type": "integer", "minimum": 1},
+											"end_line":   map[string]interface{}{"type": "integer", "minimum": -1},
+											"max_chars":  map[string]interface{}{"type": "integer", "minimum": 1},
+										},
+										"required":             []string{"path"},
+										"additionalProperties": false,
+									},
+								},
+							},
+							"minItems": 1,
+							"maxItems": maxReadFilesPaths,
+						},
+					},
+					"required":             []string{"paths"},
+					"additionalProperties": false,
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        "write_file",
+				"description": "Create or overwrite/append a UTF-8 text file. Use overwrite unless explicitly asked to append.",
+				"parameters": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"path":    map[string]interface{}{"type": "string"},
+						"content": map[string]interface{}{"type": "string"},
+						"mode":    map[string]interface{}{"type": "string", "enum": []string{"overwrite", "append"}, "default": "overwrite"},
+						"backup":  map[string]interface{}{"type": "boolean", "description": "Save the previous contents to <path>.bak first"},
+					},
+					"required":             []string{"path", "content"},
+					"additionalProperties": false,
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        "edit_text",
+				"description": "Small, precise text edits. Choose one action: replace | insert | delete_range.",
+				"parameters": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"path":         map[string]interface{}{"type": "string"},
+						"action":       map[string]interface{}{"type": "string", "enum": []string{"replace", "insert", "delete_range"}},
+						"find":         map[string]interface{}{"type": "string"},
+						"replace":      map[string]interface{}{"type": "string"},
+						"regex":        map[string]interface{}{"type": "boolean", "description": "replace: treat find as a Go regexp; replace may use $1 or ${name}"},
+						"count":        map[string]interface{}{"type": "integer", "minimum": 1, "description": "replace: change only the first N matches (default all)"},
+						"occurrence":   map[string]interface{}{"type": "integer", "minimum": 1, "description": "replace: change only the Nth match (1-based)"},
+						"insert_after": map[string]interface{}{"type": "integer", "minimum": -1},
+						"new_text":     map[string]interface{}{"type": "string"},
+						"range":        map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "integer"}, "minItems": 2, "maxItems": 2},
+						"backup":       map[string]interface{}{"type": "boolean", "description": "replace, delete_range: save the previous contents to <path>.bak first"},
+					},
+					"required":             []string{"path", "action"},
+					"additionalProperties": false,
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        "move_file",
+				"description": "Move or rename a file or directory inside the workspace, creating the destination's parent directories. Prefer this over reading and rewriting a file under a new name.",
+				"parameters": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"from":      map[string]interface{}{"type": "string"},
+						"to":        map[string]interface{}{"type": "string"},
+						"overwrite": map[string]interface{}{"type": "boolean", "description": "Replace an existing destination file (default false)"},
+					},
+					"required":             []string{"from", "to"},
+					"additionalProperties": false,
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        "preview_edit",
+				"description": "Dry-run an edit_text or write_file call: takes the same arguments plus tool, and returns the diff it would make without writing. Use it to check that a replace hits the right lines before editing.",
+				"parameters": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"tool":         map[string]interface{}{"type": "string", "enum": []string{"edit_text", "write_file"}, "default": "edit_text"},
+						"path":         map[string]interface{}{"type": "string"},
+						"action":       map[string]interface{}{"type": "string", "enum": []string{"replace", "insert", "delete_range"}, "description": "edit_text only"},
+						"find":         map[string]interface{}{"type": "string"},
+						"replace":      map[string]interface{}{"type": "string"},
+						"regex":        map[string]interface{}{"type": "boolean"},
+						"count":        map[string]interface{}{"type": "integer", "minimum": 1},
+						"occurrence":   map[string]interface{}{"type": "integer", "minimum": 1},
+						"insert_after": map[string]interface{}{"type": "integer", "minimum": -1},
+						"new_text":     map[string]interface{}{"type": "string"},
+						"range":        map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "integer"}, "minItems": 2, "maxItems": 2},
+						"content":      map[string]interface{}{"type": "string", "description": "write_file only"},
+						"mode":         map[string]interface{}{"type": "string", "enum": []string{"overwrite", "append"}, "description": "write_file only"},
+					},
+					"required":             []string{"path"},
+					"additionalProperties": false,
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        "git_files",
+				"description": "List tracked, untracked and ignored files in the workspace separately. Use it to avoid editing generated or ignored files. Falls back to a plain listing outside git repositories.",
+				"parameters": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"max_entries": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 10000, "description": "Maximum entries listed per section"},
+					},
+					"additionalProperties": false,
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        "grep",
+				"description": "Search file contents in the workspace with a regular expression (Go RE2 syntax). Returns file:line: text for each matching line. Skips .git, node_modules, binary and very large files. Prefer this over running grep through bash.",
+				"parameters": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"pattern":     map[string]interface{}{"type": "string", "description": "Regular expression to search for"},
+						"path":        map[string]interface{}{"type": "string", "description": "File or directory to search, or a glob such as *.go or internal/**/*_test.go (default: whole workspace)"},
+						"ignore_case": map[string]interface{}{"type": "boolean"},
+						"max_results": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": maxGrepResults, "description": "Maximum matching lines to return (default 100)"},
+					},
+					"required":             []string{"pattern"},
+					"additionalProperties": false,
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        "log_search",
+				"description": "Search the end of a large log file: reads only the last lines (within the last max_bytes) and returns the lines matching a regex, most recent kept. Much cheaper than read_file for finding recent errors.",
+				"parameters": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"path":        map[string]interface{}{"type": "string"},
+						"pattern":     map[string]interface{}{"type": "string", "description": "Regular expression (Go RE2 syntax); omit to return every line"},
+						"ignore_case": map[string]interface{}{"type": "boolean"},
+						"lines":       map[string]interface{}{"type": "integer", "minimum": 1, "maximum": maxLogLines, "description": "How many lines from the end to search (default 1000)"},
+						"max_bytes":   map[string]interface{}{"type": "integer", "minimum": 1, "maximum": maxLogBytes, "description": "Read at most this many bytes from the end (default 8MB)"},
+						"max_results": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": maxGrepResults, "description": "Most matching lines returned (default 100)"},
+					},
+					"required":             []string{"path"},
+					"additionalProperties": false,
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        "list_dir",
+				"description": "List a directory tree with file sizes; directories end in /. Use it to get oriented before guessing paths. .git and node_modules are not descended into unless include_ignored is set.",
+				"parameters": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"path":            map[string]interface{}{"type": "string", "description": "Directory to list (default: workspace root)"},
+						"max_depth":       map[string]interface{}{"type": "integer", "minimum": 1, "maximum": maxListDepth, "description": "Levels to descend (default 2; 1 lists only the directory itself)"},
+						"max_entries":     map[string]interface{}{"type": "integer", "minimum": 1, "maximum": maxListEntries, "description": "Maximum entries in total (default 500)"},
+						"include_ignored": map[string]interface{}{"type": "boolean", "description": "Also descend into .git and node_modules"},
+					},
+					"additionalProperties": false,
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        "glob",
+				"description": "Find files by path pattern, e.g. **/*.go, cmd/**/main.go or src/**/*.{ts,tsx}. ** spans directories. Returns sorted workspace-relative paths. Prefer this over find through bash.",
 				"parameters": map[string]interface{}{
 					"type": "object",
 					"properties": map[string]interface{}{
-						"command":    map[string]interface{}{"type": "string", "description": "Shell command to run"},
-						"timeout_ms": map[string]interface{}{"type": "integer", "minimum": 1000, "maximum": 120000},
+						"pattern":     map[string]interface{}{"type": "string", "description": "Glob relative to path (default: the workspace root)"},
+						"path":        map[string]interface{}{"type": "string", "description": "Directory to search from"},
+						"max_results": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": maxGlobResults, "description": "Maximum paths to return (default 500)"},
 					},
-					"required":             []string{"command"},
+					"required":             []string{"pattern"},
 					"additionalProperties": false,
 				},
 			},
@@ -1020,15 +9453,122 @@ func toolDefinitions() []map[string]interface{} {
 		{
 			"type": "function",
 			"function": map[string]interface{}{
-				"name":        "read_file",
-				"description": "Read a UTF-8 text file. Optionally slice by line range or clamp length.",
+				"name":        "query_data",
+				"description": "Extract values from a JSON or YAML file without reading it whole. query is a dotted path with [n] indices (negative counts from the end), [*] or * wildcards and [\"quoted.keys\"], e.g. $.items[0].name or spec.ports[*].port.",
 				"parameters": map[string]interface{}{
 					"type": "object",
 					"properties": map[string]interface{}{
-						"path":       map[string]interface{}{"type": "string"},
-						"start_line": map[string]interface{}{"type": "integer", "minimum": 1},
-						"end_line":   map[string]interface{}{"type": "integer", "minimum": -1},
-						"max_chars":  map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 200000},
+						"path":   map[string]interface{}{"type": "string"},
+						"query":  map[string]interface{}{"type": "string", "description": "Path expression; empty or $ returns the whole document"},
+						"format": map[string]interface{}{"type": "string", "enum": []string{"json", "yaml"}, "description": "Defaults from the file extension"},
+					},
+					"required":             []string{"path", "query"},
+					"additionalProperties": false,
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        "apply_patch",
+				"description": "Apply a unified diff (---/+++ file headers, @@ hunks with space/-/+ prefixed lines) to one or more files. Context and removed lines must match exactly; if any hunk fails nothing is written. Use /dev/null as the old or new file to create or delete a file. Prefer this over edit_text for multi-line or multi-file changes.",
+				"parameters": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"patch":   map[string]interface{}{"type": "string", "description": "The unified diff"},
+						"dry_run": map[string]interface{}{"type": "boolean", "description": "Check that the patch applies and report the changes without writing"},
+					},
+					"required":             []string{"patch"},
+					"additionalProperties": false,
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        "build",
+				"description": "Check whether the workspace builds. Detects the build command (go, cargo, npm, tsc, make) unless one is given, parses compiler errors into file:line:col entries, and returns the cached result when nothing changed since the last build. Prefer it over running the build through bash.",
+				"parameters": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"command":    map[string]interface{}{"type": "string", "description": "Build command to run instead of the detected one"},
+						"force":      map[string]interface{}{"type": "boolean", "description": "Rebuild even if the cached result is still valid"},
+						"timeout_ms": map[string]interface{}{"type": "integer", "description": "Timeout in milliseconds (default 300000)"},
+					},
+					"additionalProperties": false,
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        "lint",
+				"description": "Run the project's linter (golangci-lint, eslint or ruff, detected from config files) in check-only mode and list violations as file:line:col: rule: message. Never modifies files.",
+				"parameters": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"linter":     map[string]interface{}{"type": "string", "enum": []string{"golangci-lint", "eslint", "ruff"}, "description": "Linter to run instead of the detected one"},
+						"path":       map[string]interface{}{"type": "string", "description": "File or directory to check (default: the whole workspace)"},
+						"timeout_ms": map[string]interface{}{"type": "integer", "description": "Timeout in milliseconds (default 300000)"},
+					},
+					"additionalProperties": false,
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        "parse_trace",
+				"description": "Parse a Go, Python or Node stack trace the user pasted. Returns the error message and each frame's file:line and function, with the surrounding source for frames inside the workspace. Use it first when debugging from a trace.",
+				"parameters": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"trace":         map[string]interface{}{"type": "string", "description": "The stack trace text"},
+						"context_lines": map[string]interface{}{"type": "integer", "description": "Source lines shown before and after each frame (default 2, 0 for none)"},
+					},
+					"required":             []string{"trace"},
+					"additionalProperties": false,
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        "scaffold",
+				"description": "Create a minimal project (manifest, main file with a Repro function, and a test calling it) in a new subdirectory, to reproduce an issue in isolation. Refuses to overwrite existing files.",
+				"parameters": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"language": map[string]interface{}{"type": "string", "enum": []string{"go", "node", "python"}},
+						"dir":      map[string]interface{}{"type": "string", "description": "Subdirectory to create the project in, e.g. repro/issue-42"},
+						"name":     map[string]interface{}{"type": "string", "description": "Module/package name (default: the directory name)"},
+					},
+					"required":             []string{"language", "dir"},
+					"additionalProperties": false,
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        "undo",
+				"description": "Revert your most recent write_file or edit_text change, one file of an apply_patch, or a move_file, restoring the file's previous content (or removing a file that write created, or moving a moved file back). Call repeatedly to step further back; up to 50 edits are kept.",
+				"parameters": map[string]interface{}{
+					"type":                 "object",
+					"properties":           map[string]interface{}{},
+					"additionalProperties": false,
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        "diff_since_write",
+				"description": "Show a unified diff between what you last wrote to a file (write_file or edit_text this session) and its current content, revealing changes made by someone else. Check this before editing a file again after a pause.",
+				"parameters": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"path": map[string]interface{}{"type": "string"},
 					},
 					"required":             []string{"path"},
 					"additionalProperties": false,
@@ -1038,16 +9578,14 @@ func toolDefinitions() []map[string]interface{} {
 		{
 			"type": "function",
 			"function": map[string]interface{}{
-				"name":        "write_file",
-				"description": "Create or overwrite/append a UTF-8 text file. Use overwrite unless explicitly asked to append.",
+				"name":        "compute",
+				"description": "Evaluate a small expression without a shell: numbers with + - * / % and parentheses, \"strings\" joined with +, constants pi and e, and functions abs sqrt pow floor ceil round log exp min max len upper lower trim replace repeat join base dir ext clean rel. Prefer this over bash for quick arithmetic or path manipulation.",
 				"parameters": map[string]interface{}{
 					"type": "object",
 					"properties": map[string]interface{}{
-						"path":    map[string]interface{}{"type": "string"},
-						"content": map[string]interface{}{"type": "string"},
-						"mode":    map[string]interface{}{"type": "string", "enum": []string{"overwrite", "append"}, "default": "overwrite"},
+						"expression": map[string]interface{}{"type": "string", "description": "e.g. (1024*3)/7, join(\"src\", \"pkg\", base(\"a/b.go\"))"},
 					},
-					"required":             []string{"path", "content"},
+					"required":             []string{"expression"},
 					"additionalProperties": false,
 				},
 			},
@@ -1055,20 +9593,58 @@ func toolDefinitions() []map[string]interface{} {
 		{
 			"type": "function",
 			"function": map[string]interface{}{
-				"name":        "edit_text",
-				"description": "Small, precise text edits. Choose one action: replace | insert | delete_range.",
+				"name":        "memory_set",
+				"description": "Save a fact to durable memory that later sessions in this workspace will see: project conventions, decisions and their reasons, gotchas. Not for scratch notes about the current task. An existing key is overwritten; an empty value deletes the key.",
 				"parameters": map[string]interface{}{
 					"type": "object",
 					"properties": map[string]interface{}{
-						"path":         map[string]interface{}{"type": "string"},
-						"action":       map[string]interface{}{"type": "string", "enum": []string{"replace", "insert", "delete_range"}},
-						"find":         map[string]interface{}{"type": "string"},
-						"replace":      map[string]interface{}{"type": "string"},
-						"insert_after": map[string]interface{}{"type": "integer", "minimum": -1},
-						"new_text":     map[string]interface{}{"type": "string"},
-						"range":        map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "integer"}, "minItems": 2, "maxItems": 2},
+						"key":   map[string]interface{}{"type": "string", "maxLength": maxMemoryKeyLen, "description": "Short descriptive name, e.g. test-command or db-migrations"},
+						"value": map[string]interface{}{"type": "string", "maxLength": maxMemoryValueChars, "description": "The fact to remember, written so it makes sense without this conversation"},
+					},
+					"required":             []string{"key", "value"},
+					"additionalProperties": false,
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        "memory_get",
+				"description": "Read one fact saved with memory_set.",
+				"parameters": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"key": map[string]interface{}{"type": "string"},
+					},
+					"required":             []string{"key"},
+					"additionalProperties": false,
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        "memory_list",
+				"description": "List saved memory keys with the first line of each value, most recent first.",
+				"parameters": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"prefix": map[string]interface{}{"type": "string", "description": "Only keys starting with this"},
+					},
+					"additionalProperties": false,
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        "list_tools",
+				"description": "List the tools available in this session with their descriptions and parameter schemas. Pass name to show a single tool.",
+				"parameters": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"name": map[string]interface{}{"type": "string", "description": "Only describe this tool"},
 					},
-					"required":             []string{"path", "action"},
 					"additionalProperties": false,
 				},
 			},
@@ -1090,11 +9666,12 @@ func toolDefinitions() []map[string]interface{} {
 									"content":    map[string]interface{}{"type": "string"},
 									"activeForm": map[string]interface{}{"type": "string"},
 									"status":     map[string]interface{}{"type": "string", "enum": []string{"pending", "in_progress", "completed"}},
+									"priority":   map[string]interface{}{"type": "string", "enum": []string{"high", "medium", "low"}, "description": "Optional; high-priority pending items are highlighted"},
 								},
 								"required":             []string{"content", "activeForm", "status"},
 								"additionalProperties": false,
 							},
-							"maxItems": maxTodoItems,
+							"maxItems": cfg.MaxTodoItems,
 						},
 					},
 					"required":             []string{"items"},
@@ -1105,6 +9682,198 @@ func toolDefinitions() []map[string]interface{} {
 	}
 }
 
+// anthropicResponse is the subset of the Anthropic Messages API response we use.
+type anthropicResponse struct {
+	ID         string `json:"id"`
+	Model      string `json:"model"`
+	StopReason string `json:"stop_reason"`
+	Content    []struct {
+		Type  string          `json:"type"` // text | tool_use
+		Text  string          `json:"text"`
+		ID    string          `json:"id"`
+		Name  string          `json:"name"`
+		Input json.RawMessage `json:"input"`
+	} `json:"content"`
+}
+
+// callAnthropic sends the conversation to the Anthropic Messages API and maps
+// the reply back into the OpenAI-shaped APIResponse the agent loop expects.
+// Responses are always requested non-streaming.
+func callAnthropic(ctx context.Context, cfg Config, messages []Message, tools []map[string]interface{}) (*APIResponse, error) {
+	system, converted := toAnthropicMessages(messages)
+	body := map[string]interface{}{
+		"model":      cfg.Model,
+		"messages":   converted,
+		"max_tokens": cfg.MaxResult,
+	}
+	if len(tools) > 0 {
+		body["tools"] = toAnthropicTools(tools)
+		if choice := anthropicToolChoice(cfg.ToolChoice, cfg.ParallelTools); choice != nil {
+			body["tool_choice"] = choice
+		}
+	}
+	if system != "" {
+		body["system"] = system
+	}
+	applySamplingParams(cfg, body)
+	if len(cfg.Stop) > 0 {
+		body["stop_sequences"] = cfg.Stop
+	}
+
+	resp, err := postJSON(ctx, cfg, messagesEndpoint(cfg), body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Debug {
+		fmt.Fprintf(os.Stderr, "[DEBUG] Response Status: %d %s\n", resp.StatusCode, resp.Status)
+		fmt.Fprintf(os.Stderr, "[DEBUG] Response Body (raw):\n%s\n\n", clampForLog(string(data)))
+	}
+	if resp.StatusCode >= 400 {
+		return nil, newAPIError(resp.StatusCode, data)
+	}
+
+	var anthResp anthropicResponse
+	if err := json.Unmarshal(data, &anthResp); err != nil {
+		return nil, err
+	}
+	return fromAnthropicResponse(anthResp), nil
+}
+
+// messagesEndpoint applies the same base URL conventions as chatEndpoint to
+// the Anthropic /v1/messages path.
+func messagesEndpoint(cfg Config) string {
+	baseURL := cfg.BaseURL
+	if strings.HasSuffix(baseURL, "#") {
+		return strings.TrimSuffix(baseURL, "#")
+	} else if strings.HasSuffix(baseURL, "/v1") {
+		return baseURL + "/messages"
+	} else if strings.HasSuffix(baseURL, "/") {
+		return baseURL + "messages"
+	}
+	return baseURL + "/v1/messages"
+}
+
+// toAnthropicMessages lifts system messages into the top-level system field,
+// turns tool results into tool_result blocks and tool calls into tool_use
+// blocks, and merges consecutive same-role turns as the API requires.
+func toAnthropicMessages(messages []Message) (string, []map[string]interface{}) {
+	var systemParts []string
+	var out []map[string]interface{}
+
+	appendBlocks := func(role string, blocks []map[string]interface{}) {
+		if len(blocks) == 0 {
+			return
+		}
+		if n := len(out); n > 0 && out[n-1]["role"] == role {
+			out[n-1]["content"] = append(out[n-1]["content"].([]map[string]interface{}), blocks...)
+			return
+		}
+		out = append(out, map[string]interface{}{"role": role, "content": blocks})
+	}
+
+	for _, msg := range messages {
+		switch msg.Role {
+		case "system":
+			if text := contentText(msg.Content); text != "" {
+				systemParts = append(systemParts, text)
+			}
+		case "tool":
+			appendBlocks("user", []map[string]interface{}{{
+				"type":        "tool_result",
+				"tool_use_id": msg.ToolCallID,
+				"content":     contentText(msg.Content),
+			}})
+		case "assistant":
+			var blocks []map[string]interface{}
+			if text := contentText(msg.Content); text != "" {
+				blocks = append(blocks, map[string]interface{}{"type": "text", "text": text})
+			}
+			for _, tc := range msg.ToolCalls {
+				input := map[string]interface{}{}
+				if strings.TrimSpace(tc.Function.Arguments) != "" {
+					_ = json.Unmarshal([]byte(tc.Function.Arguments), &input)
+				}
+				blocks = append(blocks, map[string]interface{}{
+					"type":  "tool_use",
+					"id":    tc.ID,
+					"name":  tc.Function.Name,
+					"input": input,
+				})
+			}
+			appendBlocks("assistant", blocks)
+		default:
+			var blocks []map[string]interface{}
+			for _, text := range contentTexts(msg.Content) {
+				blocks = append(blocks, map[string]interface{}{"type": "text", "text": text})
+			}
+			appendBlocks("user", blocks)
+		}
+	}
+	return strings.Join(systemParts, "\n\n"), out
+}
+
+// toAnthropicTools reshapes OpenAI function definitions into Anthropic's
+// {name, description, input_schema} form.
+func toAnthropicTools(defs []map[string]interface{}) []map[string]interface{} {
+	tools := make([]map[string]interface{}, 0, len(defs))
+	for _, def := range defs {
+		fn, ok := def["function"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		tools = append(tools, map[string]interface{}{
+			"name":         fn["name"],
+			"description":  fn["description"],
+			"input_schema": fn["parameters"],
+		})
+	}
+	return tools
+}
+
+func fromAnthropicResponse(resp anthropicResponse) *APIResponse {
+	msg := Message{Role: "assistant"}
+	var text strings.Builder
+	for _, block := range resp.Content {
+		switch block.Type {
+		case "text":
+			text.WriteString(block.Text)
+		case "tool_use":
+			args := string(block.Input)
+			if args == "" || args == "null" {
+				args = "{}"
+			}
+			msg.ToolCalls = append(msg.ToolCalls, ToolCall{
+				ID:       block.ID,
+				Type:     "function",
+				Function: Function{Name: block.Name, Arguments: args},
+			})
+		}
+	}
+	msg.Content = text.String()
+
+	finish := "stop"
+	switch resp.StopReason {
+	case "tool_use":
+		finish = "tool_calls"
+	case "max_tokens":
+		finish = "length"
+	case "refusal":
+		finish = "content_filter"
+	}
+
+	return &APIResponse{
+		ID:      resp.ID,
+		Model:   resp.Model,
+		Choices: []Choice{{Message: msg, FinishReason: finish}},
+	}
+}
+
 // handleNonStreamingResponse processes standard JSON responses
 func handleNonStreamingResponse(cfg Config, resp *http.Response) (*APIResponse, error) {
 	// Read response body
@@ -1131,7 +9900,7 @@ func handleNonStreamingResponse(cfg Config, resp *http.Response) (*APIResponse,
 	}
 
 	if resp.StatusCode >= 400 {
-		return nil, fmt.Errorf("api error: status %d body %s", resp.StatusCode, clampForLog(string(data)))
+		return nil, newAPIError(resp.StatusCode, data)
 	}
 
 	var apiResp APIResponse
@@ -1141,8 +9910,113 @@ func handleNonStreamingResponse(cfg Config, resp *http.Response) (*APIResponse,
 	return &apiResp, nil
 }
 
-// handleStreamingResponse processes Server-Sent Events (SSE) stream responses
-func handleStreamingResponse(cfg Config, resp *http.Response) (*APIResponse, error) {
+// detectStreamFormat picks how to read a streamed reply: STREAM_FORMAT when set,
+// otherwise the Content-Type. "auto" means it is decided line by line.
+func detectStreamFormat(cfg Config, resp *http.Response) string {
+	if cfg.StreamFormat != "auto" {
+		return cfg.StreamFormat
+	}
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0]))
+	switch mediaType {
+	case "text/event-stream":
+		return "sse"
+	case "application/x-ndjson", "application/ndjson", "application/jsonl", "application/x-jsonlines", "application/stream+json":
+		return "ndjson"
+	}
+	return "auto"
+}
+
+// streamPayload extracts the JSON payload from one line of a stream: the
+// data field of an SSE line, or the whole line in NDJSON. In auto mode a
+// line is SSE if it starts with "data:" and NDJSON if it starts with "{".
+func streamPayload(line, format string) (string, bool) {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" {
+		return "", false
+	}
+	isSSE := strings.HasPrefix(line, "data:")
+	switch {
+	case format == "sse" || (format == "auto" && isSSE):
+		if !isSSE {
+			return "", false
+		}
+		return strings.TrimSpace(strings.TrimPrefix(line, "data:")), true
+	case format == "ndjson":
+		return trimmed, true
+	default:
+		return trimmed, strings.HasPrefix(trimmed, "{")
+	}
+}
+
+// APIError is an error response from the provider. StatusCode is always
+// set; Message, Type and Code come from the {"error": {...}} envelope that
+// OpenAI, Azure and Anthropic all use, and Body keeps the raw response when
+// it isn't one.
+type APIError struct {
+	StatusCode int
+	Message    string
+	Type       string
+	Code       string
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("api error: status %d body %s", e.StatusCode, e.Body)
+	}
+	if e.Type != "" {
+		return fmt.Sprintf("%s (%d, %s)", e.Message, e.StatusCode, e.Type)
+	}
+	return fmt.Sprintf("%s (%d)", e.Message, e.StatusCode)
+}
+
+// newAPIError builds an APIError from a failed response's status and body.
+func newAPIError(status int, body []byte) *APIError {
+	apiErr := &APIError{StatusCode: status}
+	var envelope struct {
+		Error struct {
+			Message string      `json:"message"`
+			Type    string      `json:"type"`
+			Code    interface{} `json:"code"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &envelope) != nil || envelope.Error.Message == "" {
+		apiErr.Body = clampForLog(string(body))
+		return apiErr
+	}
+	apiErr.Message = strings.TrimSpace(envelope.Error.Message)
+	apiErr.Type = envelope.Error.Type
+	if envelope.Error.Code != nil {
+		apiErr.Code = fmt.Sprint(envelope.Error.Code)
+	}
+	return apiErr
+}
+
+// streamErrorMessage describes the error value of a mid-stream error event:
+// an object with message, type and code, or a bare string.
+func streamErrorMessage(raw json.RawMessage) string {
+	var text string
+	if json.Unmarshal(raw, &text) == nil && text != "" {
+		return text
+	}
+	var e struct {
+		Message string      `json:"message"`
+		Type    string      `json:"type"`
+		Code    interface{} `json:"code"`
+	}
+	if json.Unmarshal(raw, &e) != nil || e.Message == "" {
+		return clampForLog(string(raw))
+	}
+	if e.Type != "" {
+		return fmt.Sprintf("%s (%s)", e.Message, e.Type)
+	}
+	return e.Message
+}
+
+// handleStreamingResponse processes Server-Sent Events (SSE) stream responses.
+// Text is printed as it arrives; tool calls are assembled from their
+// per-index deltas while spin shows how much of the arguments has arrived.
+func handleStreamingResponse(cfg Config, resp *http.Response, spin *spinner) (*APIResponse, error) {
 	// Log response headers (only if DEBUG=true)
 	if cfg.Debug {
 		fmt.Fprintf(os.Stderr, "[DEBUG] Response Status: %d %s\n", resp.StatusCode, resp.Status)
@@ -1160,26 +10034,34 @@ func handleStreamingResponse(cfg Config, resp *http.Response) (*APIResponse, err
 		if err != nil {
 			return nil, err
 		}
-		return nil, fmt.Errorf("api error: status %d body %s", resp.StatusCode, clampForLog(string(data)))
+		return nil, newAPIError(resp.StatusCode, data)
 	}
 
 	// Process streaming response
 	var finalContent strings.Builder
+	var toolCalls []ToolCall
+	// Text held back in hybrid mode once a tool call has started
+	var held strings.Builder
+	wrap := newSoftWrapper(displayWidth(cfg))
+	finishReason := "stop"
+	format := detectStreamFormat(cfg, resp)
+	if cfg.Debug {
+		fmt.Fprintf(os.Stderr, "[DEBUG] Stream format: %s\n", format)
+	}
 	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), cfg.StreamMaxLine)
 
 	for scanner.Scan() {
 		line := scanner.Text()
 		if cfg.Debug {
-			fmt.Fprintf(os.Stderr, "[DEBUG] SSE Line: %s\n", line)
+			fmt.Fprintf(os.Stderr, "[DEBUG] Stream line: %s\n", line)
 		}
 
-		// Skip empty lines and SSE event markers
-		if strings.TrimSpace(line) == "" || !strings.HasPrefix(line, "data: ") {
+		// Skip empty lines, SSE event markers and comments
+		dataStr, ok := streamPayload(line, format)
+		if !ok {
 			continue
 		}
-
-		// Extract JSON data
-		dataStr := strings.TrimPrefix(line, "data: ")
 		if dataStr == "[DONE]" {
 			break
 		}
@@ -1188,44 +10070,105 @@ func handleStreamingResponse(cfg Config, resp *http.Response) (*APIResponse, err
 		var chunk struct {
 			Choices []struct {
 				Delta struct {
-					Content string `json:"content"`
+					Content   string `json:"content"`
+					ToolCalls []struct {
+						Index    int    `json:"index"`
+						ID       string `json:"id"`
+						Type     string `json:"type"`
+						Function struct {
+							Name      string `json:"name"`
+							Arguments string `json:"arguments"`
+						} `json:"function"`
+					} `json:"tool_calls"`
 				} `json:"delta"`
 				FinishReason string `json:"finish_reason"`
 			} `json:"choices"`
+			Error json.RawMessage `json:"error"`
 		}
 
 		if err := json.Unmarshal([]byte(dataStr), &chunk); err != nil {
 			if cfg.Debug {
-				fmt.Fprintf(os.Stderr, "[DEBUG] Error parsing SSE chunk: %v\n", err)
+				fmt.Fprintf(os.Stderr, "[DEBUG] Error parsing stream chunk: %v\n", err)
 			}
 			continue
 		}
+		// Providers report failures mid-stream as {"error": ...} in place of a chunk
+		if len(chunk.Error) > 0 && string(chunk.Error) != "null" {
+			if finalContent.Len() > 0 {
+				fmt.Println(wrap.Flush())
+			}
+			return nil, fmt.Errorf("api error in stream: %s", streamErrorMessage(chunk.Error))
+		}
 
 		// Accumulate content
 		if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
 			finalContent.WriteString(chunk.Choices[0].Delta.Content)
-			fmt.Print(chunk.Choices[0].Delta.Content)
+			if cfg.StreamHybrid && len(toolCalls) > 0 {
+				held.WriteString(chunk.Choices[0].Delta.Content)
+			} else {
+				spin.Stop()
+				fmt.Print(wrap.Write(chunk.Choices[0].Delta.Content))
+			}
+		}
+
+		// Tool call fragments are keyed by index; id, type and name come
+		// once, arguments arrive in pieces
+		if len(chunk.Choices) > 0 && len(chunk.Choices[0].Delta.ToolCalls) > 0 {
+			for _, d := range chunk.Choices[0].Delta.ToolCalls {
+				for len(toolCalls) <= d.Index {
+					toolCalls = append(toolCalls, ToolCall{Type: "function"})
+				}
+				tc := &toolCalls[d.Index]
+				if d.ID != "" {
+					tc.ID = d.ID
+				}
+				if d.Type != "" {
+					tc.Type = d.Type
+				}
+				tc.Function.Name += d.Function.Name
+				tc.Function.Arguments += d.Function.Arguments
+				spin.SetLabel(fmt.Sprintf("assembling %s... %s", tc.Function.Name, formatSize(int64(len(tc.Function.Arguments)))))
+			}
+			if finalContent.Len() > 0 && !strings.HasSuffix(finalContent.String(), "\n") {
+				// Keep the spinner off the end of the streamed text
+				fmt.Println(wrap.Flush())
+				finalContent.WriteString("\n")
+			}
+			spin.Start()
 		}
 
 		// Check for finish reason
 		if len(chunk.Choices) > 0 && chunk.Choices[0].FinishReason != "" {
+			finishReason = chunk.Choices[0].FinishReason
 			break
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return nil, fmt.Errorf("error reading stream: a line exceeds STREAM_MAX_LINE (%d bytes)", cfg.StreamMaxLine)
+		}
 		return nil, fmt.Errorf("error reading stream: %v", err)
 	}
+	if held.Len() > 0 {
+		spin.Stop()
+		fmt.Print(wrap.Write(held.String()))
+	}
+	fmt.Print(wrap.Flush())
+	if text := finalContent.String(); text != "" && !strings.HasSuffix(text, "\n") {
+		fmt.Println()
+	}
 
 	// Create a mock API response with the accumulated content
 	return &APIResponse{
 		Choices: []Choice{
 			{
 				Message: Message{
-					Role:    "assistant",
-					Content: finalContent.String(),
+					Role:      "assistant",
+					Content:   strings.TrimSuffix(finalContent.String(), "\n"),
+					ToolCalls: toolCalls,
 				},
-				FinishReason: "stop",
+				FinishReason: finishReason,
 			},
 		},
 	}, nil
@@ -2,6 +2,9 @@ module mini-claude-code
 
 go 1.21
 
-require golang.org/x/term v0.15.0
+require (
+	golang.org/x/term v0.15.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require golang.org/x/sys v0.15.0 // indirect
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// setProcessGroup is a no-op where process groups are unavailable; the
+// shell itself is still killed on cancellation.
+func setProcessGroup(cmd *exec.Cmd) {}